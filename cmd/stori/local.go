@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	"stori-challenge/pipeline"
+	"stori-challenge/runs"
+	"stori-challenge/summary"
+	"stori-challenge/templates"
+)
+
+// localBucketName stands in for the bucket name in run ids and metadata.
+const localBucketName = "local"
+
+// memoryStore keeps the summaries in memory when no database is given, every account gets the fallback recipient.
+type memoryStore struct {
+	stored []*summary.Message
+}
+
+func (m *memoryStore) StoreSummary(_ context.Context, message *summary.Message) (int64, error) {
+	m.stored = append(m.stored, message)
+
+	return int64(len(m.stored)), nil
+}
+
+func (m *memoryStore) Recipients(_ context.Context, _, fallback string) ([]pipeline.Recipient, error) {
+	if fallback == "" {
+		return nil, nil
+	}
+
+	return []pipeline.Recipient{{Email: fallback, Format: "html"}}, nil
+}
+
+// local runs the parse, store and notify steps in-process with a directory as the bucket, so a CSV can be tried
+// without deploying the stack. The steps are the ones the lambdas run.
+func local(args []string) error {
+	flags := flag.NewFlagSet("local", flag.ExitOnError)
+	dir := flags.String("dir", "local-bucket", "directory used as the bucket")
+	csvPath := flags.String("csv", "", "CSV file to drop under input/, without it every file already under input/ is processed")
+	account := flags.String("account", "", "account folder the CSV file is dropped in, empty drops it directly under input/")
+	dsn := flags.String("dsn", os.Getenv("DATABASE_URL"), "Postgres connection string, defaults to DATABASE_URL; summaries are kept in memory without it")
+	brandName := flags.String("brand", templates.DefaultBrand, "template brand")
+	version := flags.String("version", "", "template version, defaults to the latest")
+	outbox := flags.String("outbox", "", "directory the emails are written to as if they were sent, nothing is sent without it")
+	recipient := flags.String("recipient", "recipient@example.com", "recipient of the accounts without registered recipients")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	bucket := &pipeline.LocalBucket{Root: *dir}
+
+	emailTemplate, err := templates.Get(*brandName, *version)
+	if err != nil {
+		return err
+	}
+	if err = pipeline.UploadEmailTemplates(ctx, bucket, localBucketName); err != nil {
+		return err
+	}
+
+	var repository interface {
+		pipeline.SummaryRepository
+		pipeline.RecipientRepository
+	} = &memoryStore{}
+	var deliveries pipeline.DeliveryRepository
+	var tracker runs.Tracker
+	if *dsn != "" {
+		db, err := sql.Open("postgres", *dsn)
+		if err != nil {
+			return fmt.Errorf("failed to open database connection: %w", err)
+		}
+		defer db.Close()
+
+		postgres := &pipeline.Postgres{DB: db}
+		if err = postgres.Initialize(ctx); err != nil {
+			return fmt.Errorf("failed to initialize the database: %w", err)
+		}
+		repository = postgres
+		deliveries = postgres
+		tracker = runs.Tracker{DB: db}
+	}
+
+	keys, err := inputKeys(*dir, *csvPath, *account)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("nothing to process under %s", filepath.Join(*dir, "input"))
+	}
+
+	parser := &pipeline.Parser{S3: bucket, Tracker: tracker}
+	storer := &pipeline.Storer{Summaries: repository, Tracker: tracker}
+	notifier := &pipeline.Notifier{
+		S3:                bucket,
+		SES:               &pipeline.Outbox{Dir: *outbox},
+		Recipients:        repository,
+		Deliveries:        deliveries,
+		Tracker:           tracker,
+		Bucket:            localBucketName,
+		TemplateKey:       emailTemplate.Key(),
+		Brand:             *brandName,
+		UseSES:            *outbox != "",
+		FallbackRecipient: *recipient,
+	}
+
+	failed := 0
+	for _, key := range keys {
+		if err = runLocal(ctx, bucket, parser, storer, notifier, key); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", key, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed", failed, len(keys))
+	}
+
+	return nil
+}
+
+// runLocal takes one input file through the pipeline, as the state machine does in the stack.
+func runLocal(ctx context.Context, bucket *pipeline.LocalBucket, parser *pipeline.Parser, storer *pipeline.Storer, notifier *pipeline.Notifier, key string) error {
+	filePath := filepath.Join(bucket.Root, filepath.FromSlash(key))
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	// The ETag of a single part upload is the MD5 of the content, and the sequencer only has to grow per upload
+	sum := md5.Sum(content)
+	receivedAt := time.Now().UTC()
+	sequencer := strconv.FormatInt(receivedAt.UnixNano(), 16)
+
+	message, err := parser.Parse(ctx, localBucketName, key, hex.EncodeToString(sum[:]), sequencer, receivedAt)
+	if err != nil {
+		return err
+	}
+
+	// The input file is only archived once notified, and quarantined when storing or notifying failed
+	stored, err := storer.Store(ctx, &message)
+	if err != nil {
+		parser.Quarantine(ctx, &message, err)
+		return err
+	}
+
+	result, err := notifier.Notify(ctx, stored)
+	if err != nil {
+		parser.Quarantine(ctx, &message, err)
+		return err
+	}
+	parser.Archive(ctx, &message)
+
+	fmt.Printf("run %s: %s -> %s", message.RunID, key, filepath.Join(bucket.Root, filepath.FromSlash(result.OutputKey)))
+	if notifier.UseSES {
+		fmt.Printf(", %d emails written to %s", result.Recipients, notifier.SES.(*pipeline.Outbox).Dir)
+	}
+	fmt.Println()
+
+	return nil
+}
+
+// inputKeys drops the CSV file under input/ when given and returns the keys to process.
+func inputKeys(dir, csvPath, account string) ([]string, error) {
+	if csvPath != "" {
+		content, err := os.ReadFile(csvPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CSV file: %w", err)
+		}
+
+		key := path.Join(strings.TrimSuffix(summary.InputPrefix, "/"), account, filepath.Base(csvPath))
+		if err = os.MkdirAll(filepath.Join(dir, filepath.Dir(filepath.FromSlash(key))), 0o755); err != nil {
+			return nil, err
+		}
+		if err = os.WriteFile(filepath.Join(dir, filepath.FromSlash(key)), content, 0o644); err != nil {
+			return nil, err
+		}
+
+		return []string{key}, nil
+	}
+
+	var keys []string
+	root := filepath.Join(dir, filepath.FromSlash(summary.InputPrefix))
+	err := filepath.WalkDir(root, func(filePath string, entry os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+
+		relative, err := filepath.Rel(dir, filePath)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, filepath.ToSlash(relative))
+
+		return nil
+	})
+	sort.Strings(keys)
+
+	return keys, err
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"stori-challenge/summary"
+	"stori-challenge/templates"
+)
+
+const usage = `Usage: stori <command> [flags]
+
+Commands:
+  local     run the whole pipeline on a local directory used as the bucket, without AWS
+  preview   render an email template against a local CSV file into an HTML file
+  redrive   move the messages of a dead-letter queue back to its source queue
+  runs      list processing runs or show the error and rejection report of one
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "local":
+		err = local(os.Args[2:])
+	case "preview":
+		err = preview(os.Args[2:])
+	case "redrive":
+		err = redrive(os.Args[2:])
+	case "runs":
+		err = listRuns(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "stori %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+// preview renders a template against a sample CSV without touching AWS.
+func preview(args []string) error {
+	flags := flag.NewFlagSet("preview", flag.ExitOnError)
+	csvPath := flags.String("csv", "resources/sample.csv", "CSV file with the transactions")
+	brandName := flags.String("brand", templates.DefaultBrand, "template brand")
+	version := flags.String("version", "", "template version, defaults to the latest")
+	out := flags.String("out", "preview.html", "output HTML file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	csvData, err := os.ReadFile(*csvPath)
+	if err != nil {
+		return fmt.Errorf("failed to read CSV file: %w", err)
+	}
+
+	summaryData, report, err := summary.ParseCSV(string(csvData))
+	if err != nil {
+		for _, rejection := range report.Rejections {
+			fmt.Fprintf(os.Stderr, "%s:%d: %s\n", *csvPath, rejection.Line, rejection.Reason)
+		}
+		return fmt.Errorf("failed to process CSV data: %w", err)
+	}
+
+	brand, err := templates.GetBrand(*brandName)
+	if err != nil {
+		return err
+	}
+
+	emailTemplate, err := templates.Get(*brandName, *version)
+	if err != nil {
+		return err
+	}
+
+	emailBody, err := templates.Render(emailTemplate.Body, brand, templates.Recipient{}, &summaryData)
+	if err != nil {
+		return err
+	}
+
+	if err = os.WriteFile(*out, emailBody.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("failed to write preview: %w", err)
+	}
+
+	fmt.Printf("rendered %s with %s/%s to %s\n", *csvPath, emailTemplate.Brand, emailTemplate.Version, *out)
+
+	return nil
+}
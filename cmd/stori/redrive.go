@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// redrive moves the messages of a dead-letter queue back to the queue they failed from.
+func redrive(args []string) error {
+	flags := flag.NewFlagSet("redrive", flag.ExitOnError)
+	from := flags.String("from", "", "URL of the dead-letter queue to drain")
+	to := flags.String("to", "", "URL of the queue to send the messages back to")
+	limit := flags.Int("max", 0, "maximum number of messages to move, 0 moves all of them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" || *to == "" {
+		return fmt.Errorf("both -from and -to are required")
+	}
+
+	ctx := context.Background()
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	sqsClient := sqs.NewFromConfig(cfg)
+
+	moved := 0
+	for *limit == 0 || moved < *limit {
+		batch := int32(10)
+		if *limit > 0 && *limit-moved < 10 {
+			batch = int32(*limit - moved)
+		}
+
+		output, err := sqsClient.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:              aws.String(*from),
+			MaxNumberOfMessages:   batch,
+			WaitTimeSeconds:       1,
+			MessageAttributeNames: []string{"All"},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to receive messages: %w", err)
+		}
+		if len(output.Messages) == 0 {
+			break
+		}
+
+		for _, message := range output.Messages {
+			_, err = sqsClient.SendMessage(ctx, &sqs.SendMessageInput{
+				QueueUrl:          aws.String(*to),
+				MessageBody:       message.Body,
+				MessageAttributes: message.MessageAttributes,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to send message %s, %d moved so far: %w", aws.ToString(message.MessageId), moved, err)
+			}
+
+			_, err = sqsClient.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(*from),
+				ReceiptHandle: message.ReceiptHandle,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to delete message %s, %d moved so far: %w", aws.ToString(message.MessageId), moved, err)
+			}
+			moved++
+		}
+	}
+
+	fmt.Printf("moved %d messages from %s to %s\n", moved, *from, *to)
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	_ "github.com/lib/pq"
+	"stori-challenge/runs"
+)
+
+// listRuns prints the latest processing runs, or the details of one run with 'runs show <run-id>'. The database
+// of a deployed stack is only reachable from inside its VPC, so the runs are read through its process-csv-lambda,
+// while -dsn connects to a local database directly.
+func listRuns(args []string) error {
+	show := len(args) > 0 && args[0] == "show"
+	if show {
+		args = args[1:]
+	}
+
+	flags := flag.NewFlagSet("runs", flag.ExitOnError)
+	function := flags.String("function", os.Getenv("STORI_RUNS_FUNCTION"),
+		"process-csv-lambda of the deployed stack, its ProcessCsvLambdaName output, defaults to STORI_RUNS_FUNCTION")
+	dsn := flags.String("dsn", os.Getenv("DATABASE_URL"), "Postgres connection string of a local database, defaults to DATABASE_URL")
+	status := flags.String("status", "", "only list runs with this status, e.g. failed")
+	limit := flags.Int("limit", 20, "maximum number of runs to list")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *function == "" && *dsn == "" {
+		return fmt.Errorf("-function, STORI_RUNS_FUNCTION, -dsn or DATABASE_URL is required")
+	}
+	if show && flags.NArg() != 1 {
+		return fmt.Errorf("usage: stori runs show [flags] <run-id>")
+	}
+
+	query := runs.Query{Status: *status, Limit: *limit}
+	if show {
+		query.RunID = flags.Arg(0)
+	}
+
+	ctx := context.Background()
+	var list []runs.Run
+	var err error
+	if *function != "" {
+		list, err = invokeRuns(ctx, *function, query)
+	} else {
+		list, err = readRuns(ctx, *dsn, query)
+	}
+	if err != nil {
+		return err
+	}
+
+	if show {
+		if len(list) == 0 {
+			return fmt.Errorf("run %s not found", query.RunID)
+		}
+		printRun(list[0])
+		return nil
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "RUN ID\tSTATUS\tSTAGE\tROWS\tREJECTED\tSTARTED\tINPUT")
+	for _, run := range list {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%d\t%d\t%s\t%s\n", run.RunID, run.Status, run.Stage, run.RowsParsed,
+			run.RowsRejected, run.StartedAt.UTC().Format(time.RFC3339), run.InputKey)
+	}
+
+	return writer.Flush()
+}
+
+// invokeRuns reads the runs through the process-csv-lambda, which answers runs.QueryRequest payloads.
+func invokeRuns(ctx context.Context, function string, query runs.Query) ([]runs.Run, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	payload, err := json.Marshal(runs.QueryRequest{RunsQuery: &query})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal runs query: %w", err)
+	}
+
+	output, err := lambda.NewFromConfig(cfg).Invoke(ctx, &lambda.InvokeInput{
+		FunctionName: aws.String(function),
+		Payload:      payload,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to invoke %s: %w", function, err)
+	}
+	if output.FunctionError != nil {
+		var functionErr struct {
+			ErrorMessage string `json:"errorMessage"`
+		}
+		if err = json.Unmarshal(output.Payload, &functionErr); err != nil || functionErr.ErrorMessage == "" {
+			functionErr.ErrorMessage = string(output.Payload)
+		}
+		return nil, fmt.Errorf("%s failed: %s", function, functionErr.ErrorMessage)
+	}
+
+	var list []runs.Run
+	if err = json.Unmarshal(output.Payload, &list); err != nil {
+		return nil, fmt.Errorf("failed to decode %s response: %w", function, err)
+	}
+
+	return list, nil
+}
+
+// readRuns reads the runs from a database the CLI can connect to, e.g. the one of docker-compose.
+func readRuns(ctx context.Context, dsn string, query runs.Query) ([]runs.Run, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database connection: %w", err)
+	}
+	defer db.Close()
+
+	return runs.Reader{DB: db}.Runs(ctx, query)
+}
+
+// printRun prints every field of a run followed by its rejection report.
+func printRun(run runs.Run) {
+	fmt.Printf("Run:       %s\n", run.RunID)
+	fmt.Printf("Input:     s3://%s/%s (etag %s)\n", run.Bucket, run.InputKey, run.ETag)
+	fmt.Printf("Account:   %s\n", run.Account)
+	fmt.Printf("Status:    %s (stage %s)\n", run.Status, run.Stage)
+	fmt.Printf("Rows:      %d parsed, %d rejected\n", run.RowsParsed, run.RowsRejected)
+	fmt.Printf("Started:   %s\n", run.StartedAt.UTC().Format(time.RFC3339))
+	if run.FinishedAt != nil {
+		fmt.Printf("Finished:  %s\n", run.FinishedAt.UTC().Format(time.RFC3339))
+	}
+	if run.SummaryRecordID != nil {
+		fmt.Printf("Record:    %d\n", *run.SummaryRecordID)
+	}
+	if run.OutputKey != "" {
+		fmt.Printf("Output:    %s\n", run.OutputKey)
+	}
+	if run.Error != "" {
+		fmt.Printf("Error:     %s\n", run.Error)
+	}
+
+	if len(run.RejectionReport) > 0 {
+		fmt.Println("Rejected rows:")
+		for _, rejection := range run.RejectionReport {
+			fmt.Printf("  line %d: %s\n", rejection.Line, rejection.Reason)
+		}
+	}
+}
@@ -1,91 +1,435 @@
 package config
 
 import (
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslogs"
 	"github.com/aws/constructs-go/constructs/v10"
 	"github.com/aws/jsii-runtime-go"
-	"strconv"
+	"stori-challenge/templates"
+)
+
+// Orchestration modes of the pipeline.
+const (
+	// OrchestrationStepFunctions runs parse, store and notify as tasks of a state machine.
+	OrchestrationStepFunctions = "stepfunctions"
+	// OrchestrationInvoke has the process-csv-lambda invoke the store and send lambdas synchronously.
+	OrchestrationInvoke = "invoke"
+	// OrchestrationQueue has the process-csv-lambda publish the summary to a topic feeding the store queue, the
+	// store-summary-lambda then queues the stored summary to the send queue, each with its own dead-letter queue.
+	OrchestrationQueue = "queue"
 )
 
-// EnableSES set SES by 'cdk.json/context/enableSES'.
-func EnableSES(scope constructs.Construct) string {
-	enableSes := false
+// VPC endpoints the lambdas can reach the AWS services through, named after the services.
+const (
+	EndpointS3             = "s3"
+	EndpointSecretsManager = "secretsmanager"
+	EndpointLambda         = "lambda"
+	EndpointSES            = "ses"
+	EndpointSQS            = "sqs"
+	EndpointSNS            = "sns"
+	EndpointXRay           = "xray"
+)
+
+// endpoints are the supported VPC endpoints, in the order they are created.
+var endpoints = []string{EndpointS3, EndpointSecretsManager, EndpointLambda, EndpointSES, EndpointSQS, EndpointSNS, EndpointXRay}
+
+// Config is the deployment configuration, read from the 'cdk.json/context' keys named after the json tags.
+type Config struct {
+	StackName string `json:"stackName"`
+
+	DBName string `json:"dbName"`
+	DBUser string `json:"dbUser"`
+	// DBPasswordRotationDays is how often Secrets Manager rotates the generated password.
+	DBPasswordRotationDays float64 `json:"dbPasswordRotationDays"`
+	DBInstanceType         string  `json:"dbInstanceType"`
+	DBAllocatedStorage     float64 `json:"dbAllocatedStorage"`
+	DBMultiAz              bool    `json:"dbMultiAz"`
+	DBBackupRetentionDays  float64 `json:"dbBackupRetentionDays"`
+	// DeletionProtection keeps the database, and snapshots it when the stack is deleted anyway.
+	DeletionProtection bool    `json:"deletionProtection"`
+	LogRetentionDays   float64 `json:"logRetentionDays"`
+	// LogEmails keeps the email addresses in the lambda logs, they are redacted otherwise.
+	LogEmails bool `json:"logEmails"`
+
+	// EnableSES sends the emails, SenderEmail and RecipientEmail are required then. RecipientEmail gets the
+	// summaries of the accounts without registered recipients.
+	EnableSES      bool   `json:"enableSES"`
+	SenderEmail    string `json:"senderEmail"`
+	RecipientEmail string `json:"recipientEmail"`
+	// AlarmEmail is subscribed to the alarm topic, the alarms are only visible in CloudWatch without it.
+	AlarmEmail string `json:"alarmEmail"`
+
+	// EmailBrand picks the email template, an entry for the deployment account in AccountBrands takes precedence.
+	// An empty EmailTemplateVersion uses the latest one.
+	EmailBrand           string            `json:"emailBrand"`
+	EmailTemplateVersion string            `json:"emailTemplateVersion"`
+	AccountBrands        map[string]string `json:"accountBrands"`
+
+	Orchestration string `json:"orchestration"`
+
+	// NatGateways gives the private subnets of the lambdas internet access, without them the lambdas only reach
+	// the services of VpcEndpoints.
+	NatGateways  float64  `json:"natGateways"`
+	VpcEndpoints []string `json:"vpcEndpoints"`
+}
+
+// defaults are the values of the keys missing from the context. Email addresses have no default, a mistyped key
+// must not silently send to a made up address.
+var defaults = Config{
+	StackName:              "StoriChallengeStack",
+	DBName:                 "postgres",
+	DBUser:                 "adminStori",
+	DBPasswordRotationDays: 30,
+	DBInstanceType:         "t3.micro",
+	DBAllocatedStorage:     100,
+	DBBackupRetentionDays:  1,
+	LogRetentionDays:       7,
+	EmailBrand:             templates.DefaultBrand,
+	Orchestration:          OrchestrationStepFunctions,
+	VpcEndpoints:           endpoints,
+}
+
+// FileKey names the context key of an optional JSON file whose values override the context ones, e.g. set by an
+// environment to 'config/prod.json'.
+const FileKey = "configFile"
+
+// contextEnv is how the CDK CLI hands the context of cdk.json, cdk.context.json and the '-c' options to the app.
+const contextEnv = "CDK_CONTEXT_JSON"
+
+// appKeys are the context keys read by the app besides the configuration ones.
+var appKeys = []string{"environments", "env", "deploymentPipeline", "dbPass", "acknowledged-issue-numbers"}
+
+var (
+	identifierPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{0,62}$`)
+	stackNamePattern  = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9-]{0,127}$`)
+)
+
+// retentionDays are the log retention periods CloudWatch supports, in days.
+var retentionDays = map[float64]awslogs.RetentionDays{
+	1: awslogs.RetentionDays_ONE_DAY, 3: awslogs.RetentionDays_THREE_DAYS, 5: awslogs.RetentionDays_FIVE_DAYS,
+	7: awslogs.RetentionDays_ONE_WEEK, 14: awslogs.RetentionDays_TWO_WEEKS, 30: awslogs.RetentionDays_ONE_MONTH,
+	60: awslogs.RetentionDays_TWO_MONTHS, 90: awslogs.RetentionDays_THREE_MONTHS,
+	120: awslogs.RetentionDays_FOUR_MONTHS, 150: awslogs.RetentionDays_FIVE_MONTHS,
+	180: awslogs.RetentionDays_SIX_MONTHS, 365: awslogs.RetentionDays_ONE_YEAR,
+	400: awslogs.RetentionDays_THIRTEEN_MONTHS, 545: awslogs.RetentionDays_EIGHTEEN_MONTHS,
+	731: awslogs.RetentionDays_TWO_YEARS, 1096: awslogs.RetentionDays_THREE_YEARS,
+	1827: awslogs.RetentionDays_FIVE_YEARS, 2192: awslogs.RetentionDays_SIX_YEARS,
+	2557: awslogs.RetentionDays_SEVEN_YEARS, 2922: awslogs.RetentionDays_EIGHT_YEARS,
+	3288: awslogs.RetentionDays_NINE_YEARS, 3653: awslogs.RetentionDays_TEN_YEARS,
+}
+
+// ValidationError lists every problem found in the configuration.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// Load reads the configuration from the context of the scope, so the overrides of an environment stage apply, and
+// validates it.
+func Load(scope constructs.Construct) (Config, error) {
+	values := make(map[string]interface{})
+	for _, key := range Keys() {
+		if value := scope.Node().TryGetContext(jsii.String(key)); value != nil {
+			values[key] = value
+		}
+	}
+
+	var problems []string
+	if scope.Node().TryGetContext(jsii.String("dbPass")) != nil {
+		problems = append(problems, "dbPass: the database password is generated by Secrets Manager, remove the key")
+	}
+	if err := checkContext(os.Getenv(contextEnv)); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if file, ok := scope.Node().TryGetContext(jsii.String(FileKey)).(string); ok && file != "" {
+		fileValues, err := readFile(file)
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		for key, value := range fileValues {
+			values[key] = value
+		}
+	}
+
+	config, decodeProblems := decode(values)
+	problems = append(problems, decodeProblems...)
+	problems = append(problems, config.validate()...)
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return config, &ValidationError{Problems: problems}
+	}
+
+	return config, nil
+}
+
+// Keys returns the context keys of the configuration.
+func Keys() []string {
+	keys := append([]string{FileKey}, fields()...)
+	sort.Strings(keys)
+
+	return keys
+}
+
+// IsKey reports whether the context key belongs to the configuration.
+func IsKey(key string) bool {
+	for _, k := range Keys() {
+		if k == key {
+			return true
+		}
+	}
+
+	return false
+}
 
-	ctxValue := scope.Node().TryGetContext(jsii.String("enableSES"))
-	if v, ok := ctxValue.(bool); ok {
-		enableSes = v
+// Brand returns the email template brand of the deployment account.
+func (c Config) Brand(account string) string {
+	if brand, ok := c.AccountBrands[account]; ok && brand != "" {
+		return brand
 	}
 
-	return strconv.FormatBool(enableSes)
+	return c.EmailBrand
 }
 
-// StackName change stack name by 'cdk.json/context/stackName'.
-func StackName(scope constructs.Construct) string {
-	stackName := "StoriChallengeStack"
+// LogRetention returns the retention period of LogRetentionDays, which is validated to be a supported one.
+func (c Config) LogRetention() awslogs.RetentionDays {
+	return retentionDays[c.LogRetentionDays]
+}
 
-	ctxValue := scope.Node().TryGetContext(jsii.String("stackName"))
-	if v, ok := ctxValue.(string); ok {
-		stackName = v
+// fields returns the json names of the Config fields.
+func fields() []string {
+	configType := reflect.TypeOf(Config{})
+	names := make([]string, 0, configType.NumField())
+	for i := 0; i < configType.NumField(); i++ {
+		names = append(names, configType.Field(i).Tag.Get("json"))
 	}
 
-	return stackName
+	return names
 }
 
-// DBUser   change user id by 'cdk.json/context/dbUser'.
-func DBUser(scope constructs.Construct) string {
-	userID := "adminStori"
+// readFile reads the configuration file, unknown keys are rejected since they are most likely mistyped.
+func readFile(file string) (map[string]interface{}, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s %s: %w", FileKey, file, err)
+	}
+
+	var values map[string]interface{}
+	if err = json.Unmarshal(content, &values); err != nil {
+		return nil, fmt.Errorf("failed to parse %s %s: %w", FileKey, file, err)
+	}
 
-	ctxValue := scope.Node().TryGetContext(jsii.String("dbUser"))
-	if v, ok := ctxValue.(string); ok {
-		userID = v
+	var unknown []string
+	for key := range values {
+		if key == FileKey || !IsKey(key) {
+			unknown = append(unknown, key)
+			delete(values, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return values, fmt.Errorf("%s %s: unknown keys %s", FileKey, file, strings.Join(unknown, ", "))
 	}
 
-	return userID
+	return values, nil
 }
 
-// DBPass   change user id by 'cdk.json/context/dbPass'.
-func DBPass(scope constructs.Construct) string {
-	userID := "adminPass"
+// checkContext rejects the unknown keys of the CLI context the same way readFile does, since TryGetContext alone
+// would silently ignore a mistyped key. The feature flags and cached lookups of the CDK, whose keys start with '@'
+// or contain ':', are left alone.
+func checkContext(contextJSON string) error {
+	if contextJSON == "" {
+		return nil
+	}
 
-	ctxValue := scope.Node().TryGetContext(jsii.String("dbPass"))
-	if v, ok := ctxValue.(string); ok {
-		userID = v
+	var values map[string]interface{}
+	if err := json.Unmarshal([]byte(contextJSON), &values); err != nil {
+		return fmt.Errorf("context: failed to parse %s: %w", contextEnv, err)
 	}
 
-	return userID
+	var unknown []string
+	for key := range values {
+		if strings.HasPrefix(key, "@") || strings.Contains(key, ":") || contains(appKeys, key) || IsKey(key) {
+			continue
+		}
+		unknown = append(unknown, key)
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("context: unknown keys %s", strings.Join(unknown, ", "))
+	}
+
+	return nil
 }
 
-// SenderEmail change user id by 'cdk.json/context/senderEmail'.
-func SenderEmail(scope constructs.Construct) string {
-	userID := "someemail@email.com"
+// decode applies the values over the defaults, reporting the ones of the wrong type.
+func decode(values map[string]interface{}) (Config, []string) {
+	config := defaults
+	// Decoding a list reuses the backing array of the default one, it must not be shared
+	config.VpcEndpoints = append([]string(nil), defaults.VpcEndpoints...)
+	var problems []string
+	for _, key := range fields() {
+		value, ok := values[key]
+		if !ok {
+			continue
+		}
 
-	ctxValue := scope.Node().TryGetContext(jsii.String("senderEmail"))
-	if v, ok := ctxValue.(string); ok {
-		userID = v
+		// Decoding the key alone keeps the other values when one has the wrong type
+		encoded, err := json.Marshal(map[string]interface{}{key: value})
+		if err == nil {
+			err = json.Unmarshal(encoded, &config)
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: expected %s, got %v", key, kindOf(key), value))
+		}
 	}
 
-	return userID
+	return config, problems
 }
 
-// RecipientEmail   change user id by 'cdk.json/context/recipientEmail'.
-func RecipientEmail(scope constructs.Construct) string {
-	userID := "recipient@some.com"
+// kindOf describes the type of the value expected for the key.
+func kindOf(key string) string {
+	switch key {
+	case "dbAllocatedStorage", "dbBackupRetentionDays", "dbPasswordRotationDays", "logRetentionDays", "natGateways":
+		return "a number"
+	case "dbMultiAz", "deletionProtection", "enableSES", "logEmails":
+		return "a boolean"
+	case "accountBrands":
+		return "an object of account ids to brands"
+	case "vpcEndpoints":
+		return "a list of services"
+	default:
+		return "a string"
+	}
+}
+
+// validate returns every problem of the configuration.
+func (c Config) validate() []string {
+	var problems []string
+	problemf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if !stackNamePattern.MatchString(c.StackName) {
+		problemf("stackName: %q must start with a letter and only contain letters, digits and hyphens", c.StackName)
+	}
+
+	if !identifierPattern.MatchString(c.DBName) {
+		problemf("dbName: %q must start with a letter and only contain letters, digits and underscores", c.DBName)
+	}
+	if !identifierPattern.MatchString(c.DBUser) || strings.EqualFold(c.DBUser, "rdsadmin") {
+		problemf("dbUser: %q must start with a letter, only contain letters, digits and underscores and not be reserved", c.DBUser)
+	}
+
+	if c.DBPasswordRotationDays < 1 || c.DBPasswordRotationDays > 1000 {
+		problemf("dbPasswordRotationDays: %v must be between 1 and 1000", c.DBPasswordRotationDays)
+	}
+
+	if c.DBInstanceType == "" {
+		problemf("dbInstanceType: is required")
+	}
+	if c.DBAllocatedStorage < 20 || c.DBAllocatedStorage > 65536 {
+		problemf("dbAllocatedStorage: %v must be between 20 and 65536 GiB", c.DBAllocatedStorage)
+	}
+	if c.DBBackupRetentionDays < 0 || c.DBBackupRetentionDays > 35 {
+		problemf("dbBackupRetentionDays: %v must be between 0 and 35", c.DBBackupRetentionDays)
+	}
+	if _, ok := retentionDays[c.LogRetentionDays]; !ok {
+		problemf("logRetentionDays: %v is not a retention period supported by CloudWatch", c.LogRetentionDays)
+	}
+
+	// Accounts without registered recipients fall back to recipientEmail, sending needs both
+	if c.EnableSES && c.SenderEmail == "" {
+		problemf("senderEmail: is required when enableSES is set")
+	}
+	if c.EnableSES && c.RecipientEmail == "" {
+		problemf("recipientEmail: is required when enableSES is set")
+	}
+	for key, address := range map[string]string{"senderEmail": c.SenderEmail, "recipientEmail": c.RecipientEmail, "alarmEmail": c.AlarmEmail} {
+		if address == "" {
+			continue
+		}
+		if parsed, err := mail.ParseAddress(address); err != nil || parsed.Address != address {
+			problemf("%s: %q is not an email address", key, address)
+		}
+	}
+
+	brands := map[string]string{"emailBrand": c.EmailBrand}
+	for account, brand := range c.AccountBrands {
+		brands["accountBrands."+account] = brand
+	}
+	for key, brand := range brands {
+		if _, err := templates.Get(brand, c.EmailTemplateVersion); err != nil {
+			problemf("%s: %v", key, err)
+		}
+	}
 
-	ctxValue := scope.Node().TryGetContext(jsii.String("recipientEmail"))
-	if v, ok := ctxValue.(string); ok {
-		userID = v
+	switch c.Orchestration {
+	case OrchestrationStepFunctions, OrchestrationInvoke, OrchestrationQueue:
+	default:
+		problemf("orchestration: %q must be one of %s, %s or %s", c.Orchestration,
+			OrchestrationStepFunctions, OrchestrationInvoke, OrchestrationQueue)
 	}
 
-	return userID
+	// One NAT gateway per availability zone at most, the VPC spans two
+	if c.NatGateways < 0 || c.NatGateways > 2 || c.NatGateways != float64(int(c.NatGateways)) {
+		problemf("natGateways: %v must be 0, 1 or 2", c.NatGateways)
+	}
+	for _, endpoint := range c.VpcEndpoints {
+		if !contains(endpoints, endpoint) {
+			problemf("vpcEndpoints: %q must be one of %s", endpoint, strings.Join(endpoints, ", "))
+		}
+	}
+	if c.NatGateways == 0 {
+		for _, endpoint := range c.requiredEndpoints() {
+			if !contains(c.VpcEndpoints, endpoint) {
+				problemf("vpcEndpoints: %s is required without natGateways", endpoint)
+			}
+		}
+	}
+
+	return problems
+}
+
+// HasEndpoint reports whether the VPC gets an endpoint for the service.
+func (c Config) HasEndpoint(endpoint string) bool {
+	return contains(c.VpcEndpoints, endpoint)
 }
 
-// DBName change region by 'cdk.json/context/dbName'.
-func DBName(scope constructs.Construct) string {
-	dbName := "postgres"
+// requiredEndpoints are the services the lambdas call with this configuration. X-Ray is not one of them, the
+// lambdas work without it and only their traces are lost.
+func (c Config) requiredEndpoints() []string {
+	required := []string{EndpointS3, EndpointSecretsManager}
+	if c.EnableSES {
+		required = append(required, EndpointSES)
+	}
+	switch c.Orchestration {
+	case OrchestrationInvoke:
+		required = append(required, EndpointLambda)
+	case OrchestrationQueue:
+		// The process lambda publishes to the summary topic and the store lambda sends to the send queue
+		required = append(required, EndpointSNS, EndpointSQS)
+	}
+
+	return required
+}
 
-	ctxValue := scope.Node().TryGetContext(jsii.String("dbName"))
-	if v, ok := ctxValue.(string); ok {
-		dbName = v
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
 	}
 
-	return dbName
+	return false
 }
@@ -0,0 +1,146 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslogs"
+	"github.com/stretchr/testify/require"
+)
+
+func load(t *testing.T, context map[string]interface{}) (Config, error) {
+	t.Helper()
+
+	return Load(awscdk.NewApp(&awscdk.AppProps{Context: &context}))
+}
+
+func TestLoad(t *testing.T) {
+	config, err := load(t, map[string]interface{}{
+		"enableSES":        true,
+		"senderEmail":      "sender@example.com",
+		"recipientEmail":   "recipient@example.com",
+		"logRetentionDays": 30,
+		"logEmails":        true,
+		"accountBrands":    map[string]interface{}{"123456789012": "stori-plus"},
+		"orchestration":    OrchestrationQueue,
+	})
+	require.NoError(t, err)
+
+	expected := defaults
+	expected.EnableSES = true
+	expected.SenderEmail = "sender@example.com"
+	expected.RecipientEmail = "recipient@example.com"
+	expected.LogRetentionDays = 30
+	expected.LogEmails = true
+	expected.AccountBrands = map[string]string{"123456789012": "stori-plus"}
+	expected.Orchestration = OrchestrationQueue
+	require.Equal(t, expected, config)
+
+	require.Equal(t, "stori-plus", config.Brand("123456789012"))
+	require.Equal(t, "stori", config.Brand("210987654321"))
+	require.Equal(t, awslogs.RetentionDays_ONE_MONTH, config.LogRetention())
+}
+
+func TestLoadListsEveryProblem(t *testing.T) {
+	_, err := load(t, map[string]interface{}{
+		"stackName":              "my stack",
+		"alarmEmail":             "ops",
+		"dbPass":                 "adminPass",
+		"dbPasswordRotationDays": 0,
+		"dbAllocatedStorage":     "lots",
+		"enableSES":              "true",
+		"recipientEmail":         "<RECIPIENT-EMAIL>",
+		"logRetentionDays":       10,
+		"emailBrand":             "unknown",
+		"orchestration":          "cron",
+	})
+
+	var validationErr *ValidationError
+	require.ErrorAs(t, err, &validationErr)
+	require.Equal(t, []string{
+		`alarmEmail: "ops" is not an email address`,
+		"dbAllocatedStorage: expected a number, got lots",
+		"dbPass: the database password is generated by Secrets Manager, remove the key",
+		"dbPasswordRotationDays: 0 must be between 1 and 1000",
+		"emailBrand: no templates for brand unknown: open files/unknown: file does not exist",
+		"enableSES: expected a boolean, got true",
+		"logRetentionDays: 10 is not a retention period supported by CloudWatch",
+		`orchestration: "cron" must be one of stepfunctions, invoke or queue`,
+		`recipientEmail: "<RECIPIENT-EMAIL>" is not an email address`,
+		`stackName: "my stack" must start with a letter and only contain letters, digits and hyphens`,
+	}, validationErr.Problems)
+}
+
+func TestLoadRequiresEmailsWithSES(t *testing.T) {
+	_, err := load(t, map[string]interface{}{"enableSES": true})
+
+	var validationErr *ValidationError
+	require.ErrorAs(t, err, &validationErr)
+	require.Equal(t, []string{
+		"recipientEmail: is required when enableSES is set",
+		"senderEmail: is required when enableSES is set",
+	}, validationErr.Problems)
+}
+
+func TestLoadRejectsUnknownContextKeys(t *testing.T) {
+	// The CLI passes cdk.json and the -c options through the environment, NewApp reads them from there too
+	t.Setenv(contextEnv, `{"sesEnable": true, "dbUsr": "someone", "dbUser": "someone", "env": "dev",
+		"@aws-cdk/core:checkSecretUsage": true, "availability-zones:account=123456789012:region=us-east-1": []}`)
+
+	_, err := Load(awscdk.NewApp(nil))
+
+	var validationErr *ValidationError
+	require.ErrorAs(t, err, &validationErr)
+	require.Equal(t, []string{"context: unknown keys dbUsr, sesEnable"}, validationErr.Problems)
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "prod.json")
+	require.NoError(t, os.WriteFile(file, []byte(`{"dbUser": "fromTheFile", "dbInstanceType": "t3.medium"}`), 0o600))
+
+	config, err := load(t, map[string]interface{}{"dbUser": "fromTheContext", FileKey: file})
+	require.NoError(t, err)
+	require.Equal(t, "fromTheFile", config.DBUser)
+	require.Equal(t, "t3.medium", config.DBInstanceType)
+
+	// Mistyped keys of the file are reported instead of being ignored
+	require.NoError(t, os.WriteFile(file, []byte(`{"dbUsr": "fromTheFile", "dbInstanceTyp": "t3.medium"}`), 0o600))
+
+	_, err = load(t, map[string]interface{}{FileKey: file})
+	var validationErr *ValidationError
+	require.ErrorAs(t, err, &validationErr)
+	require.Equal(t, []string{"configFile " + file + ": unknown keys dbInstanceTyp, dbUsr"}, validationErr.Problems)
+}
+
+func TestLoadVpcEndpoints(t *testing.T) {
+	config, err := load(t, map[string]interface{}{"natGateways": 1, "vpcEndpoints": []interface{}{"s3"}})
+	require.NoError(t, err)
+	require.True(t, config.HasEndpoint(EndpointS3))
+	require.False(t, config.HasEndpoint(EndpointSecretsManager))
+	require.Equal(t, []string{"s3", "secretsmanager", "lambda", "ses", "sqs", "sns", "xray"}, defaults.VpcEndpoints)
+
+	// Without NAT gateways the lambdas need an endpoint for every service they call
+	_, err = load(t, map[string]interface{}{
+		"enableSES":      true,
+		"senderEmail":    "sender@example.com",
+		"recipientEmail": "recipient@example.com",
+		"orchestration":  OrchestrationQueue,
+		"vpcEndpoints":   []interface{}{"s3", "sqs", "dynamodb"},
+	})
+
+	var validationErr *ValidationError
+	require.ErrorAs(t, err, &validationErr)
+	require.Equal(t, []string{
+		`vpcEndpoints: "dynamodb" must be one of s3, secretsmanager, lambda, ses, sqs, sns, xray`,
+		"vpcEndpoints: secretsmanager is required without natGateways",
+		"vpcEndpoints: ses is required without natGateways",
+		"vpcEndpoints: sns is required without natGateways",
+	}, validationErr.Problems)
+
+	_, err = load(t, map[string]interface{}{"natGateways": 1.5})
+	require.ErrorAs(t, err, &validationErr)
+	require.Equal(t, []string{"natGateways: 1.5 must be 0, 1 or 2"}, validationErr.Problems)
+}
@@ -0,0 +1,146 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// Environment is a deployment stage of the app, e.g. dev, staging or prod, declared by an entry of
+// 'cdk.json/context/environments'.
+type Environment struct {
+	// Name identifies the stage, its stacks are named after it.
+	Name string
+	// Account and Region of the stage, empty ones use CDK_DEFAULT_ACCOUNT and CDK_DEFAULT_REGION.
+	Account string
+	Region  string
+	// Context holds every other key of the entry, e.g. dbInstanceType, enableSES or configFile. They override the
+	// top level context values for the stacks of the stage, and must be keys of Config.
+	Context map[string]interface{}
+}
+
+// Environments read the deployment stages by 'cdk.json/context/environments', in promotion order. Each entry needs
+// a unique name, the remaining keys override the context of the stage.
+func Environments(scope constructs.Construct) ([]Environment, error) {
+	ctxValue := scope.Node().TryGetContext(jsii.String("environments"))
+	if ctxValue == nil {
+		return nil, nil
+	}
+
+	entries, ok := ctxValue.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("environments must be a list, got %T", ctxValue)
+	}
+
+	environments := make([]Environment, 0, len(entries))
+	names := make(map[string]bool)
+	for i, entry := range entries {
+		values, ok := entry.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("environment %d must be an object, got %T", i, entry)
+		}
+
+		environment := Environment{Context: make(map[string]interface{})}
+		for key, value := range values {
+			switch key {
+			case "name":
+				environment.Name, _ = value.(string)
+			case "account":
+				environment.Account, _ = value.(string)
+			case "region":
+				environment.Region, _ = value.(string)
+			default:
+				if !IsKey(key) {
+					return nil, fmt.Errorf("environment %v: unknown key %q", values["name"], key)
+				}
+				environment.Context[key] = value
+			}
+		}
+
+		if environment.Name == "" {
+			return nil, fmt.Errorf("environment %d has no name", i)
+		}
+		if names[environment.Name] {
+			return nil, fmt.Errorf("environment %s is declared twice", environment.Name)
+		}
+		names[environment.Name] = true
+
+		environments = append(environments, environment)
+	}
+
+	return environments, nil
+}
+
+// SelectedEnvironments keep the stages named by 'cdk.json/context/env', a comma separated list usually given on
+// the command line, e.g. 'cdk deploy -c env=dev'. Every stage is kept when it is not set.
+func SelectedEnvironments(scope constructs.Construct, environments []Environment) ([]Environment, error) {
+	ctxValue, _ := scope.Node().TryGetContext(jsii.String("env")).(string)
+	if ctxValue == "" {
+		return environments, nil
+	}
+
+	var selected []Environment
+	for _, name := range strings.Split(ctxValue, ",") {
+		name = strings.TrimSpace(name)
+		found := false
+		for _, environment := range environments {
+			if environment.Name == name {
+				selected = append(selected, environment)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown environment %q", name)
+		}
+	}
+
+	return selected, nil
+}
+
+// DeploymentPipeline is the CDK pipeline promoting the app through the environments, configured by
+// 'cdk.json/context/deploymentPipeline'.
+type DeploymentPipeline struct {
+	// Repository is the GitHub repository, as owner/name, and Branch the branch that gets deployed.
+	Repository string
+	Branch     string
+	// ConnectionArn is the CodeStar connection giving the pipeline access to the repository.
+	ConnectionArn string
+	// Account and Region host the pipeline, empty ones use CDK_DEFAULT_ACCOUNT and CDK_DEFAULT_REGION.
+	Account string
+	Region  string
+	// ApprovalBefore lists the environments that need a manual approval before being deployed.
+	ApprovalBefore []string
+}
+
+// Pipeline read the deployment pipeline by 'cdk.json/context/deploymentPipeline', the app synthesizes the pipeline
+// instead of the stages when it is enabled.
+func Pipeline(scope constructs.Construct) (DeploymentPipeline, bool) {
+	values, ok := scope.Node().TryGetContext(jsii.String("deploymentPipeline")).(map[string]interface{})
+	if !ok {
+		return DeploymentPipeline{}, false
+	}
+	if enabled, _ := values["enabled"].(bool); !enabled {
+		return DeploymentPipeline{}, false
+	}
+
+	pipeline := DeploymentPipeline{Branch: "main"}
+	pipeline.Repository, _ = values["repository"].(string)
+	if v, ok := values["branch"].(string); ok && v != "" {
+		pipeline.Branch = v
+	}
+	pipeline.ConnectionArn, _ = values["connectionArn"].(string)
+	pipeline.Account, _ = values["account"].(string)
+	pipeline.Region, _ = values["region"].(string)
+	if approvals, ok := values["approvalBefore"].([]interface{}); ok {
+		for _, approval := range approvals {
+			if name, ok := approval.(string); ok {
+				pipeline.ApprovalBefore = append(pipeline.ApprovalBefore, name)
+			}
+		}
+	}
+
+	return pipeline, true
+}
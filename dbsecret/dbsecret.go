@@ -0,0 +1,236 @@
+// Package dbsecret connects to the RDS instance with the credentials Secrets Manager generates and rotates, or with
+// IAM authentication tokens through the RDS Proxy. The secret is cached between invocations and read again when the
+// database rejects the cached password, which happens once the secret was rotated.
+package dbsecret
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/lib/pq"
+)
+
+// DefaultTTL is how long a secret is cached when Cache.TTL is not set. A rotated password is picked up earlier on
+// the first authentication failure.
+const DefaultTTL = time.Hour
+
+// authRetries is the number of times a connection rejected for its credentials is retried with the secret read
+// again. Single user rotation changes the password before promoting the new version, so a read right after a
+// failure can still return the old password.
+const authRetries = 2
+
+// DefaultDBName is the database connected to when neither the source nor the secret name one.
+const DefaultDBName = "postgres"
+
+// Pool limits of Open. A container serves one invocation at a time, so a couple of connections kept open across warm
+// invocations is all it needs, and a burst of containers cannot exhaust the connections of the database.
+const (
+	maxOpenConns    = 2
+	connMaxIdleTime = 5 * time.Minute
+)
+
+// Source provides the credentials of every new connection.
+type Source interface {
+	Get(ctx context.Context) (Credentials, error)
+	// Invalidate is called when the database rejected the credentials.
+	Invalidate()
+}
+
+// Getter is the part of the Secrets Manager client used to read the database credentials.
+type Getter interface {
+	GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+}
+
+// Credentials are the fields of the secret RDS generates for the instance.
+type Credentials struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// DBName is empty for DefaultDBName.
+	DBName string `json:"dbname"`
+}
+
+// Validate reports the first missing or invalid field, so a malformed secret fails with an error naming the field
+// instead of a connection attempt to an empty host.
+func (c Credentials) Validate() error {
+	switch {
+	case c.Host == "":
+		return errors.New("database host is missing")
+	case c.Port < 1 || c.Port > 65535:
+		return fmt.Errorf("database port %d is out of range", c.Port)
+	case c.Username == "":
+		return errors.New("database username is missing")
+	case c.Password == "":
+		return errors.New("database password is missing")
+	}
+
+	return nil
+}
+
+// DSN returns the connection string of the credentials, requiring TLS. Every field is escaped, so passwords and IAM
+// tokens can hold any character.
+func (c Credentials) DSN() string {
+	dbName := c.DBName
+	if dbName == "" {
+		dbName = DefaultDBName
+	}
+	dsn := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(c.Username, c.Password),
+		Host:     net.JoinHostPort(c.Host, strconv.Itoa(c.Port)),
+		Path:     "/" + dbName,
+		RawQuery: "sslmode=require",
+	}
+
+	return dsn.String()
+}
+
+// Cache keeps the credentials of the secret in memory, create it once per container so invocations share it.
+type Cache struct {
+	Secrets  Getter
+	SecretID string
+	// DBName, when set, replaces the database name of the secret.
+	DBName string
+	// TTL defaults to DefaultTTL.
+	TTL time.Duration
+
+	mu          sync.Mutex
+	credentials *Credentials
+	fetchedAt   time.Time
+	now         func() time.Time
+}
+
+// Get returns the cached credentials, reading the secret when they are missing or expired.
+func (c *Cache) Get(ctx context.Context) (Credentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ttl := c.TTL
+	if ttl == 0 {
+		ttl = DefaultTTL
+	}
+	if c.credentials != nil && c.clock().Sub(c.fetchedAt) < ttl {
+		return *c.credentials, nil
+	}
+
+	output, err := c.Secrets.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(c.SecretID)})
+	if err != nil {
+		return Credentials{}, fmt.Errorf("failed to get secret: %w", err)
+	}
+
+	var credentials Credentials
+	if err = json.Unmarshal([]byte(aws.ToString(output.SecretString)), &credentials); err != nil {
+		return Credentials{}, fmt.Errorf("failed to parse secret: %w", err)
+	}
+	if err = credentials.Validate(); err != nil {
+		return Credentials{}, fmt.Errorf("malformed secret: %w", err)
+	}
+	if c.DBName != "" {
+		credentials.DBName = c.DBName
+	}
+
+	c.credentials, c.fetchedAt = &credentials, c.clock()
+
+	return credentials, nil
+}
+
+// Invalidate drops the cached credentials, the next Get reads the secret again.
+func (c *Cache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.credentials = nil
+}
+
+func (c *Cache) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+
+	return time.Now()
+}
+
+// Open returns a connection pool authenticating with the credentials of the source. Connections opened after a
+// rotation pick up the new password, so the pool can be kept for the lifetime of the container.
+func Open(source Source) *sql.DB {
+	return OpenConnector(NewConnector(source))
+}
+
+// NewConnector returns the connector of Open, to be wrapped before opening the pool, e.g. to trace it.
+func NewConnector(source Source) driver.Connector {
+	return &connector{source: source, connect: connectPostgres}
+}
+
+// OpenConnector returns a connection pool of the connector, with the limits of Open.
+func OpenConnector(c driver.Connector) *sql.DB {
+	db := sql.OpenDB(c)
+	db.SetMaxOpenConns(maxOpenConns)
+	db.SetMaxIdleConns(maxOpenConns)
+	db.SetConnMaxIdleTime(connMaxIdleTime)
+
+	return db
+}
+
+// IsAuthError reports whether the database rejected the connection for its credentials.
+func IsAuthError(err error) bool {
+	var pqErr *pq.Error
+	// Class 28 is invalid_authorization_specification, e.g. 28P01 invalid_password
+	return errors.As(err, &pqErr) && pqErr.Code.Class() == "28"
+}
+
+// connector opens the connections of the pool.
+type connector struct {
+	source  Source
+	connect func(ctx context.Context, credentials Credentials) (driver.Conn, error)
+}
+
+// Connect opens a connection, getting the credentials again and retrying when they are rejected.
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		credentials, err := c.source.Get(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := c.connect(ctx, credentials)
+		if err == nil || !IsAuthError(err) || attempt == authRetries {
+			return conn, err
+		}
+
+		c.source.Invalidate()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(attempt) * time.Second):
+		}
+	}
+}
+
+func (c *connector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+func connectPostgres(ctx context.Context, credentials Credentials) (driver.Conn, error) {
+	if err := credentials.Validate(); err != nil {
+		return nil, err
+	}
+
+	pqConnector, err := pq.NewConnector(credentials.DSN())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database connection: %w", err)
+	}
+
+	return pqConnector.Connect(ctx)
+}
@@ -0,0 +1,46 @@
+package dbsecret
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/rds/auth"
+)
+
+// IAMAuth authenticates with IAM tokens instead of a password, e.g. through an RDS Proxy requiring IAM
+// authentication. A token is built for every new connection, it only requires the rds-db:connect permission. Tokens
+// can open connections for 15 minutes, established ones outlive them.
+type IAMAuth struct {
+	Host     string
+	Port     int
+	Username string
+	// DBName is empty for DefaultDBName.
+	DBName string
+	Region string
+	// Credentials sign the tokens, usually the ones of the lambda execution role.
+	Credentials aws.CredentialsProvider
+}
+
+// Get returns the credentials of a new connection, the password being a fresh token.
+func (a *IAMAuth) Get(ctx context.Context) (Credentials, error) {
+	token, err := a.token(ctx)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	return Credentials{Host: a.Host, Port: a.Port, Username: a.Username, Password: token, DBName: a.DBName}, nil
+}
+
+// Invalidate does nothing, every connection gets a new token anyway.
+func (a *IAMAuth) Invalidate() {}
+
+// token builds the token of the user, the presigned connect URL without its scheme.
+func (a *IAMAuth) token(ctx context.Context) (string, error) {
+	token, err := auth.BuildAuthToken(ctx, fmt.Sprintf("%s:%d", a.Host, a.Port), a.Region, a.Username, a.Credentials)
+	if err != nil {
+		return "", fmt.Errorf("failed to build auth token: %w", err)
+	}
+
+	return token, nil
+}
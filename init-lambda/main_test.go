@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/require"
+	"stori-challenge/templates"
+)
+
+// fakeS3 records the uploaded keys.
+type fakeS3 struct {
+	keys []string
+}
+
+func (f *fakeS3) PutObject(_ context.Context, params *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	f.keys = append(f.keys, aws.ToString(params.Key))
+
+	return &s3.PutObjectOutput{}, nil
+}
+
+// fakeSchema counts the initializations.
+type fakeSchema struct {
+	calls int
+	err   error
+}
+
+func (f *fakeSchema) Initialize(_ context.Context) error {
+	f.calls++
+
+	return f.err
+}
+
+func TestHandleUploadsEveryTemplate(t *testing.T) {
+	bucket := &fakeS3{}
+	schema := &fakeSchema{}
+	handler := &Handler{S3: bucket, Schema: schema, Bucket: "bucket"}
+
+	require.NoError(t, handler.Handle(context.Background(), events.S3Event{}))
+	require.Equal(t, 1, schema.calls)
+
+	emailTemplates, err := templates.All()
+	require.NoError(t, err)
+
+	var keys []string
+	for _, emailTemplate := range emailTemplates {
+		keys = append(keys, emailTemplate.Key())
+	}
+	require.ElementsMatch(t, keys, bucket.keys)
+}
+
+func TestHandleStopsWhenDatabaseFails(t *testing.T) {
+	bucket := &fakeS3{}
+	handler := &Handler{S3: bucket, Schema: &fakeSchema{err: errors.New("connection refused")}, Bucket: "bucket"}
+
+	err := handler.Handle(context.Background(), events.S3Event{})
+	require.ErrorContains(t, err, "failed to initialize the database")
+	require.Empty(t, bucket.keys)
+}
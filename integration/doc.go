@@ -0,0 +1,9 @@
+// Package integration runs the lambdas against local stand-ins for AWS: MinIO for S3, Postgres for RDS and
+// MailHog for SES. The tests are behind the integration build tag and expect the services of docker-compose.yml:
+//
+//	docker compose up -d
+//	go test -tags integration ./integration/
+//
+// Every lambda is built and started as the Lambda runtime would, then invoked with the payloads of the state
+// machine. The endpoints and credentials can be pointed elsewhere with the variables read by harness_test.go.
+package integration
@@ -0,0 +1,268 @@
+//go:build integration
+
+package integration
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/require"
+	"stori-challenge/runs"
+	"stori-challenge/summary"
+)
+
+// upload puts the file under input/<account>/ and returns the parse request the state machine would build for it.
+func upload(t *testing.T, account, filePath string) summary.ParseRequest {
+	t.Helper()
+
+	content, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+
+	key := fmt.Sprintf("%s%s/%s", summary.InputPrefix, account, filepath.Base(filePath))
+	_, err = s3Client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket:      aws.String(bucketName),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(content),
+		ContentType: aws.String("text/csv"),
+	})
+	require.NoError(t, err)
+
+	sum := md5.Sum(content)
+	receivedAt := time.Now().UTC()
+
+	return summary.ParseRequest{
+		Bucket:     bucketName,
+		Key:        key,
+		ETag:       hex.EncodeToString(sum[:]),
+		Sequencer:  strconv.FormatInt(receivedAt.UnixNano(), 16),
+		ReceivedAt: receivedAt,
+	}
+}
+
+func requireNoObject(t *testing.T, key string) {
+	t.Helper()
+
+	_, err := s3Client.HeadObject(context.Background(), &s3.HeadObjectInput{Bucket: aws.String(bucketName), Key: aws.String(key)})
+	require.Error(t, err, "%s should not exist", key)
+}
+
+func objectTags(t *testing.T, key string) map[string]string {
+	t.Helper()
+
+	output, err := s3Client.GetObjectTagging(context.Background(), &s3.GetObjectTaggingInput{Bucket: aws.String(bucketName), Key: aws.String(key)})
+	require.NoError(t, err)
+
+	tags := make(map[string]string)
+	for _, tag := range output.TagSet {
+		tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+
+	return tags
+}
+
+func objectMetadata(t *testing.T, key string) map[string]string {
+	t.Helper()
+
+	output, err := s3Client.HeadObject(context.Background(), &s3.HeadObjectInput{Bucket: aws.String(bucketName), Key: aws.String(key)})
+	require.NoError(t, err)
+
+	return output.Metadata
+}
+
+// TestSampleCSV takes resources/sample.csv through the parse, store and notify lambdas as the state machine does.
+func TestSampleCSV(t *testing.T) {
+	ctx := context.Background()
+	account := newAccount(t)
+	recipient := account + "@example.com"
+	_, err := db.ExecContext(ctx, `INSERT INTO recipients (account, email) VALUES ($1, $2)`, account, recipient)
+	require.NoError(t, err)
+
+	content, err := os.ReadFile("../resources/sample.csv")
+	require.NoError(t, err)
+	expected, _, err := summary.ParseCSV(string(content))
+	require.NoError(t, err)
+
+	request := upload(t, account, "../resources/sample.csv")
+
+	// Parse
+	var message summary.Message
+	require.NoError(t, processCSV.invoke(request, &message))
+	require.Equal(t, summary.RunID(request.Bucket, request.Key, request.ETag, request.Sequencer), message.RunID)
+	require.Equal(t, account, message.Account)
+	require.Equal(t, expected, message.Summary)
+	require.Empty(t, message.ArchivedKey, "the file stays under input/ until archived")
+
+	// Store
+	var stored summary.Message
+	require.NoError(t, storeSummary.invoke(message, &stored))
+	require.NotZero(t, stored.RecordID)
+
+	var totalBalance float64
+	var runID, sourceKey string
+	err = db.QueryRowContext(ctx, `SELECT total_balance, run_id, source_key FROM summary_records WHERE id = $1`, stored.RecordID).
+		Scan(&totalBalance, &runID, &sourceKey)
+	require.NoError(t, err)
+	require.InDelta(t, expected.TotalBalance, totalBalance, 0.001)
+	require.Equal(t, message.RunID, runID)
+	require.Equal(t, request.Key, sourceKey)
+
+	// Storing the same run again, e.g. on a retry, returns the same row
+	var restored summary.Message
+	require.NoError(t, storeSummary.invoke(message, &restored))
+	require.Equal(t, stored.RecordID, restored.RecordID)
+
+	// Notify
+	var result summary.NotifyResult
+	require.NoError(t, sendSummary.invoke(stored, &result))
+	require.Equal(t, 1, result.Recipients)
+	require.Equal(t, stored.OutputKey(), result.OutputKey)
+
+	metadata := objectMetadata(t, result.OutputKey)
+	require.Equal(t, message.RunID, metadata["run-id"])
+	require.Equal(t, request.Key, metadata["source-key"])
+	require.Equal(t, strconv.FormatInt(stored.RecordID, 10), metadata["summary-record-id"])
+
+	emails := sentEmails(t, recipient, 1)
+	require.Len(t, emails, 1)
+	require.Equal(t, []string{"Transaction Summary"}, emails[0].Content.Headers["Subject"])
+	require.Equal(t, []string{sender}, emails[0].Content.Headers["From"])
+	require.Contains(t, emails[0].decodedBody(t), fmt.Sprintf("Total Balance: %.2f", expected.TotalBalance))
+
+	// Notifying the same run again, e.g. on a redelivery, does not send the email twice
+	var resent summary.NotifyResult
+	require.NoError(t, sendSummary.invoke(stored, &resent))
+	require.Zero(t, resent.Recipients)
+	require.Len(t, sentEmails(t, recipient, 1), 1)
+
+	// Archive, once notified
+	var archived summary.Message
+	require.NoError(t, processCSV.invoke(summary.ArchiveRequest{Outcome: summary.OutcomeProcessed, Message: stored}, &archived))
+	archivedKey := fmt.Sprintf("%s%s/sample.csv", summary.ProcessedPrefix, account)
+	require.Equal(t, archivedKey, archived.ArchivedKey)
+	requireNoObject(t, request.Key)
+	require.Equal(t, "processed", objectTags(t, archivedKey)["outcome"])
+	head, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(bucketName), Key: aws.String(archivedKey)})
+	require.NoError(t, err)
+	require.Equal(t, "text/csv", aws.ToString(head.ContentType))
+
+	run, err := runs.Get(ctx, db, message.RunID)
+	require.NoError(t, err)
+	require.Equal(t, runs.StatusCompleted, run.Status)
+	require.Equal(t, account, run.Account)
+	require.Equal(t, 20, run.RowsParsed)
+	require.Zero(t, run.RowsRejected)
+	require.NotNil(t, run.SummaryRecordID)
+	require.Equal(t, stored.RecordID, *run.SummaryRecordID)
+	require.Equal(t, result.OutputKey, run.OutputKey)
+	require.NotNil(t, run.FinishedAt)
+
+	// 'stori runs' reads the same run through the process lambda
+	var queried []runs.Run
+	require.NoError(t, processCSV.invoke(runs.QueryRequest{RunsQuery: &runs.Query{RunID: message.RunID}}, &queried))
+	require.Len(t, queried, 1)
+	require.Equal(t, runs.StatusCompleted, queried[0].Status)
+	require.Equal(t, run.OutputKey, queried[0].OutputKey)
+
+	// Storing the run again once completed, e.g. a redriven message, leaves it where it ended
+	runs.Tracker{DB: db}.Stored(ctx, message.RunID, stored.RecordID)
+	run, err = runs.Get(ctx, db, message.RunID)
+	require.NoError(t, err)
+	require.Equal(t, runs.StatusCompleted, run.Status)
+	require.Equal(t, runs.StageNotify, run.Stage)
+}
+
+// TestUnsubscribedAccount checks that an account whose recipients all unsubscribed gets no email at all, the
+// fallback recipient only standing in for accounts without any registered recipient.
+func TestUnsubscribedAccount(t *testing.T) {
+	ctx := context.Background()
+	account := newAccount(t)
+	_, err := db.ExecContext(ctx, `INSERT INTO recipients (account, email, unsubscribed) VALUES ($1, $2, true)`,
+		account, account+"@example.com")
+	require.NoError(t, err)
+
+	request := upload(t, account, "../resources/sample.csv")
+
+	var message, stored summary.Message
+	require.NoError(t, processCSV.invoke(request, &message))
+	require.NoError(t, storeSummary.invoke(message, &stored))
+
+	var result summary.NotifyResult
+	require.NoError(t, sendSummary.invoke(stored, &result))
+	require.Zero(t, result.Recipients)
+
+	var deliveries int
+	require.NoError(t, db.QueryRowContext(ctx, `SELECT count(*) FROM summary_deliveries WHERE run_id = $1`, message.RunID).Scan(&deliveries))
+	require.Zero(t, deliveries, "the summary must not go to the fallback recipient")
+}
+
+// TestMalformedCSV checks that every malformed fixture fails the parse step, is quarantined with the reason and
+// leaves a failed run with its rejection report. Nothing is stored or sent.
+func TestMalformedCSV(t *testing.T) {
+	tests := []struct {
+		file         string
+		reason       string
+		rowsParsed   int
+		rowsRejected int
+	}{
+		{file: "bad_amount.csv", reason: "failed to parse amount", rowsParsed: 1, rowsRejected: 2},
+		{file: "bad_date.csv", reason: "invalid date: 01/02/2023", rowsParsed: 1, rowsRejected: 2},
+		{file: "bad_type.csv", reason: "invalid transaction type: refund", rowsParsed: 1, rowsRejected: 1},
+		{file: "missing_columns.csv", reason: "record has missing columns", rowsParsed: 1, rowsRejected: 1},
+		{file: "unterminated_quote.csv", reason: `extraneous or missing " in quoted-field`, rowsParsed: 1, rowsRejected: 1},
+		{file: "empty.csv", reason: "failed to read header line"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			ctx := context.Background()
+			account := newAccount(t)
+			request := upload(t, account, filepath.Join("testdata", "malformed", test.file))
+			runID := summary.RunID(request.Bucket, request.Key, request.ETag, request.Sequencer)
+
+			err := processCSV.invoke(request, nil)
+			require.ErrorContains(t, err, test.reason)
+
+			quarantinedKey := fmt.Sprintf("%s%s/%s", summary.QuarantinePrefix, account, test.file)
+			requireNoObject(t, request.Key)
+
+			tags := objectTags(t, quarantinedKey)
+			require.Equal(t, "quarantined", tags["outcome"])
+			require.Equal(t, runID, tags["run-id"])
+			require.Contains(t, tags["failure-reason"], "failed to process CSV data")
+
+			metadata := objectMetadata(t, quarantinedKey)
+			require.Equal(t, strconv.Itoa(test.rowsParsed), metadata["rows-parsed"])
+			require.Equal(t, strconv.Itoa(test.rowsRejected), metadata["rows-rejected"])
+
+			run, err := runs.Get(ctx, db, runID)
+			require.NoError(t, err)
+			require.Equal(t, runs.StatusFailed, run.Status)
+			require.Equal(t, runs.StageParse, run.Stage)
+			require.Contains(t, run.Error, test.reason)
+			require.Equal(t, test.rowsRejected, run.RowsRejected)
+			require.Len(t, run.RejectionReport, test.rowsRejected)
+			require.Nil(t, run.SummaryRecordID)
+
+			// A later failure without a report keeps the one of the parse step
+			runs.Tracker{DB: db}.Failed(ctx, runID, runs.StageParse, errors.New("retried"), nil)
+			run, err = runs.Get(ctx, db, runID)
+			require.NoError(t, err)
+			require.Len(t, run.RejectionReport, test.rowsRejected)
+
+			var stored int
+			require.NoError(t, db.QueryRowContext(ctx, `SELECT count(*) FROM summary_records WHERE run_id = $1`, runID).Scan(&stored))
+			require.Zero(t, stored)
+		})
+	}
+}
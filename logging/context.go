@@ -0,0 +1,73 @@
+package logging
+
+import (
+	"context"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+// RunIDKey is the field holding the run id, the correlation id of an upload. It is derived from the bucket, key
+// and etag of the uploaded object and travels with the message through every step, so filtering on it in
+// CloudWatch Logs Insights traces one upload across the lambdas.
+const RunIDKey = "run_id"
+
+// RequestIDKey is the field holding the id of the Lambda invocation, added to the records of the invocation context.
+const RequestIDKey = "aws_request_id"
+
+type fieldsKey struct{}
+
+// WithFields returns a context whose records carry the fields, on top of the ones already in ctx.
+func WithFields(ctx context.Context, fields Fields) context.Context {
+	merged := Fields{}
+	for key, value := range FieldsFrom(ctx) {
+		merged[key] = value
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+
+	return context.WithValue(ctx, fieldsKey{}, merged)
+}
+
+// FieldsFrom returns the fields of the context, set with WithFields.
+func FieldsFrom(ctx context.Context) Fields {
+	fields, _ := ctx.Value(fieldsKey{}).(Fields)
+	return fields
+}
+
+// contextFields merges the fields of the context, the request id of the invocation and the fields of the record,
+// the latter taking precedence.
+func contextFields(ctx context.Context, fields Fields) Fields {
+	merged := Fields{}
+	if lambdaContext, ok := lambdacontext.FromContext(ctx); ok {
+		merged[RequestIDKey] = lambdaContext.AwsRequestID
+	}
+	for key, value := range FieldsFrom(ctx) {
+		merged[key] = value
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+
+	return merged
+}
+
+// InfoContext logs a record of the normal operation with the fields of the context.
+func (l *Logger) InfoContext(ctx context.Context, msg string, fields Fields) {
+	l.log("info", msg, contextFields(ctx, fields))
+}
+
+// ErrorContext logs a failure with the fields of the context.
+func (l *Logger) ErrorContext(ctx context.Context, msg string, fields Fields) {
+	l.log("error", msg, contextFields(ctx, fields))
+}
+
+// InfoContext logs a record of the normal operation with the logger of Setup and the fields of the context.
+func InfoContext(ctx context.Context, msg string, fields Fields) {
+	std.InfoContext(ctx, msg, fields)
+}
+
+// ErrorContext logs a failure with the logger of Setup and the fields of the context.
+func ErrorContext(ctx context.Context, msg string, fields Fields) {
+	std.ErrorContext(ctx, msg, fields)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// legacyBucketID is the construct id the bucket had on the stack, before the pipeline construct named it Bucket.
+const legacyBucketID = "storiChallenge-bucket"
+
+var nonAlphanumeric = regexp.MustCompile(`[^A-Za-z0-9]`)
+
+// keepLogicalIDs gives the resources of the statement pipeline the logical ids they had while they were declared on
+// the stack itself. Extracting the construct changed their paths, and with them the logical ids, so CloudFormation
+// would otherwise replace the bucket, queues, topics and lambdas of an already deployed stack, orphaning the
+// retained bucket and changing the unsubscribe URL of the emails already sent. The ids embedding the path of a
+// pipeline construct, e.g. the ingress rules of the lambda security groups, are kept as well.
+func keepLogicalIDs(stack awscdk.Stack, pipeline constructs.Construct) {
+	stackPath := *stack.Node().Path()
+	pipelinePath := *pipeline.Node().Path()
+
+	// legacyPath drops the pipeline from the path of one of its constructs
+	legacyPath := func(path string) string {
+		rest := strings.TrimPrefix(path, pipelinePath+"/")
+		if rest == path {
+			return path
+		}
+		if rest == "Bucket" || strings.HasPrefix(rest, "Bucket/") {
+			rest = legacyBucketID + strings.TrimPrefix(rest, "Bucket")
+		}
+
+		return stackPath + "/" + rest
+	}
+
+	// Construct ids of permissions, subscriptions and ingress rules embed the unique id of the construct they target
+	renames := make(map[string]string)
+	for _, construct := range *pipeline.Node().FindAll(constructs.ConstructOrder_PREORDER) {
+		path := *construct.Node().Path()
+		if path != pipelinePath {
+			renames[uniqueID(strings.Split(path, "/"))] = uniqueID(strings.Split(legacyPath(path), "/"))
+		}
+	}
+	renamed := make([]string, 0, len(renames))
+	for id := range renames {
+		renamed = append(renamed, id)
+	}
+	sort.Slice(renamed, func(i, j int) bool { return len(renamed[i]) > len(renamed[j]) })
+
+	for _, construct := range *stack.Node().FindAll(constructs.ConstructOrder_PREORDER) {
+		element, ok := construct.(awscdk.CfnElement)
+		if !ok || !*awscdk.CfnElement_IsCfnElement(construct) {
+			continue
+		}
+
+		path := *construct.Node().Path()
+		components := strings.Split(strings.TrimPrefix(legacyPath(path), stackPath+"/"), "/")
+		for i, component := range components {
+			for _, id := range renamed {
+				component = strings.ReplaceAll(component, id, renames[id])
+			}
+			components[i] = component
+		}
+
+		if legacyID := uniqueID(components); legacyID != uniqueID(strings.Split(strings.TrimPrefix(path, stackPath+"/"), "/")) {
+			element.OverrideLogicalId(jsii.String(legacyID))
+		}
+	}
+}
+
+// uniqueID computes the id CDK derives from the construct ids of a path, the logical id of a resource from its path
+// within the stack: the alphanumeric characters of the ids, skipping Default and Resource, followed by a hash of
+// the path. A single id is used as is.
+func uniqueID(components []string) string {
+	path := make([]string, 0, len(components))
+	for _, component := range components {
+		if component != "Default" {
+			path = append(path, component)
+		}
+	}
+
+	if len(path) == 1 {
+		if id := nonAlphanumeric.ReplaceAllString(path[0], ""); len(id) <= 255 {
+			return id
+		}
+	}
+
+	sum := md5.Sum([]byte(strings.Join(path, "/")))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))[:8]
+
+	// Ids repeating the end of their parent one, e.g. a Bucket in FooBucket, are left out of the readable part
+	var human strings.Builder
+	previous := ""
+	for _, component := range path {
+		if previous != "" && strings.HasSuffix(previous, component) {
+			continue
+		}
+		previous = component
+		if component != "Resource" {
+			human.WriteString(nonAlphanumeric.ReplaceAllString(component, ""))
+		}
+	}
+
+	readable := human.String()
+	if len(readable) > 240 {
+		readable = readable[:240]
+	}
+
+	return readable + hash
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/jsii-runtime-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUniqueID(t *testing.T) {
+	require.Equal(t, "AlarmTopic", uniqueID([]string{"AlarmTopic"}))
+	require.Equal(t, "storiChallengebucketB49A2D5A", uniqueID([]string{"storiChallenge-bucket", "Resource"}))
+	require.Equal(t, "TestStackSendSummaryQueue9CE4E4B7", uniqueID([]string{"TestStack", "SendSummaryQueue"}))
+	// Default ids are left out of the hash as well, a construct and its Default child share the logical id
+	require.Equal(t, uniqueID([]string{"UnsubscribeLambda", "FunctionUrl", "Resource"}),
+		uniqueID([]string{"UnsubscribeLambda", "FunctionUrl", "Default", "Resource"}))
+}
+
+func TestStoriChallengeStackKeepsLogicalIDs(t *testing.T) {
+	template := synth(map[string]interface{}{"orchestration": "queue"})
+
+	// The ids the resources had before the pipeline was extracted into its construct
+	for resourceType, ids := range map[string][]string{
+		"AWS::S3::Bucket":                 {"storiChallengebucketB49A2D5A"},
+		"Custom::S3BucketNotifications":   {"storiChallengebucketNotifications582541E0"},
+		"AWS::SQS::Queue":                 {"StoreSummaryQueue69F0685C", "StoreSummaryDLQ0EB9DB09", "SendSummaryQueue10A3D268", "SendSummaryDLQ7919E8B5"},
+		"AWS::SNS::Topic":                 {"SummaryTopicCB81EE8C", "SesEventsTopic6E3F217C"},
+		"AWS::SNS::Subscription":          {"StoreSummaryQueueTestStackSummaryTopic91B09AF57E5F758F"},
+		"AWS::Lambda::Function":           {"ProcessCsvLambdaFD123D69", "UnsubscribeLambda181ED454"},
+		"AWS::Lambda::Url":                {"UnsubscribeLambdaFunctionUrlA4337533"},
+		"AWS::Lambda::EventSourceMapping": {"StoreSummaryLambdaSqsEventSourceTestStackStoreSummaryQueueDAC9A3D42E1AE7B2"},
+		"AWS::Lambda::Permission":         {"storiChallengebucketAllowBucketNotificationsToTestStackProcessCsvLambda3840791537B8DC0F"},
+		"AWS::EC2::SecurityGroup":         {"ProcessCsvLambdaSecurityGroup9CF7B684"},
+	} {
+		resources := *template.FindResources(&resourceType, nil)
+		for _, id := range ids {
+			require.Contains(t, resources, id, "%s %s", resourceType, id)
+		}
+	}
+
+	template = synth(nil)
+	require.Contains(t, *template.FindResources(jsii.String("AWS::StepFunctions::StateMachine"), nil), "PipelineStateMachine88B77A5B")
+}
@@ -0,0 +1,126 @@
+// Package metrics emits the custom metrics of the pipeline in CloudWatch Embedded Metric Format: every record is a
+// JSON line written to stdout, which CloudWatch Logs turns into metrics without any API call, so the lambdas need
+// no permission nor VPC endpoint for them.
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"stori-challenge/logging"
+)
+
+// Environment variables of the lambdas, set by the statement pipeline construct. Metrics are only emitted when
+// NamespaceEnv is set, so tests and local runs keep a clean output.
+const (
+	NamespaceEnv = "METRICS_NAMESPACE"
+	PipelineEnv  = "METRICS_PIPELINE"
+)
+
+// DefaultNamespace holds the metrics of every pipeline, told apart by their PipelineDimension.
+const DefaultNamespace = "StoriChallenge"
+
+// PipelineDimension is the only dimension of the metrics, the construct path of the pipeline.
+const PipelineDimension = "Pipeline"
+
+// Names of the metrics.
+const (
+	FilesProcessed  = "FilesProcessed"
+	RowsParsed      = "RowsParsed"
+	RowsRejected    = "RowsRejected"
+	EmailsSent      = "EmailsSent"
+	DBInsertLatency = "DBInsertLatency"
+)
+
+// Units of the metrics, named after the CloudWatch ones.
+const (
+	UnitCount        = "Count"
+	UnitMilliseconds = "Milliseconds"
+)
+
+// Value is one data point.
+type Value struct {
+	Name  string
+	Unit  string
+	Value float64
+}
+
+// Count returns a data point counting n occurrences.
+func Count(name string, n int) Value {
+	return Value{Name: name, Unit: UnitCount, Value: float64(n)}
+}
+
+// Duration returns a data point of a duration, in milliseconds.
+func Duration(name string, d time.Duration) Value {
+	return Value{Name: name, Unit: UnitMilliseconds, Value: float64(d) / float64(time.Millisecond)}
+}
+
+// Emitter writes the data points as EMF records.
+type Emitter struct {
+	Out       io.Writer
+	Namespace string
+	Pipeline  string
+
+	mu  sync.Mutex
+	now func() time.Time
+}
+
+// Emit writes one record holding the values. The run id of the context is added as a property, so the metrics
+// of a run can be found along with its logs.
+func (e *Emitter) Emit(ctx context.Context, values ...Value) {
+	if e == nil || e.Namespace == "" || len(values) == 0 {
+		return
+	}
+
+	definitions := make([]map[string]string, 0, len(values))
+	record := map[string]interface{}{PipelineDimension: e.Pipeline}
+	for _, value := range values {
+		definitions = append(definitions, map[string]string{"Name": value.Name, "Unit": value.Unit})
+		record[value.Name] = value.Value
+	}
+	if runID, ok := logging.FieldsFrom(ctx)[logging.RunIDKey]; ok {
+		record[logging.RunIDKey] = runID
+	}
+	record["_aws"] = map[string]interface{}{
+		"Timestamp": e.clock().UnixNano() / int64(time.Millisecond),
+		"CloudWatchMetrics": []map[string]interface{}{{
+			"Namespace":  e.Namespace,
+			"Dimensions": [][]string{{PipelineDimension}},
+			"Metrics":    definitions,
+		}},
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		logging.ErrorContext(ctx, "failed to encode metrics", logging.Fields{"error": err})
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, _ = e.Out.Write(append(line, '\n'))
+}
+
+func (e *Emitter) clock() time.Time {
+	if e.now != nil {
+		return e.now()
+	}
+
+	return time.Now()
+}
+
+var std = &Emitter{Out: os.Stdout}
+
+// Setup enables the metrics of the lambda from its environment, call it first thing in main.
+func Setup(getenv func(string) string) {
+	std = &Emitter{Out: os.Stdout, Namespace: getenv(NamespaceEnv), Pipeline: getenv(PipelineEnv)}
+}
+
+// Emit writes one record holding the values with the emitter of Setup.
+func Emit(ctx context.Context, values ...Value) {
+	std.Emit(ctx, values...)
+}
@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"stori-challenge/logging"
+)
+
+func TestEmit(t *testing.T) {
+	var out bytes.Buffer
+	emitter := &Emitter{
+		Out:       &out,
+		Namespace: DefaultNamespace,
+		Pipeline:  "TestStack/StatementPipeline",
+		now:       func() time.Time { return time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC) },
+	}
+
+	ctx := logging.WithFields(context.Background(), logging.Fields{logging.RunIDKey: "run-1"})
+	emitter.Emit(ctx, Count(RowsParsed, 12), Count(RowsRejected, 0), Duration(DBInsertLatency, 1500*time.Microsecond))
+
+	var record map[string]interface{}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &record))
+	require.Equal(t, map[string]interface{}{
+		"_aws": map[string]interface{}{
+			"Timestamp": 1680350400000.0,
+			"CloudWatchMetrics": []interface{}{map[string]interface{}{
+				"Namespace":  "StoriChallenge",
+				"Dimensions": []interface{}{[]interface{}{"Pipeline"}},
+				"Metrics": []interface{}{
+					map[string]interface{}{"Name": "RowsParsed", "Unit": "Count"},
+					map[string]interface{}{"Name": "RowsRejected", "Unit": "Count"},
+					map[string]interface{}{"Name": "DBInsertLatency", "Unit": "Milliseconds"},
+				},
+			}},
+		},
+		"Pipeline":        "TestStack/StatementPipeline",
+		"run_id":          "run-1",
+		"RowsParsed":      12.0,
+		"RowsRejected":    0.0,
+		"DBInsertLatency": 1.5,
+	}, record)
+}
+
+func TestEmitDisabledWithoutNamespace(t *testing.T) {
+	var out bytes.Buffer
+	(&Emitter{Out: &out}).Emit(context.Background(), Count(FilesProcessed, 1))
+	require.Empty(t, out.String())
+
+	var emitter *Emitter
+	emitter.Emit(context.Background(), Count(FilesProcessed, 1))
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsec2"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+	"stori-challenge/config"
+)
+
+// Subnet groups of the VPC.
+const (
+	publicSubnets   = "Public"
+	lambdaSubnets   = "Lambda"
+	databaseSubnets = "Database"
+)
+
+// Network is the VPC of the stack: the database lives in isolated subnets, the lambdas in private ones reaching the
+// AWS services through VPC endpoints, and through NAT gateways when configured.
+type Network struct {
+	Vpc awsec2.Vpc
+	// LambdaSubnets are private with egress when the VPC has NAT gateways, isolated otherwise.
+	LambdaSubnets   *awsec2.SubnetSelection
+	DatabaseSubnets *awsec2.SubnetSelection
+	// SecretsManagerEndpoint is nil unless configured.
+	SecretsManagerEndpoint awsec2.InterfaceVpcEndpoint
+}
+
+// newNetwork creates the VPC and the endpoints of cfg.VpcEndpoints, S3 gets a gateway endpoint and the other
+// services an interface one.
+func newNetwork(scope constructs.Construct, cfg config.Config) *Network {
+	subnets := []*awsec2.SubnetConfiguration{
+		{Name: jsii.String(lambdaSubnets), SubnetType: awsec2.SubnetType_PRIVATE_ISOLATED, CidrMask: jsii.Number(24)},
+		{Name: jsii.String(databaseSubnets), SubnetType: awsec2.SubnetType_PRIVATE_ISOLATED, CidrMask: jsii.Number(24)},
+	}
+	// Public subnets only host the NAT gateways
+	if cfg.NatGateways > 0 {
+		subnets[0].SubnetType = awsec2.SubnetType_PRIVATE_WITH_EGRESS
+		subnets = append(subnets, &awsec2.SubnetConfiguration{
+			Name: jsii.String(publicSubnets), SubnetType: awsec2.SubnetType_PUBLIC, CidrMask: jsii.Number(24),
+		})
+	}
+
+	vpc := awsec2.NewVpc(scope, jsii.String("StoriVPC"), &awsec2.VpcProps{
+		MaxAzs:              jsii.Number(2),
+		NatGateways:         jsii.Number(cfg.NatGateways),
+		SubnetConfiguration: &subnets,
+	})
+
+	network := &Network{
+		Vpc:             vpc,
+		LambdaSubnets:   &awsec2.SubnetSelection{SubnetGroupName: jsii.String(lambdaSubnets)},
+		DatabaseSubnets: &awsec2.SubnetSelection{SubnetGroupName: jsii.String(databaseSubnets)},
+	}
+
+	if cfg.HasEndpoint(config.EndpointS3) {
+		vpc.AddGatewayEndpoint(jsii.String("S3Endpoint"), &awsec2.GatewayVpcEndpointOptions{
+			Service: awsec2.GatewayVpcEndpointAwsService_S3(),
+			Subnets: &[]*awsec2.SubnetSelection{network.LambdaSubnets},
+		})
+	}
+
+	// Interface endpoints accept HTTPS from the whole VPC and resolve the public service names privately
+	interfaceEndpoints := []struct {
+		name    string
+		id      string
+		service awsec2.IInterfaceVpcEndpointService
+	}{
+		{config.EndpointSecretsManager, "SecretsManagerEndpoint", awsec2.InterfaceVpcEndpointAwsService_SECRETS_MANAGER()},
+		{config.EndpointLambda, "LambdaEndpoint", awsec2.InterfaceVpcEndpointAwsService_LAMBDA()},
+		// The SES service of the CDK is the SMTP endpoint, the send lambda calls the API one
+		{config.EndpointSES, "SesEndpoint", awsec2.NewInterfaceVpcEndpointAwsService(jsii.String("email"), nil, nil)},
+		{config.EndpointSQS, "SqsEndpoint", awsec2.InterfaceVpcEndpointAwsService_SQS()},
+		{config.EndpointSNS, "SnsEndpoint", awsec2.InterfaceVpcEndpointAwsService_SNS()},
+		{config.EndpointXRay, "XRayEndpoint", awsec2.InterfaceVpcEndpointAwsService_XRAY()},
+	}
+	for _, endpoint := range interfaceEndpoints {
+		if !cfg.HasEndpoint(endpoint.name) {
+			continue
+		}
+
+		interfaceEndpoint := vpc.AddInterfaceEndpoint(jsii.String(endpoint.id), &awsec2.InterfaceVpcEndpointOptions{
+			Service: endpoint.service,
+			Subnets: network.LambdaSubnets,
+		})
+		if endpoint.name == config.EndpointSecretsManager {
+			network.SecretsManagerEndpoint = interfaceEndpoint
+		}
+	}
+
+	return network
+}
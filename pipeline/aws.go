@@ -0,0 +1,67 @@
+package pipeline
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"stori-challenge/tracing"
+)
+
+// Environment variables pointing the lambdas at local stand-ins instead of AWS, e.g. MinIO, Postgres and MailHog.
+// EndpointEnv applies to every AWS client while EndpointEnv followed by '_' and the service id in upper case with
+// spaces replaced by '_', e.g. AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL_SECRETS_MANAGER, only applies to that one.
+const (
+	EndpointEnv    = "AWS_ENDPOINT_URL"
+	DatabaseURLEnv = "DATABASE_URL"
+	SMTPAddrEnv    = "SMTP_ADDR"
+)
+
+// LoadAWSConfig loads the default AWS configuration, honoring the endpoint overrides of the environment. The
+// calls of the clients created from it are traced when tracing is on.
+func LoadAWSConfig(ctx context.Context) (aws.Config, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithEndpointResolverWithOptions(endpointResolver(os.Getenv)))
+	if err != nil {
+		return aws.Config{}, err
+	}
+	tracing.InstrumentAWS(&cfg)
+
+	return cfg, nil
+}
+
+// NewS3Client creates the S3 client, S3 compatible stand-ins do not serve buckets as subdomains so path style
+// addressing is used when the endpoint is overridden.
+func NewS3Client(cfg aws.Config) *s3.Client {
+	_, overridden := endpointOverride(os.Getenv, s3.ServiceID)
+
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.UsePathStyle = overridden
+	})
+}
+
+// endpointResolver resolves the overridden endpoints, services without an override keep the default endpoint.
+func endpointResolver(getenv func(string) string) aws.EndpointResolverWithOptions {
+	return aws.EndpointResolverWithOptionsFunc(func(service, region string, _ ...interface{}) (aws.Endpoint, error) {
+		url, ok := endpointOverride(getenv, service)
+		if !ok {
+			return aws.Endpoint{}, &aws.EndpointNotFoundError{}
+		}
+
+		return aws.Endpoint{URL: url, SigningRegion: region, HostnameImmutable: true}, nil
+	})
+}
+
+// endpointOverride returns the endpoint set for the service, or for every service.
+func endpointOverride(getenv func(string) string, service string) (string, bool) {
+	if url := getenv(EndpointEnv + "_" + strings.ToUpper(strings.ReplaceAll(service, " ", "_"))); url != "" {
+		return url, true
+	}
+	if url := getenv(EndpointEnv); url != "" {
+		return url, true
+	}
+
+	return "", false
+}
@@ -0,0 +1,42 @@
+package pipeline
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEndpointResolver(t *testing.T) {
+	env := map[string]string{
+		"AWS_ENDPOINT_URL_S3":              "http://localhost:9000",
+		"AWS_ENDPOINT_URL_SECRETS_MANAGER": "http://localhost:4566",
+	}
+	resolver := endpointResolver(func(key string) string { return env[key] })
+
+	endpoint, err := resolver.ResolveEndpoint("S3", "us-east-1")
+	require.NoError(t, err)
+	require.Equal(t, "http://localhost:9000", endpoint.URL)
+	require.Equal(t, "us-east-1", endpoint.SigningRegion)
+	require.True(t, endpoint.HostnameImmutable)
+
+	endpoint, err = resolver.ResolveEndpoint("Secrets Manager", "us-east-1")
+	require.NoError(t, err)
+	require.Equal(t, "http://localhost:4566", endpoint.URL)
+
+	// Services without an override fall back to the default endpoint
+	_, err = resolver.ResolveEndpoint("SES", "us-east-1")
+	var notFound *aws.EndpointNotFoundError
+	require.True(t, errors.As(err, &notFound))
+
+	// The global override applies to every service without its own
+	env["AWS_ENDPOINT_URL"] = "http://localhost:4566"
+	endpoint, err = resolver.ResolveEndpoint("SES", "us-east-1")
+	require.NoError(t, err)
+	require.Equal(t, "http://localhost:4566", endpoint.URL)
+
+	endpoint, err = resolver.ResolveEndpoint("S3", "us-east-1")
+	require.NoError(t, err)
+	require.Equal(t, "http://localhost:9000", endpoint.URL)
+}
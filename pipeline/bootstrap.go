@@ -0,0 +1,35 @@
+package pipeline
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"stori-challenge/logging"
+	"stori-challenge/metrics"
+	"stori-challenge/tracing"
+)
+
+// Bootstrap sets up the logging, metrics and tracing of a lambda, loads the AWS configuration its clients are
+// created from and opens the connection pool of the Database, exiting when either fails. Call it first thing in
+// main: the clients main builds and the pool live as long as the container, so every invocation it serves reuses
+// them instead of creating its own clients and connections.
+func Bootstrap(ctx context.Context) (aws.Config, *sql.DB) {
+	logging.Setup(os.Getenv)
+	metrics.Setup(os.Getenv)
+	tracing.Setup(os.Getenv)
+
+	cfg, err := LoadAWSConfig(ctx)
+	if err != nil {
+		log.Fatalf("failed to load configuration: %v", err)
+	}
+
+	db, err := Database(cfg)
+	if err != nil {
+		log.Fatalf("failed to open database: %v", err)
+	}
+
+	return cfg, db
+}
@@ -0,0 +1,39 @@
+// Package pipeline holds the parse, store and notify steps shared by the lambdas and the local runner. Every step
+// gets the AWS clients and repositories it uses injected, so it can run against fakes.
+package pipeline
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// ObjectGetter is the part of the S3 client used to read objects.
+type ObjectGetter interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// ObjectPutter is the part of the S3 client used to write objects.
+type ObjectPutter interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+}
+
+// ObjectArchiver is the part of the S3 client used to move input files out of the input prefix, HeadObject reads
+// the content type the copy keeps.
+type ObjectArchiver interface {
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+}
+
+// EmailSender is the part of the SES client used to send the summaries.
+type EmailSender interface {
+	SendRawEmail(ctx context.Context, params *ses.SendRawEmailInput, optFns ...func(*ses.Options)) (*ses.SendRawEmailOutput, error)
+}
+
+// MessageSender is the part of the SQS client used to hand the stored summaries to the send queue.
+type MessageSender interface {
+	SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+}
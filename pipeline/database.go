@@ -0,0 +1,84 @@
+package pipeline
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	_ "github.com/lib/pq"
+	"stori-challenge/dbsecret"
+	"stori-challenge/tracing"
+)
+
+// Environment variables locating the database. DatabaseURLEnv takes precedence, then the RDS Proxy of
+// DBProxyEndpointEnv reached as DBUserEnv with IAM authentication, then the RDS instance of the SECRET_ARN secret.
+// Both connect to the DBNameEnv database.
+const (
+	DBProxyEndpointEnv = "DB_PROXY_ENDPOINT"
+	DBUserEnv          = "DB_USER"
+	SecretArnEnv       = "SECRET_ARN"
+	DBNameEnv          = "DB_NAME"
+)
+
+// databasePort is the port of the RDS Proxy.
+const databasePort = 5432
+
+// The connection pool of the container, shared by the repositories and the run tracker and kept open across warm
+// invocations instead of connecting on every one.
+var (
+	pool     *sql.DB
+	poolErr  error
+	poolOnce sync.Once
+)
+
+// Database returns the connection pool of the container, opened by the first call. It is nil when the environment
+// does not locate a database.
+func Database(cfg aws.Config) (*sql.DB, error) {
+	poolOnce.Do(func() {
+		pool, poolErr = openDatabase(cfg, os.Getenv)
+	})
+
+	return pool, poolErr
+}
+
+func openDatabase(cfg aws.Config, getenv func(string) string) (*sql.DB, error) {
+	if dsn := getenv(DatabaseURLEnv); dsn != "" {
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open database connection: %w", err)
+		}
+		return db, nil
+	}
+
+	source := databaseSource(cfg, getenv)
+	if source == nil {
+		return nil, nil
+	}
+
+	return dbsecret.OpenConnector(tracing.Connector(dbsecret.NewConnector(source))), nil
+}
+
+// databaseSource returns the credentials of the connections to the RDS Proxy or to the RDS instance, nil when
+// neither is set.
+func databaseSource(cfg aws.Config, getenv func(string) string) dbsecret.Source {
+	if endpoint := getenv(DBProxyEndpointEnv); endpoint != "" {
+		return &dbsecret.IAMAuth{
+			Host:        endpoint,
+			Port:        databasePort,
+			Username:    getenv(DBUserEnv),
+			DBName:      getenv(DBNameEnv),
+			Region:      cfg.Region,
+			Credentials: cfg.Credentials,
+		}
+	}
+
+	if secretArn := getenv(SecretArnEnv); secretArn != "" {
+		// The secret is cached for every invocation of the container, and read again once rotated
+		return &dbsecret.Cache{Secrets: secretsmanager.NewFromConfig(cfg), SecretID: secretArn, DBName: getenv(DBNameEnv)}
+	}
+
+	return nil
+}
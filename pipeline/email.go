@@ -0,0 +1,94 @@
+package pipeline
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+)
+
+// email is a summary email, sent as a raw MIME message so it can carry headers the simple SES API does not, e.g.
+// List-Unsubscribe.
+type email struct {
+	From        string
+	To          []string
+	Subject     string
+	ContentType string
+	Body        string
+	// Headers are added as they are, sorted by name.
+	Headers map[string]string
+}
+
+// mimeMessage renders the email as a MIME message, the body is quoted-printable so long template lines stay within
+// the SMTP line limit.
+func mimeMessage(e email, messageID string, date time.Time) ([]byte, error) {
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", e.From)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(e.To, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", e.Subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "Message-ID: <%s@stori.local>\r\n", messageID)
+
+	names := make([]string, 0, len(e.Headers))
+	for name := range e.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&message, "%s: %s\r\n", name, e.Headers[name])
+	}
+
+	fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&message, "Content-Type: %s; charset=UTF-8\r\n", e.ContentType)
+	fmt.Fprintf(&message, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	writer := quotedprintable.NewWriter(&message)
+	if _, err := writer.Write([]byte(e.Body)); err != nil {
+		return nil, fmt.Errorf("failed to encode email body: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to encode email body: %w", err)
+	}
+
+	return message.Bytes(), nil
+}
+
+// readMessage parses a message rendered by mimeMessage, returning its headers, content type and decoded body.
+func readMessage(raw []byte) (mail.Header, string, string, error) {
+	message, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, "", "", fmt.Errorf("failed to read email: %w", err)
+	}
+
+	contentType, _, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, "", "", fmt.Errorf("failed to read email content type: %w", err)
+	}
+
+	var body io.Reader = message.Body
+	if strings.EqualFold(message.Header.Get("Content-Transfer-Encoding"), "quoted-printable") {
+		body = quotedprintable.NewReader(body)
+	}
+	decoded, err := io.ReadAll(body)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("failed to read email body: %w", err)
+	}
+
+	return message.Header, contentType, string(decoded), nil
+}
+
+func newMessageID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("failed to generate message id: %w", err)
+	}
+
+	return hex.EncodeToString(id), nil
+}
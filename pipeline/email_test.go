@@ -0,0 +1,62 @@
+package pipeline
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	sesTypes "github.com/aws/aws-sdk-go-v2/service/ses/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMIMEMessage(t *testing.T) {
+	body := "<p>Total Balance: 39.74</p>" + strings.Repeat("x", 200)
+	message, err := mimeMessage(email{
+		From:        "sender@example.com",
+		To:          []string{"a@example.com", "b@example.com"},
+		Subject:     "Resumen de transacciones",
+		ContentType: "text/html",
+		Body:        body,
+		Headers:     map[string]string{"List-Unsubscribe": "<https://unsubscribe.example.com/?token=t>"},
+	}, "abc", time.Date(2023, 3, 31, 12, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+
+	headers, encoded, found := strings.Cut(string(message), "\r\n\r\n")
+	require.True(t, found)
+	require.Contains(t, headers, "From: sender@example.com\r\n")
+	require.Contains(t, headers, "To: a@example.com, b@example.com\r\n")
+	require.Contains(t, headers, "Subject: Resumen de transacciones\r\n")
+	require.Contains(t, headers, "Message-ID: <abc@stori.local>\r\n")
+	require.Contains(t, headers, "List-Unsubscribe: <https://unsubscribe.example.com/?token=t>\r\n")
+	require.Contains(t, headers, "Content-Type: text/html; charset=UTF-8\r\n")
+
+	for _, line := range strings.Split(encoded, "\r\n") {
+		require.LessOrEqual(t, len(line), 76)
+	}
+
+	_, contentType, decoded, err := readMessage(message)
+	require.NoError(t, err)
+	require.Equal(t, "text/html", contentType)
+	require.Equal(t, body, decoded)
+}
+
+func TestMIMEMessageText(t *testing.T) {
+	message, err := mimeMessage(email{
+		From:        "sender@example.com",
+		To:          []string{"a@example.com"},
+		Subject:     "Transaction Summary",
+		ContentType: "text/plain",
+		Body:        "Total Balance: 39.74",
+	}, "abc", time.Now())
+	require.NoError(t, err)
+	require.Contains(t, string(message), "Content-Type: text/plain; charset=UTF-8\r\n")
+}
+
+func TestSMTPSenderRequiresRecipient(t *testing.T) {
+	_, err := (&SMTPSender{Addr: "localhost:1025"}).SendRawEmail(context.Background(), &ses.SendRawEmailInput{
+		RawMessage: &sesTypes.RawMessage{Data: []byte("Subject: none\r\n\r\n")},
+	})
+	require.ErrorContains(t, err, "no recipient")
+}
@@ -0,0 +1,192 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/mail"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/stretchr/testify/require"
+	"stori-challenge/summary"
+)
+
+// fakeS3 is an in-memory bucket recording the requests it gets.
+type fakeS3 struct {
+	objects      map[string]string
+	metadata     map[string]map[string]string
+	contentTypes map[string]string
+	puts         []*s3.PutObjectInput
+	copies       []*s3.CopyObjectInput
+	deletes      []*s3.DeleteObjectInput
+	getErr       error
+	putErr       error
+	copyErr      error
+}
+
+func newFakeS3(objects map[string]string) *fakeS3 {
+	if objects == nil {
+		objects = map[string]string{}
+	}
+
+	return &fakeS3{objects: objects, metadata: map[string]map[string]string{}, contentTypes: map[string]string{}}
+}
+
+func (f *fakeS3) HeadObject(_ context.Context, params *s3.HeadObjectInput, _ ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	key := aws.ToString(params.Key)
+	if _, ok := f.objects[key]; !ok {
+		return nil, errors.New("NotFound")
+	}
+
+	output := &s3.HeadObjectOutput{Metadata: f.metadata[key]}
+	if contentType, ok := f.contentTypes[key]; ok {
+		output.ContentType = aws.String(contentType)
+	}
+
+	return output, nil
+}
+
+func (f *fakeS3) GetObject(_ context.Context, params *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	if f.getErr != nil {
+		return nil, f.getErr
+	}
+
+	body, ok := f.objects[aws.ToString(params.Key)]
+	if !ok {
+		return nil, errors.New("NoSuchKey")
+	}
+
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(body))}, nil
+}
+
+func (f *fakeS3) PutObject(_ context.Context, params *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	f.puts = append(f.puts, params)
+	if f.putErr != nil {
+		return nil, f.putErr
+	}
+
+	body, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.objects[aws.ToString(params.Key)] = string(body)
+	f.metadata[aws.ToString(params.Key)] = params.Metadata
+
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) CopyObject(_ context.Context, params *s3.CopyObjectInput, _ ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	f.copies = append(f.copies, params)
+	if f.copyErr != nil {
+		return nil, f.copyErr
+	}
+
+	source, err := url.PathUnescape(aws.ToString(params.CopySource))
+	if err != nil {
+		return nil, err
+	}
+	key := source[strings.Index(source, "/")+1:]
+	f.objects[aws.ToString(params.Key)] = f.objects[key]
+	f.metadata[aws.ToString(params.Key)] = params.Metadata
+	f.contentTypes[aws.ToString(params.Key)] = aws.ToString(params.ContentType)
+
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (f *fakeS3) DeleteObject(_ context.Context, params *s3.DeleteObjectInput, _ ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	f.deletes = append(f.deletes, params)
+	delete(f.objects, aws.ToString(params.Key))
+
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// fakeSES records the sent emails, failing the ones sent to the addresses in fail.
+type fakeSES struct {
+	sent []*ses.SendRawEmailInput
+	fail map[string]bool
+}
+
+func (f *fakeSES) SendRawEmail(_ context.Context, params *ses.SendRawEmailInput, _ ...func(*ses.Options)) (*ses.SendRawEmailOutput, error) {
+	if f.fail[params.Destinations[0]] {
+		return nil, errors.New("MessageRejected: Email address is not verified")
+	}
+	f.sent = append(f.sent, params)
+
+	return &ses.SendRawEmailOutput{MessageId: aws.String("message-1")}, nil
+}
+
+// email parses the i-th sent email.
+func (f *fakeSES) email(t *testing.T, i int) (mail.Header, string, string) {
+	t.Helper()
+
+	header, contentType, body, err := readMessage(f.sent[i].RawMessage.Data)
+	require.NoError(t, err)
+
+	return header, contentType, body
+}
+
+// fakeSummaries hands out increasing record ids.
+type fakeSummaries struct {
+	stored []*summary.Message
+	err    error
+}
+
+func (f *fakeSummaries) StoreSummary(_ context.Context, message *summary.Message) (int64, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	f.stored = append(f.stored, message)
+
+	return int64(len(f.stored)), nil
+}
+
+// fakeRecipients returns the recipients registered per account.
+type fakeRecipients struct {
+	byAccount map[string][]Recipient
+	err       error
+}
+
+func (f *fakeRecipients) Recipients(_ context.Context, account, fallback string) ([]Recipient, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if recipients := f.byAccount[account]; len(recipients) > 0 {
+		return recipients, nil
+	}
+	if fallback == "" {
+		return nil, nil
+	}
+
+	return []Recipient{{Email: fallback, Format: "html"}}, nil
+}
+
+// fakeDeliveries records the deliveries per run.
+type fakeDeliveries struct {
+	byRun map[string]map[string]bool
+}
+
+func (f *fakeDeliveries) Delivered(_ context.Context, runID string) (map[string]bool, error) {
+	delivered := make(map[string]bool)
+	for email := range f.byRun[runID] {
+		delivered[email] = true
+	}
+
+	return delivered, nil
+}
+
+func (f *fakeDeliveries) RecordDelivery(_ context.Context, runID, email, _ string) error {
+	if f.byRun == nil {
+		f.byRun = make(map[string]map[string]bool)
+	}
+	if f.byRun[runID] == nil {
+		f.byRun[runID] = make(map[string]bool)
+	}
+	f.byRun[runID][strings.ToLower(email)] = true
+
+	return nil
+}
@@ -0,0 +1,172 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+)
+
+// LocalBucket serves a local directory through the S3 calls used by the pipeline, object keys are paths relative
+// to Root. Metadata and tags are not kept.
+type LocalBucket struct {
+	Root string
+}
+
+// path maps an object key to a file under Root, refusing keys that would escape it.
+func (b *LocalBucket) path(key string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(strings.TrimPrefix(key, "/")))
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+
+	return filepath.Join(b.Root, clean), nil
+}
+
+// GetObject opens the file of the key.
+func (b *LocalBucket) GetObject(_ context.Context, params *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	path, err := b.path(aws.ToString(params.Key))
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3.GetObjectOutput{Body: file}, nil
+}
+
+// PutObject writes the body to the file of the key, creating its directories.
+func (b *LocalBucket) PutObject(_ context.Context, params *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	path, err := b.path(aws.ToString(params.Key))
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = writeFile(path, body); err != nil {
+		return nil, err
+	}
+
+	return &s3.PutObjectOutput{}, nil
+}
+
+// HeadObject stats the file of the key, local files have no content type.
+func (b *LocalBucket) HeadObject(_ context.Context, params *s3.HeadObjectInput, _ ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	path, err := b.path(aws.ToString(params.Key))
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3.HeadObjectOutput{ContentLength: info.Size()}, nil
+}
+
+// CopyObject copies the file of the copy source, which is '<bucket>/<key>' as sent to S3, to the file of the key.
+func (b *LocalBucket) CopyObject(_ context.Context, params *s3.CopyObjectInput, _ ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	source, err := url.PathUnescape(aws.ToString(params.CopySource))
+	if err != nil {
+		return nil, fmt.Errorf("invalid copy source %q: %w", aws.ToString(params.CopySource), err)
+	}
+	_, sourceKey, found := strings.Cut(source, "/")
+	if !found {
+		return nil, fmt.Errorf("invalid copy source %q", source)
+	}
+
+	sourcePath, err := b.path(sourceKey)
+	if err != nil {
+		return nil, err
+	}
+	path, err := b.path(aws.ToString(params.Key))
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := os.ReadFile(sourcePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = writeFile(path, body); err != nil {
+		return nil, err
+	}
+
+	return &s3.CopyObjectOutput{}, nil
+}
+
+// DeleteObject removes the file of the key, deleting a missing key succeeds as it does on S3.
+func (b *LocalBucket) DeleteObject(_ context.Context, params *s3.DeleteObjectInput, _ ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	path, err := b.path(aws.ToString(params.Key))
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func writeFile(path string, body []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, body, 0o644)
+}
+
+// Outbox writes the emails it is asked to send to a directory instead of sending them, one file per recipient.
+type Outbox struct {
+	Dir  string
+	sent int
+}
+
+// SendRawEmail writes the html or text body of the email to '<n>-<recipient>.html' or '.txt'.
+func (o *Outbox) SendRawEmail(_ context.Context, params *ses.SendRawEmailInput, _ ...func(*ses.Options)) (*ses.SendRawEmailOutput, error) {
+	if len(params.Destinations) == 0 {
+		return nil, fmt.Errorf("email has no recipient")
+	}
+	if params.RawMessage == nil {
+		return nil, fmt.Errorf("email has no message")
+	}
+
+	_, contentType, body, err := readMessage(params.RawMessage.Data)
+	if err != nil {
+		return nil, err
+	}
+	extension := ".html"
+	if contentType == "text/plain" {
+		extension = ".txt"
+	}
+
+	o.sent++
+	recipient := strings.Join(params.Destinations, ",")
+	name := fmt.Sprintf("%d-%s%s", o.sent, unsafeFileChars.Replace(recipient), extension)
+	if err := writeFile(filepath.Join(o.Dir, name), bytes.TrimSpace([]byte(body))); err != nil {
+		return nil, err
+	}
+
+	return &ses.SendRawEmailOutput{MessageId: aws.String(name)}, nil
+}
+
+// unsafeFileChars replaces the characters of an address that are awkward in file names.
+var unsafeFileChars = strings.NewReplacer("/", "_", "\\", "_", ":", "_", " ", "_")
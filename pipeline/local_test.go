@@ -0,0 +1,81 @@
+package pipeline
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/require"
+	"stori-challenge/templates"
+)
+
+func TestLocalBucketRejectsKeysOutsideRoot(t *testing.T) {
+	bucket := &LocalBucket{Root: t.TempDir()}
+
+	_, err := bucket.GetObject(context.Background(), &s3.GetObjectInput{Key: aws.String("../secret")})
+	require.ErrorContains(t, err, "invalid object key")
+
+	_, err = bucket.PutObject(context.Background(), &s3.PutObjectInput{Key: aws.String("output/../../x"), Body: strings.NewReader("")})
+	require.ErrorContains(t, err, "invalid object key")
+}
+
+func TestLocalBucketDeleteMissingKey(t *testing.T) {
+	bucket := &LocalBucket{Root: t.TempDir()}
+
+	_, err := bucket.DeleteObject(context.Background(), &s3.DeleteObjectInput{Key: aws.String("input/missing.csv")})
+	require.NoError(t, err)
+}
+
+// TestLocalPipeline runs the steps the way 'stori local' does, with a directory as the bucket and the outbox as SES.
+func TestLocalPipeline(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	outbox := t.TempDir()
+	bucket := &LocalBucket{Root: root}
+
+	require.NoError(t, UploadEmailTemplates(ctx, bucket, "local"))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "input", "acme"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "input", "acme", "july.csv"), []byte(sampleCSV), 0o644))
+
+	emailTemplate := templates.Default(templates.DefaultBrand)
+	parser := &Parser{S3: bucket}
+	storer := &Storer{Summaries: &fakeSummaries{}}
+	notifier := &Notifier{
+		S3:                bucket,
+		SES:               &Outbox{Dir: outbox},
+		Recipients:        &fakeRecipients{},
+		Bucket:            "local",
+		TemplateKey:       emailTemplate.Key(),
+		Brand:             templates.DefaultBrand,
+		UseSES:            true,
+		FallbackRecipient: "someone@example.com",
+	}
+
+	message, err := parser.Parse(ctx, "local", "input/acme/july.csv", "etag", "seq", time.Date(2023, 8, 3, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+
+	stored, err := storer.Store(ctx, &message)
+	require.NoError(t, err)
+
+	result, err := notifier.Notify(ctx, stored)
+	require.NoError(t, err)
+	require.Equal(t, 1, result.Recipients)
+
+	parser.Archive(ctx, &message)
+	require.Equal(t, "processed/acme/july.csv", message.ArchivedKey)
+	require.FileExists(t, filepath.Join(root, "processed", "acme", "july.csv"))
+	require.NoFileExists(t, filepath.Join(root, "input", "acme", "july.csv"))
+
+	output, err := os.ReadFile(filepath.Join(root, "output", "acme", "2023-08", "july-"+message.RunID+".html"))
+	require.NoError(t, err)
+	require.Contains(t, string(output), "Total Balance: 70.20")
+
+	sent, err := os.ReadFile(filepath.Join(outbox, "1-someone@example.com.html"))
+	require.NoError(t, err)
+	require.Contains(t, string(sent), "Total Balance: 70.20")
+}
@@ -0,0 +1,18 @@
+package pipeline
+
+import (
+	"context"
+
+	"stori-challenge/logging"
+	"stori-challenge/summary"
+)
+
+// WithRun returns a context whose log records carry the run id of the message, its account and source object, so
+// the records of every step of an upload share the same correlation id.
+func WithRun(ctx context.Context, message *summary.Message) context.Context {
+	return logging.WithFields(ctx, logging.Fields{
+		logging.RunIDKey: message.RunID,
+		"account":        message.Account,
+		"source_key":     message.SourceKey,
+	})
+}
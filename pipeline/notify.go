@@ -0,0 +1,316 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	sesTypes "github.com/aws/aws-sdk-go-v2/service/ses/types"
+	"stori-challenge/logging"
+	"stori-challenge/metrics"
+	"stori-challenge/runs"
+	"stori-challenge/summary"
+	"stori-challenge/templates"
+	"stori-challenge/tracing"
+)
+
+// Recipient is a row of the recipients table.
+type Recipient struct {
+	Email            string
+	Locale           string
+	Format           string
+	UnsubscribeToken string
+}
+
+// RecipientRepository looks up who gets the summary of an account.
+type RecipientRepository interface {
+	// Recipients returns the subscribed recipients of an account, or the fallback recipient when the account has
+	// no registered recipient at all. Addresses on the suppression list are never returned, and an account whose
+	// recipients all unsubscribed or are suppressed gets none.
+	Recipients(ctx context.Context, account, fallback string) ([]Recipient, error)
+}
+
+// DeliveryRepository records who got the summary of a run, so a retried notify step only sends it to the
+// recipients it failed for.
+type DeliveryRepository interface {
+	// Delivered returns the lowercased addresses the summary of the run was already sent to.
+	Delivered(ctx context.Context, runID string) (map[string]bool, error)
+	// RecordDelivery records that the summary of the run was sent to the address as the SES message.
+	RecordDelivery(ctx context.Context, runID, email, messageID string) error
+}
+
+// NotifierS3 is the part of the S3 client used by the notify step.
+type NotifierS3 interface {
+	ObjectGetter
+	ObjectPutter
+}
+
+// Notifier is the notify step, it renders the summary email, stores it in the bucket and sends it to the account
+// recipients when SES is enabled.
+type Notifier struct {
+	S3         NotifierS3
+	SES        EmailSender
+	Recipients RecipientRepository
+	// Deliveries is optional, without it a retried run is sent again to every recipient.
+	Deliveries DeliveryRepository
+	Tracker    runs.Tracker
+
+	Bucket      string
+	TemplateKey string
+	Brand       string
+	UseSES      bool
+	Sender      string
+	// FallbackRecipient gets the summaries of accounts without registered recipients.
+	FallbackRecipient string
+	UnsubscribeURL    string
+	// ConfigurationSet publishes bounce, complaint and delivery events of the sent emails when set.
+	ConfigurationSet string
+	// Prefixes of the bucket, the zero value uses the default ones.
+	Prefixes summary.Prefixes
+}
+
+// readEmailTemplate reads the email template from the bucket and returns it as a string.
+func (n *Notifier) readEmailTemplate(ctx context.Context) (string, error) {
+	result, err := n.S3.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(n.Bucket),
+		Key:    aws.String(n.TemplateKey),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get object from S3: %w", err)
+	}
+	defer result.Body.Close()
+
+	buf := new(strings.Builder)
+	_, err = io.Copy(buf, result.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read email template: %w", err)
+	}
+
+	return buf.String(), nil
+}
+
+// unsubscribeURL builds the link a recipient follows to opt out.
+func unsubscribeURL(baseURL, token string) string {
+	if baseURL == "" || token == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("%s?token=%s", baseURL, url.QueryEscape(token))
+}
+
+// getBody generates an email body from an email template and summary data in the recipient's preferred format.
+func (n *Notifier) getBody(ctx context.Context, templateStr string, recipient templates.Recipient, format string, summaryData *summary.SummaryData) (bytes.Buffer, error) {
+	brand, err := templates.GetBrand(n.Brand)
+	if err != nil {
+		return bytes.Buffer{}, err
+	}
+
+	if format == "text" {
+		return templates.RenderText(brand, recipient, summaryData)
+	}
+
+	emailBody, err := templates.Render(templateStr, brand, recipient, summaryData)
+	if err == nil {
+		return emailBody, nil
+	}
+
+	// A broken stored template should not stop the summary from going out, use the built-in one instead
+	fallback := templates.Default(n.Brand)
+	logging.ErrorContext(ctx, "stored template is invalid, falling back to the built-in one", logging.Fields{
+		"template_key": n.TemplateKey, "fallback_key": fallback.Key(), "error": err,
+	})
+
+	return templates.Render(fallback.Body, brand, recipient, summaryData)
+}
+
+// sendEmail sends an email using SES and returns its message id. With an unsubscribe link the email carries the
+// RFC 8058 headers, so mail clients offer a one-click unsubscribe that posts to the link.
+func (n *Notifier) sendEmail(ctx context.Context, emailBody bytes.Buffer, format, recipient, unsubscribeLink string) (string, error) {
+	message := email{
+		From:        n.Sender,
+		To:          []string{recipient},
+		Subject:     "Transaction Summary",
+		ContentType: "text/html",
+		Body:        emailBody.String(),
+	}
+	if format == "text" {
+		message.ContentType = "text/plain"
+	}
+	if unsubscribeLink != "" {
+		message.Headers = map[string]string{
+			"List-Unsubscribe":      "<" + unsubscribeLink + ">",
+			"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		}
+	}
+
+	messageID, err := newMessageID()
+	if err != nil {
+		return "", err
+	}
+	raw, err := mimeMessage(message, messageID, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	input := &ses.SendRawEmailInput{
+		Source:       aws.String(n.Sender),
+		Destinations: []string{recipient},
+		RawMessage:   &sesTypes.RawMessage{Data: raw},
+	}
+	// The configuration set publishes bounce, complaint and delivery events for this message
+	if n.ConfigurationSet != "" {
+		input.ConfigurationSetName = aws.String(n.ConfigurationSet)
+	}
+
+	output, err := n.SES.SendRawEmail(ctx, input)
+	if err != nil {
+		return "", fmt.Errorf("failed to send email: %w", err)
+	}
+
+	return aws.ToString(output.MessageId), nil
+}
+
+// outputMetadata ties the generated email back to the input object and the stored summary record.
+func outputMetadata(message *summary.Message) map[string]string {
+	metadata := map[string]string{
+		"run-id":        message.RunID,
+		"account":       message.Account,
+		"source-bucket": message.SourceBucket,
+		"source-key":    message.SourceKey,
+	}
+	if message.ArchivedKey != "" {
+		metadata["archived-key"] = message.ArchivedKey
+	}
+	if message.RecordID != 0 {
+		metadata["summary-record-id"] = strconv.FormatInt(message.RecordID, 10)
+	}
+
+	return metadata
+}
+
+// storeEmailOutput stores the email html generated to the output/ folder in the bucket.
+func (n *Notifier) storeEmailOutput(ctx context.Context, objectKey, emailBody string, metadata map[string]string) error {
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(n.Bucket),
+		Key:         aws.String(objectKey),
+		Body:        strings.NewReader(emailBody),
+		ContentType: aws.String("text/html"),
+		Metadata:    metadata,
+	}
+
+	_, err := n.S3.PutObject(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to store email output: %w", err)
+	}
+
+	return nil
+}
+
+// Notify notifies the summary of a run and records the outcome in processing_runs.
+func (n *Notifier) Notify(ctx context.Context, message *summary.Message) (_ summary.NotifyResult, err error) {
+	ctx, endStep := tracing.StartStep(ctx, "notify", message.RunID, message.TraceHeader)
+	defer func() { endStep(err) }()
+	ctx = WithRun(ctx, message)
+	result, err := n.notify(ctx, message)
+	metrics.Emit(ctx, metrics.Count(metrics.EmailsSent, result.Recipients))
+	if err != nil {
+		n.Tracker.Failed(ctx, message.RunID, runs.StageNotify, err, nil)
+		return result, err
+	}
+	n.Tracker.Completed(ctx, message.RunID, result.OutputKey)
+
+	return result, nil
+}
+
+func (n *Notifier) notify(ctx context.Context, message *summary.Message) (summary.NotifyResult, error) {
+	templateStr, err := n.readEmailTemplate(ctx)
+	if err != nil {
+		// Like a broken one, a stored template that cannot be read should not stop the summary from going out
+		fallback := templates.Default(n.Brand)
+		logging.ErrorContext(ctx, "unable to get email template, falling back to the built-in one", logging.Fields{
+			"template_key": n.TemplateKey, "fallback_key": fallback.Key(), "error": err,
+		})
+		templateStr = fallback.Body
+	}
+
+	emailBody, err := n.getBody(ctx, templateStr, templates.Recipient{}, "html", &message.Summary)
+	if err != nil {
+		logging.ErrorContext(ctx, "unable to get email body", logging.Fields{"error": err})
+		return summary.NotifyResult{}, err
+	}
+
+	if message.ReceivedAt.IsZero() {
+		message.ReceivedAt = time.Now().UTC()
+	}
+
+	result := summary.NotifyResult{OutputKey: n.Prefixes.OutputKey(*message)}
+
+	err = n.storeEmailOutput(ctx, result.OutputKey, emailBody.String(), outputMetadata(message))
+	if err != nil {
+		logging.ErrorContext(ctx, "failed to store email output", logging.Fields{"error": err})
+		return summary.NotifyResult{}, err
+	}
+
+	if !n.UseSES {
+		return result, nil
+	}
+
+	recipients, err := n.Recipients.Recipients(ctx, message.Account, n.FallbackRecipient)
+	if err != nil {
+		return result, fmt.Errorf("failed to get recipients: %w", err)
+	}
+
+	delivered := map[string]bool{}
+	if n.Deliveries != nil {
+		if delivered, err = n.Deliveries.Delivered(ctx, message.RunID); err != nil {
+			return result, fmt.Errorf("failed to get deliveries: %w", err)
+		}
+	}
+
+	var failed []string
+	for _, recipient := range recipients {
+		// A retried run, e.g. redelivered by the send queue, only goes to the recipients it failed for
+		if delivered[strings.ToLower(recipient.Email)] {
+			logging.InfoContext(ctx, "summary already sent, skipping", logging.Fields{"recipient": recipient.Email})
+			continue
+		}
+
+		templateRecipient := templates.Recipient{
+			Locale:         recipient.Locale,
+			UnsubscribeURL: unsubscribeURL(n.UnsubscribeURL, recipient.UnsubscribeToken),
+		}
+
+		var messageID string
+		body, err := n.getBody(ctx, templateStr, templateRecipient, recipient.Format, &message.Summary)
+		if err == nil {
+			messageID, err = n.sendEmail(ctx, body, recipient.Format, recipient.Email, templateRecipient.UnsubscribeURL)
+		}
+		if err != nil {
+			logging.ErrorContext(ctx, "failed to send email", logging.Fields{"recipient": recipient.Email, "error": err})
+			failed = append(failed, recipient.Email)
+			continue
+		}
+		result.Recipients++
+
+		// The email is out, failing the run now would only send it again
+		if n.Deliveries != nil {
+			if err = n.Deliveries.RecordDelivery(ctx, message.RunID, recipient.Email, messageID); err != nil {
+				logging.ErrorContext(ctx, "failed to record delivery", logging.Fields{"recipient": recipient.Email, "error": err})
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return result, fmt.Errorf("failed to send email to %d of %d recipients", len(failed), len(recipients))
+	}
+
+	return result, nil
+}
@@ -0,0 +1,162 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/require"
+	"stori-challenge/summary"
+	"stori-challenge/templates"
+)
+
+// newNotifier returns a notifier over a bucket holding the latest stori template.
+func newNotifier(t *testing.T) (*Notifier, *fakeS3, *fakeSES) {
+	emailTemplate, err := templates.Get(templates.DefaultBrand, "")
+	require.NoError(t, err)
+
+	bucket := newFakeS3(map[string]string{emailTemplate.Key(): emailTemplate.Body})
+	sender := &fakeSES{}
+
+	return &Notifier{
+		S3:          bucket,
+		SES:         sender,
+		Recipients:  &fakeRecipients{},
+		Bucket:      "bucket",
+		TemplateKey: emailTemplate.Key(),
+		Brand:       templates.DefaultBrand,
+		Sender:      "sender@example.com",
+	}, bucket, sender
+}
+
+func testMessage() *summary.Message {
+	message := summary.NewMessage("bucket", "input/acme/july.csv", "etag", "seq",
+		time.Date(2023, 8, 3, 10, 0, 0, 0, time.UTC), *templates.Fixture())
+	message.RecordID = 7
+
+	return &message
+}
+
+func TestNotifyStoresOutputWithoutSES(t *testing.T) {
+	notifier, bucket, sender := newNotifier(t)
+
+	result, err := notifier.Notify(context.Background(), testMessage())
+	require.NoError(t, err)
+	require.Equal(t, "output/acme/2023-08/july-"+testMessage().RunID+".html", result.OutputKey)
+	require.Zero(t, result.Recipients)
+	require.Empty(t, sender.sent)
+
+	require.Contains(t, bucket.objects[result.OutputKey], "Total Balance: 39.74")
+	require.Equal(t, "7", bucket.metadata[result.OutputKey]["summary-record-id"])
+	require.Equal(t, "input/acme/july.csv", bucket.metadata[result.OutputKey]["source-key"])
+}
+
+func TestNotifySendsToAccountRecipients(t *testing.T) {
+	notifier, _, sender := newNotifier(t)
+	notifier.UseSES = true
+	notifier.ConfigurationSet = "summary-events"
+	notifier.UnsubscribeURL = "https://unsubscribe.example.com/"
+	notifier.Recipients = &fakeRecipients{byAccount: map[string][]Recipient{"acme": {
+		{Email: "html@example.com", Format: "html", Locale: "es-MX", UnsubscribeToken: "token-1"},
+		{Email: "text@example.com", Format: "text"},
+	}}}
+
+	result, err := notifier.Notify(context.Background(), testMessage())
+	require.NoError(t, err)
+	require.Equal(t, 2, result.Recipients)
+
+	require.Len(t, sender.sent, 2)
+	require.Equal(t, "summary-events", aws.ToString(sender.sent[0].ConfigurationSetName))
+	require.Equal(t, "sender@example.com", aws.ToString(sender.sent[0].Source))
+	require.Equal(t, []string{"html@example.com"}, sender.sent[0].Destinations)
+
+	header, contentType, body := sender.email(t, 0)
+	require.Equal(t, "text/html", contentType)
+	require.Contains(t, body, "https://unsubscribe.example.com/?token=token-1")
+	// Mail clients offer a one-click unsubscribe posting to the link
+	require.Equal(t, "<https://unsubscribe.example.com/?token=token-1>", header.Get("List-Unsubscribe"))
+	require.Equal(t, "List-Unsubscribe=One-Click", header.Get("List-Unsubscribe-Post"))
+
+	// Recipients without a token have no link to unsubscribe with
+	header, contentType, body = sender.email(t, 1)
+	require.Equal(t, "text/plain", contentType)
+	require.NotEmpty(t, body)
+	require.Empty(t, header.Get("List-Unsubscribe"))
+}
+
+func TestNotifyFallsBackToDeploymentRecipient(t *testing.T) {
+	notifier, _, sender := newNotifier(t)
+	notifier.UseSES = true
+	notifier.FallbackRecipient = "fallback@example.com"
+
+	result, err := notifier.Notify(context.Background(), testMessage())
+	require.NoError(t, err)
+	require.Equal(t, 1, result.Recipients)
+	require.Equal(t, []string{"fallback@example.com"}, sender.sent[0].Destinations)
+}
+
+func TestNotifyReportsFailedRecipients(t *testing.T) {
+	notifier, _, sender := newNotifier(t)
+	notifier.UseSES = true
+	notifier.Recipients = &fakeRecipients{byAccount: map[string][]Recipient{"acme": {
+		{Email: "ok@example.com", Format: "html"},
+		{Email: "unverified@example.com", Format: "html"},
+	}}}
+	sender.fail = map[string]bool{"unverified@example.com": true}
+
+	result, err := notifier.Notify(context.Background(), testMessage())
+	require.ErrorContains(t, err, "failed to send email to 1 of 2 recipients")
+	require.Equal(t, 1, result.Recipients)
+}
+
+func TestNotifyRetrySkipsDeliveredRecipients(t *testing.T) {
+	notifier, _, sender := newNotifier(t)
+	notifier.UseSES = true
+	notifier.Deliveries = &fakeDeliveries{}
+	notifier.Recipients = &fakeRecipients{byAccount: map[string][]Recipient{"acme": {
+		{Email: "OK@example.com", Format: "html"},
+		{Email: "unverified@example.com", Format: "html"},
+	}}}
+	sender.fail = map[string]bool{"unverified@example.com": true}
+
+	_, err := notifier.Notify(context.Background(), testMessage())
+	require.Error(t, err)
+	require.Len(t, sender.sent, 1)
+
+	// The retry only goes to the recipient that failed
+	sender.fail = nil
+	result, err := notifier.Notify(context.Background(), testMessage())
+	require.NoError(t, err)
+	require.Equal(t, 1, result.Recipients)
+	require.Len(t, sender.sent, 2)
+	require.Equal(t, []string{"unverified@example.com"}, sender.sent[1].Destinations)
+}
+
+func TestNotifyFallsBackToBuiltInTemplate(t *testing.T) {
+	notifier, bucket, _ := newNotifier(t)
+	bucket.objects[notifier.TemplateKey] = "{{.Missing"
+
+	result, err := notifier.Notify(context.Background(), testMessage())
+	require.NoError(t, err)
+	require.Contains(t, bucket.objects[result.OutputKey], "Total Balance: 39.74")
+}
+
+func TestNotifyFallsBackToBuiltInTemplateWhenUnreadable(t *testing.T) {
+	notifier, bucket, _ := newNotifier(t)
+	bucket.getErr = errors.New("NoSuchKey")
+
+	result, err := notifier.Notify(context.Background(), testMessage())
+	require.NoError(t, err)
+	require.Contains(t, bucket.objects[result.OutputKey], "Total Balance: 39.74")
+}
+
+func TestNotifyFailsOnRecipientLookup(t *testing.T) {
+	notifier, _, _ := newNotifier(t)
+	notifier.UseSES = true
+	notifier.Recipients = &fakeRecipients{err: errors.New("connection refused")}
+
+	_, err := notifier.Notify(context.Background(), testMessage())
+	require.ErrorContains(t, err, "failed to get recipients")
+}
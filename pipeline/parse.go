@@ -0,0 +1,222 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"stori-challenge/logging"
+	"stori-challenge/metrics"
+	"stori-challenge/runs"
+	"stori-challenge/summary"
+	"stori-challenge/tracing"
+)
+
+const (
+	maxTagValueLength      = 256
+	maxMetadataValueLength = 1024
+)
+
+// unsafeTagChars matches the characters S3 does not accept in tag values.
+var unsafeTagChars = regexp.MustCompile(`[^\p{L}\p{N} _.:/=+\-@]+`)
+
+// ParserS3 is the part of the S3 client used by the parse step.
+type ParserS3 interface {
+	ObjectGetter
+	ObjectArchiver
+}
+
+// Parser is the parse step, it summarizes an uploaded CSV file and moves it out of the input prefix.
+type Parser struct {
+	S3      ParserS3
+	Tracker runs.Tracker
+	// Prefixes of the bucket, the zero value uses the default ones.
+	Prefixes summary.Prefixes
+}
+
+// readCsv reads a CSV file from S3 and returns its contents as a string.
+func (p *Parser) readCsv(ctx context.Context, bucket, key string) (string, error) {
+	result, err := p.S3.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get object from S3: %w", err)
+	}
+	defer result.Body.Close()
+
+	buf := new(strings.Builder)
+	_, err = io.Copy(buf, result.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read object body: %w", err)
+	}
+
+	return buf.String(), nil
+}
+
+// Parse reads and processes a CSV object, returning the message for the next steps. The run is recorded in
+// processing_runs along with the rejection report when the file is rejected. Files that cannot be parsed are moved
+// to the quarantine prefix, while failures reading them leave them in place to be retried. The message carries the
+// trace header of the step.
+func (p *Parser) Parse(ctx context.Context, bucket, key, etag, sequencer string, receivedAt time.Time) (_ summary.Message, err error) {
+	runID := summary.RunID(bucket, key, etag, sequencer)
+	ctx, endStep := tracing.StartStep(ctx, "parse", runID, "")
+	defer func() { endStep(err) }()
+	ctx = logging.WithFields(ctx, logging.Fields{logging.RunIDKey: runID, "bucket": bucket, "source_key": key, "etag": etag})
+	p.Tracker.Started(ctx, runs.Run{
+		RunID:    runID,
+		Bucket:   bucket,
+		InputKey: key,
+		ETag:     etag,
+		Account:  p.Prefixes.AccountFromKey(key),
+	})
+
+	csvData, err := p.readCsv(ctx, bucket, key)
+	if err != nil {
+		err = fmt.Errorf("failed to read CSV from S3: %w", err)
+		p.Tracker.Failed(ctx, runID, runs.StageParse, err, nil)
+		return summary.Message{}, err
+	}
+
+	summaryData, report, err := summary.ParseCSV(csvData)
+	metrics.Emit(ctx, metrics.Count(metrics.RowsParsed, report.RowsParsed), metrics.Count(metrics.RowsRejected, len(report.Rejections)))
+	if err != nil {
+		err = fmt.Errorf("failed to process CSV data: %w", err)
+		p.Tracker.Failed(ctx, runID, runs.StageParse, err, &report)
+		p.quarantine(ctx, runID, bucket, key, err, map[string]string{
+			"rows-parsed":   strconv.Itoa(report.RowsParsed),
+			"rows-rejected": strconv.Itoa(len(report.Rejections)),
+		})
+		return summary.Message{}, err
+	}
+	p.Tracker.Parsed(ctx, runID, report)
+	metrics.Emit(ctx, metrics.Count(metrics.FilesProcessed, 1))
+
+	message := summary.NewMessage(bucket, key, etag, sequencer, receivedAt, summaryData)
+	message.Account = p.Prefixes.AccountFromKey(key)
+	message.TraceHeader = tracing.Header(ctx)
+
+	return message, nil
+}
+
+// Archive moves the input file of a notified run to the processed prefix. A failed move is only logged, the
+// summary is already out and the file can still be moved by hand.
+func (p *Parser) Archive(ctx context.Context, message *summary.Message) {
+	tags := map[string]string{"outcome": summary.OutcomeProcessed, "run-id": message.RunID}
+	metadata := map[string]string{"run-id": message.RunID, "source-key": message.SourceKey}
+
+	archivedKey, err := p.archiveObject(ctx, message.SourceBucket, message.SourceKey, p.Prefixes.WithDefaults().Processed, tags, metadata)
+	if err != nil {
+		logging.ErrorContext(WithRun(ctx, message), "failed to archive input file", logging.Fields{"error": err})
+		return
+	}
+
+	message.ArchivedKey = archivedKey
+}
+
+// Quarantine moves the input file of a parsed run to the quarantine prefix once storing or notifying its summary
+// failed, tagged with the failure reason. A failed move is only logged, like with Archive.
+func (p *Parser) Quarantine(ctx context.Context, message *summary.Message, reason error) {
+	message.ArchivedKey = p.quarantine(WithRun(ctx, message), message.RunID, message.SourceBucket, message.SourceKey, reason, nil)
+}
+
+// quarantine moves an input file to the quarantine prefix, tagged with the failure reason and annotated with the
+// extra metadata, and returns the new key, empty when the file could not be moved.
+func (p *Parser) quarantine(ctx context.Context, runID, bucket, key string, reason error, extra map[string]string) string {
+	tags := map[string]string{"outcome": summary.OutcomeQuarantined, "run-id": runID, "failure-reason": reason.Error()}
+	metadata := map[string]string{"run-id": runID, "source-key": key, "failure-reason": reason.Error()}
+	for name, value := range extra {
+		metadata[name] = value
+	}
+
+	archivedKey, err := p.archiveObject(ctx, bucket, key, p.Prefixes.WithDefaults().Quarantine, tags, metadata)
+	if err != nil {
+		logging.ErrorContext(ctx, "failed to quarantine input file", logging.Fields{"error": err})
+		return ""
+	}
+
+	logging.InfoContext(ctx, "quarantined input file", logging.Fields{"archived_key": archivedKey})
+
+	return archivedKey
+}
+
+// archiveObject moves an input object under prefix, replacing its tags and metadata with the outcome of the run,
+// and returns the new key.
+func (p *Parser) archiveObject(ctx context.Context, bucket, key, prefix string, tags, metadata map[string]string) (string, error) {
+	archivedKey := p.Prefixes.ArchiveKey(key, prefix)
+
+	tagging := url.Values{}
+	for name, value := range tags {
+		tagging.Set(name, tagValue(value))
+	}
+	for name, value := range metadata {
+		metadata[name] = metadataValue(value)
+	}
+
+	// Replacing the metadata drops the content type of the source as well, it is carried over explicitly
+	head, err := p.S3.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", key, err)
+	}
+
+	_, err = p.S3.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:            aws.String(bucket),
+		Key:               aws.String(archivedKey),
+		CopySource:        aws.String((&url.URL{Path: bucket + "/" + key}).EscapedPath()),
+		ContentType:       head.ContentType,
+		Metadata:          metadata,
+		MetadataDirective: s3Types.MetadataDirectiveReplace,
+		Tagging:           aws.String(tagging.Encode()),
+		TaggingDirective:  s3Types.TaggingDirectiveReplace,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to copy %s to %s: %w", key, archivedKey, err)
+	}
+
+	_, err = p.S3.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return "", fmt.Errorf("failed to delete %s after copying it to %s: %w", key, archivedKey, err)
+	}
+
+	return archivedKey, nil
+}
+
+// tagValue makes a failure reason fit in an S3 tag value. The letters allowed in tags can take several bytes, so
+// the value is cut on a rune boundary to stay valid UTF-8.
+func tagValue(value string) string {
+	value = strings.Join(strings.Fields(unsafeTagChars.ReplaceAllString(value, " ")), " ")
+	length := 0
+	for length < len(value) {
+		_, size := utf8.DecodeRuneInString(value[length:])
+		if length+size > maxTagValueLength {
+			break
+		}
+		length += size
+	}
+
+	return value[:length]
+}
+
+// metadataValue makes a failure reason fit in an S3 metadata header, which only carries printable ASCII.
+func metadataValue(value string) string {
+	value = strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' {
+			return ' '
+		}
+		return r
+	}, value)
+	if len(value) > maxMetadataValueLength {
+		value = value[:maxMetadataValueLength]
+	}
+
+	return value
+}
@@ -0,0 +1,168 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/require"
+	"stori-challenge/summary"
+)
+
+const sampleCSV = "Id,Type,Amount,Date\n0,credit,60.5,2023-07-15\n1,debit,-10.3,2023-07-28\n2,credit,20,2023-08-02\n"
+
+func TestParse(t *testing.T) {
+	fake := newFakeS3(map[string]string{"input/acme/july.csv": sampleCSV})
+	parser := &Parser{S3: fake}
+	receivedAt := time.Date(2023, 8, 3, 10, 0, 0, 0, time.UTC)
+
+	message, err := parser.Parse(context.Background(), "bucket", "input/acme/july.csv", "etag", "seq", receivedAt)
+	require.NoError(t, err)
+
+	require.Equal(t, summary.RunID("bucket", "input/acme/july.csv", "etag", "seq"), message.RunID)
+	require.Equal(t, "acme", message.Account)
+	require.Equal(t, receivedAt, message.ReceivedAt)
+	require.InDelta(t, 80.5, message.Summary.CreditTotal, 0.001)
+	require.Equal(t, 2, message.Summary.TransactionsByMonth["2023-07"])
+	require.Empty(t, fake.copies, "parsing alone must not move the file")
+}
+
+func TestParseQuarantinesRejectedFile(t *testing.T) {
+	fake := newFakeS3(map[string]string{"input/july.csv": "Id,Type,Amount,Date\n0,credit,60.5,2023-07-15\n1,refund,10,2023-07-28\n"})
+	parser := &Parser{S3: fake}
+
+	_, err := parser.Parse(context.Background(), "bucket", "input/july.csv", "etag", "seq", time.Now())
+	require.Error(t, err)
+
+	var rejected *summary.RejectedRowsError
+	require.True(t, errors.As(err, &rejected))
+
+	require.Contains(t, fake.objects, "quarantine/july.csv")
+	require.NotContains(t, fake.objects, "input/july.csv")
+}
+
+func TestParseLeavesUnreadableFileInPlace(t *testing.T) {
+	fake := newFakeS3(map[string]string{"input/july.csv": sampleCSV})
+	fake.getErr = errors.New("SlowDown")
+	parser := &Parser{S3: fake}
+
+	_, err := parser.Parse(context.Background(), "bucket", "input/july.csv", "etag", "seq", time.Now())
+	require.ErrorContains(t, err, "SlowDown")
+	require.Empty(t, fake.copies)
+	require.Empty(t, fake.deletes)
+}
+
+func TestArchive(t *testing.T) {
+	fake := newFakeS3(map[string]string{"input/acme/march 2023.csv": sampleCSV})
+	fake.contentTypes["input/acme/march 2023.csv"] = "text/csv"
+	parser := &Parser{S3: fake}
+	message := &summary.Message{RunID: "run-1", SourceBucket: "bucket", SourceKey: "input/acme/march 2023.csv"}
+
+	parser.Archive(context.Background(), message)
+	require.Equal(t, "processed/acme/march 2023.csv", message.ArchivedKey)
+
+	require.Len(t, fake.copies, 1)
+	copied := fake.copies[0]
+	require.Equal(t, "bucket/input/acme/march%202023.csv", aws.ToString(copied.CopySource))
+	require.Equal(t, "processed/acme/march 2023.csv", aws.ToString(copied.Key))
+	require.Equal(t, s3Types.TaggingDirectiveReplace, copied.TaggingDirective)
+	require.Equal(t, "outcome=processed&run-id=run-1", aws.ToString(copied.Tagging))
+	require.Equal(t, "input/acme/march 2023.csv", copied.Metadata["source-key"])
+	// The metadata is replaced, the content type of the upload must survive it
+	require.Equal(t, s3Types.MetadataDirectiveReplace, copied.MetadataDirective)
+	require.Equal(t, "text/csv", aws.ToString(copied.ContentType))
+
+	require.Len(t, fake.deletes, 1)
+	require.Equal(t, "input/acme/march 2023.csv", aws.ToString(fake.deletes[0].Key))
+}
+
+func TestParseWithPrefixes(t *testing.T) {
+	prefixes := summary.Prefixes{
+		Input:      "tenants/acme/input/",
+		Processed:  "tenants/acme/processed/",
+		Quarantine: "tenants/acme/quarantine/",
+	}
+	fake := newFakeS3(map[string]string{
+		"tenants/acme/input/north/july.csv": sampleCSV,
+		"tenants/acme/input/bad.csv":        "Id,Type,Amount,Date\n1,refund,10,2023-07-28\n",
+	})
+	parser := &Parser{S3: fake, Prefixes: prefixes}
+
+	message, err := parser.Parse(context.Background(), "bucket", "tenants/acme/input/north/july.csv", "etag", "seq", time.Now())
+	require.NoError(t, err)
+	require.Equal(t, "north", message.Account)
+
+	parser.Archive(context.Background(), &message)
+	require.Equal(t, "tenants/acme/processed/north/july.csv", message.ArchivedKey)
+
+	_, err = parser.Parse(context.Background(), "bucket", "tenants/acme/input/bad.csv", "etag", "seq", time.Now())
+	require.Error(t, err)
+	require.Contains(t, fake.objects, "tenants/acme/quarantine/bad.csv")
+}
+
+func TestArchiveKeepsFileWhenCopyFails(t *testing.T) {
+	fake := newFakeS3(map[string]string{"input/sample.csv": sampleCSV})
+	fake.copyErr = errors.New("access denied")
+	parser := &Parser{S3: fake}
+	message := &summary.Message{RunID: "run-1", SourceBucket: "bucket", SourceKey: "input/sample.csv"}
+
+	parser.Archive(context.Background(), message)
+	require.Empty(t, message.ArchivedKey)
+	require.Len(t, fake.copies, 1)
+	require.Empty(t, fake.deletes, "the input file must not be deleted when the copy failed")
+}
+
+func TestQuarantineTagsFailureReason(t *testing.T) {
+	fake := newFakeS3(map[string]string{"input/sample.csv": "Id,Type,Amount,Date\n0,credit,60.5,2023-07-15\n1,debit,-10,julio\n"})
+	parser := &Parser{S3: fake}
+
+	_, err := parser.Parse(context.Background(), "bucket", "input/sample.csv", "etag", "seq", time.Now())
+	require.Error(t, err)
+
+	require.Len(t, fake.copies, 1)
+	copied := fake.copies[0]
+	require.Equal(t, "quarantine/sample.csv", aws.ToString(copied.Key))
+	require.Equal(t, "1", copied.Metadata["rows-parsed"])
+	require.Equal(t, "1", copied.Metadata["rows-rejected"])
+	require.Equal(t, "failed to process CSV data: rejected line 3: invalid date: julio", copied.Metadata["failure-reason"])
+
+	tags, parseErr := url.ParseQuery(aws.ToString(copied.Tagging))
+	require.NoError(t, parseErr)
+	require.Equal(t, "quarantined", tags.Get("outcome"))
+	require.Equal(t, "failed to process CSV data: rejected line 3: invalid date: julio", tags.Get("failure-reason"))
+}
+
+func TestQuarantineAfterFailedStep(t *testing.T) {
+	fake := newFakeS3(map[string]string{"input/acme/july.csv": sampleCSV})
+	parser := &Parser{S3: fake}
+	message := &summary.Message{RunID: "run-1", SourceBucket: "bucket", SourceKey: "input/acme/july.csv"}
+
+	parser.Quarantine(context.Background(), message, errors.New("failed to store summary: connection refused"))
+	require.Equal(t, "quarantine/acme/july.csv", message.ArchivedKey)
+	require.NotContains(t, fake.objects, "input/acme/july.csv")
+
+	copied := fake.copies[0]
+	require.Equal(t, "failed to store summary: connection refused", copied.Metadata["failure-reason"])
+	require.NotContains(t, copied.Metadata, "rows-parsed", "no rejection report once parsed")
+
+	tags, err := url.ParseQuery(aws.ToString(copied.Tagging))
+	require.NoError(t, err)
+	require.Equal(t, "quarantined", tags.Get("outcome"))
+	require.Equal(t, "run-1", tags.Get("run-id"))
+}
+
+func TestTagValue(t *testing.T) {
+	require.Equal(t, "failed to read: x y", tagValue("failed to read: \"x\" y"))
+	require.Len(t, tagValue(strings.Repeat("a", 300)), maxTagValueLength)
+
+	// Two-byte letters are not split when the limit falls in the middle of one
+	value := tagValue("a" + strings.Repeat("ñ", 200))
+	require.True(t, utf8.ValidString(value))
+	require.Len(t, value, maxTagValueLength-1)
+}
@@ -0,0 +1,199 @@
+package pipeline
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"stori-challenge/logging"
+	"stori-challenge/summary"
+)
+
+// Postgres implements the repositories on the database of the pool, see Database.
+type Postgres struct {
+	DB *sql.DB
+}
+
+// StoreSummary inserts the summary into summary_records and returns the id of the row. Storing the same run
+// twice, e.g. when a step is retried, returns the existing row instead of inserting a duplicate.
+func (p *Postgres) StoreSummary(ctx context.Context, message *summary.Message) (int64, error) {
+	summaryData := &message.Summary
+
+	// Convert maps to JSON strings
+	transactionsByMonthJSON, err := json.Marshal(summaryData.TransactionsByMonth)
+	if err != nil {
+		return 0, err
+	}
+	avgCreditsByMonthJSON, err := json.Marshal(summaryData.AvgCreditsByMonth)
+	if err != nil {
+		return 0, err
+	}
+	avgDebitsByMonthJSON, err := json.Marshal(summaryData.AvgDebitsByMonth)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `
+	INSERT INTO summary_records (debit_total, credit_total, transactions_by_month, avg_credits_by_month, avg_debits_by_month, total_balance, created_at, run_id, source_key)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), $9)
+	ON CONFLICT (run_id) DO UPDATE SET run_id = EXCLUDED.run_id
+	RETURNING id`
+
+	date := time.Now().Format("02-01-2006")
+
+	var recordID int64
+	err = p.DB.QueryRowContext(ctx, query, summaryData.DebitTotal, summaryData.CreditTotal, transactionsByMonthJSON,
+		avgCreditsByMonthJSON, avgDebitsByMonthJSON, summaryData.TotalBalance, date, message.RunID, message.SourceKey).Scan(&recordID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert summary data into the database: %v", err)
+	}
+
+	logging.InfoContext(ctx, "stored summary", logging.Fields{"record_id": recordID})
+
+	return recordID, nil
+}
+
+// Recipients returns the subscribed recipients of an account from the recipients table, or the fallback
+// recipient when the account has no row there at all. Addresses on the suppression list are never returned, and
+// an account whose recipients all unsubscribed or are suppressed gets no email rather than the fallback one.
+func (p *Postgres) Recipients(ctx context.Context, account, fallback string) ([]Recipient, error) {
+	query := `
+	SELECT r.email, r.locale, r.format, r.unsubscribe_token
+	FROM recipients r
+	LEFT JOIN suppressed_recipients s ON s.email = lower(r.email)
+	WHERE r.account = $1 AND NOT r.unsubscribed AND s.email IS NULL
+	ORDER BY r.id`
+
+	rows, err := p.DB.QueryContext(ctx, query, account)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query recipients: %w", err)
+	}
+	defer rows.Close()
+
+	var recipients []Recipient
+	for rows.Next() {
+		var recipient Recipient
+		if err = rows.Scan(&recipient.Email, &recipient.Locale, &recipient.Format, &recipient.UnsubscribeToken); err != nil {
+			return nil, fmt.Errorf("failed to read recipient: %w", err)
+		}
+		recipients = append(recipients, recipient)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Accounts without registered recipients keep going to the deployment wide recipient
+	if len(recipients) > 0 || fallback == "" {
+		return recipients, nil
+	}
+
+	var registered bool
+	err = p.DB.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM recipients WHERE account = $1)`, account).Scan(&registered)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check registered recipients: %w", err)
+	}
+	if registered {
+		logging.InfoContext(ctx, "every recipient of the account unsubscribed or is suppressed, skipping", nil)
+		return nil, nil
+	}
+
+	var suppressed bool
+	err = p.DB.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM suppressed_recipients WHERE email = lower($1))`, fallback).Scan(&suppressed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check suppression list: %w", err)
+	}
+	if suppressed {
+		logging.InfoContext(ctx, "fallback recipient is on the suppression list, skipping", nil)
+		return nil, nil
+	}
+
+	return []Recipient{{Email: fallback, Format: "html"}}, nil
+}
+
+// Delivered returns the lowercased addresses the summary of the run was already sent to.
+func (p *Postgres) Delivered(ctx context.Context, runID string) (map[string]bool, error) {
+	rows, err := p.DB.QueryContext(ctx, `SELECT email FROM summary_deliveries WHERE run_id = $1`, runID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	delivered := make(map[string]bool)
+	for rows.Next() {
+		var email string
+		if err = rows.Scan(&email); err != nil {
+			return nil, fmt.Errorf("failed to read delivery: %w", err)
+		}
+		delivered[email] = true
+	}
+
+	return delivered, rows.Err()
+}
+
+// RecordDelivery records in summary_deliveries that the summary of the run was sent to the address.
+func (p *Postgres) RecordDelivery(ctx context.Context, runID, email, messageID string) error {
+	query := `
+	INSERT INTO summary_deliveries (run_id, email, message_id) VALUES ($1, lower($2), NULLIF($3, ''))
+	ON CONFLICT (run_id, email) DO NOTHING`
+
+	if _, err := p.DB.ExecContext(ctx, query, runID, email, messageID); err != nil {
+		return fmt.Errorf("failed to record delivery: %w", err)
+	}
+
+	return nil
+}
+
+// Unsubscribe flips the unsubscribed flag of the recipient owning the token, reporting whether a recipient matched.
+func (p *Postgres) Unsubscribe(ctx context.Context, token string) (bool, error) {
+	res, err := p.DB.ExecContext(ctx, `UPDATE recipients SET unsubscribed = TRUE WHERE unsubscribe_token = $1`, token)
+	if err != nil {
+		return false, fmt.Errorf("failed to unsubscribe recipient: %w", err)
+	}
+
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return updated > 0, nil
+}
+
+// EmailEvent is a single row of the email_events table, Suppress adds the address to the suppression list.
+type EmailEvent struct {
+	MessageID string
+	EventType string
+	Email     string
+	Detail    string
+	Suppress  bool
+}
+
+// RecordEmailEvents stores the events in email_events and suppresses the addresses flagged by them.
+func (p *Postgres) RecordEmailEvents(ctx context.Context, emailEvents []EmailEvent) error {
+	for _, emailEvent := range emailEvents {
+		_, err := p.DB.ExecContext(ctx, `
+		INSERT INTO email_events (message_id, event_type, email, detail)
+		VALUES ($1, $2, lower($3), $4)`,
+			emailEvent.MessageID, emailEvent.EventType, emailEvent.Email, emailEvent.Detail)
+		if err != nil {
+			return fmt.Errorf("failed to record %s event for message %s: %w", emailEvent.EventType, emailEvent.MessageID, err)
+		}
+
+		if !emailEvent.Suppress {
+			continue
+		}
+
+		_, err = p.DB.ExecContext(ctx, `
+		INSERT INTO suppressed_recipients (email, reason)
+		VALUES (lower($1), $2)
+		ON CONFLICT (email) DO NOTHING`,
+			emailEvent.Email, emailEvent.EventType)
+		if err != nil {
+			return fmt.Errorf("failed to suppress recipient: %w", err)
+		}
+		logging.InfoContext(ctx, "suppressed future sends", logging.Fields{"event_type": emailEvent.EventType, "message_id": emailEvent.MessageID})
+	}
+
+	return nil
+}
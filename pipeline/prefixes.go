@@ -0,0 +1,25 @@
+package pipeline
+
+import (
+	"os"
+
+	"stori-challenge/summary"
+)
+
+// Environment variables setting the prefixes of the bucket, unset ones keep the default.
+const (
+	InputPrefixEnv      = "INPUT_PREFIX"
+	ProcessedPrefixEnv  = "PROCESSED_PREFIX"
+	QuarantinePrefixEnv = "QUARANTINE_PREFIX"
+	OutputPrefixEnv     = "OUTPUT_PREFIX"
+)
+
+// PrefixesFromEnv returns the prefixes of the bucket the lambda was deployed with.
+func PrefixesFromEnv() summary.Prefixes {
+	return summary.Prefixes{
+		Input:      os.Getenv(InputPrefixEnv),
+		Processed:  os.Getenv(ProcessedPrefixEnv),
+		Quarantine: os.Getenv(QuarantinePrefixEnv),
+		Output:     os.Getenv(OutputPrefixEnv),
+	}.WithDefaults()
+}
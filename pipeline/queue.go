@@ -0,0 +1,40 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/aws/aws-lambda-go/events"
+	"stori-challenge/logging"
+	"stori-challenge/summary"
+)
+
+// SQSEvent returns the SQS event of a lambda payload, ok is false for direct and state machine invocations.
+func SQSEvent(payload json.RawMessage) (sqsEvent events.SQSEvent, ok bool) {
+	if err := json.Unmarshal(payload, &sqsEvent); err != nil || len(sqsEvent.Records) == 0 {
+		return events.SQSEvent{}, false
+	}
+
+	return sqsEvent, sqsEvent.Records[0].EventSource == "aws:sqs"
+}
+
+// HandleSQSEvent runs the step on the summary message of every queued record, reporting the failed ones so only
+// those are retried and eventually moved to the dead-letter queue.
+func HandleSQSEvent(ctx context.Context, sqsEvent events.SQSEvent, step func(context.Context, *summary.Message) error) events.SQSEventResponse {
+	var response events.SQSEventResponse
+	for _, record := range sqsEvent.Records {
+		var message summary.Message
+		err := json.Unmarshal([]byte(record.Body), &message)
+		if err == nil {
+			err = step(ctx, &message)
+		}
+		if err != nil {
+			logging.ErrorContext(WithRun(ctx, &message), "failed to process message", logging.Fields{
+				"message_id": record.MessageId, "error": err,
+			})
+			response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: record.MessageId})
+		}
+	}
+
+	return response
+}
@@ -0,0 +1,44 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/require"
+	"stori-challenge/summary"
+)
+
+func TestSQSEvent(t *testing.T) {
+	_, ok := SQSEvent(json.RawMessage(`{"Records":[{"messageId":"m1","eventSource":"aws:sqs","body":"{}"}]}`))
+	require.True(t, ok)
+
+	// Direct invocations and other event sources are not batches
+	_, ok = SQSEvent(json.RawMessage(`{"RunID":"run-1"}`))
+	require.False(t, ok)
+	_, ok = SQSEvent(json.RawMessage(`{"Records":[{"eventSource":"aws:s3"}]}`))
+	require.False(t, ok)
+}
+
+func TestHandleSQSEventReportsFailedMessages(t *testing.T) {
+	var handled []string
+	response := HandleSQSEvent(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "m1", Body: `{"RunID":"run-1"}`},
+		{MessageId: "m2", Body: `{"RunID":"run-2"}`},
+		{MessageId: "m3", Body: `not json`},
+	}}, func(_ context.Context, message *summary.Message) error {
+		if message.RunID == "run-2" {
+			return errors.New("connection refused")
+		}
+		handled = append(handled, message.RunID)
+		return nil
+	})
+
+	require.Equal(t, []string{"run-1"}, handled)
+	require.Equal(t, events.SQSEventResponse{BatchItemFailures: []events.SQSBatchItemFailure{
+		{ItemIdentifier: "m2"},
+		{ItemIdentifier: "m3"},
+	}}, response)
+}
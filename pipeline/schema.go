@@ -0,0 +1,113 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+)
+
+// Initialize creates every table used by the pipeline, it is safe to run on an already initialized database.
+func (p *Postgres) Initialize(ctx context.Context) error {
+	db := p.DB
+	err := db.PingContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	createTableQuery := `CREATE TABLE IF NOT EXISTS summary_records (
+	id SERIAL PRIMARY KEY,
+	debit_total NUMERIC(15, 2),
+	credit_total NUMERIC(15, 2),
+	total_balance NUMERIC(15, 2),
+	transactions_by_month JSON,
+	avg_credits_by_month JSON,
+	avg_debits_by_month JSON,
+	created_at VARCHAR);`
+
+	_, err = db.ExecContext(ctx, createTableQuery)
+	if err != nil {
+		return fmt.Errorf("failed to create summary_records table: %w", err)
+	}
+
+	// Link summaries to the upload they come from, the unique run id makes storing a run idempotent
+	alterSummaryQuery := `
+	ALTER TABLE summary_records ADD COLUMN IF NOT EXISTS run_id VARCHAR UNIQUE;
+	ALTER TABLE summary_records ADD COLUMN IF NOT EXISTS source_key VARCHAR;`
+
+	_, err = db.ExecContext(ctx, alterSummaryQuery)
+	if err != nil {
+		return fmt.Errorf("failed to add run columns to summary_records table: %w", err)
+	}
+
+	createRecipientsQuery := `CREATE TABLE IF NOT EXISTS recipients (
+	id SERIAL PRIMARY KEY,
+	account VARCHAR NOT NULL,
+	email VARCHAR NOT NULL,
+	locale VARCHAR NOT NULL DEFAULT 'en-US',
+	format VARCHAR NOT NULL DEFAULT 'html' CHECK (format IN ('html', 'text')),
+	unsubscribed BOOLEAN NOT NULL DEFAULT FALSE,
+	unsubscribe_token VARCHAR NOT NULL UNIQUE DEFAULT gen_random_uuid()::text,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	UNIQUE (account, email));`
+
+	_, err = db.ExecContext(ctx, createRecipientsQuery)
+	if err != nil {
+		return fmt.Errorf("failed to create recipients table: %w", err)
+	}
+
+	createEmailEventsQuery := `CREATE TABLE IF NOT EXISTS email_events (
+	id SERIAL PRIMARY KEY,
+	message_id VARCHAR NOT NULL,
+	event_type VARCHAR NOT NULL,
+	email VARCHAR NOT NULL,
+	detail VARCHAR,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now());
+
+	CREATE TABLE IF NOT EXISTS suppressed_recipients (
+	email VARCHAR PRIMARY KEY,
+	reason VARCHAR NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now());`
+
+	_, err = db.ExecContext(ctx, createEmailEventsQuery)
+	if err != nil {
+		return fmt.Errorf("failed to create email_events and suppressed_recipients tables: %w", err)
+	}
+
+	createProcessingRunsQuery := `CREATE TABLE IF NOT EXISTS processing_runs (
+	run_id VARCHAR PRIMARY KEY,
+	bucket VARCHAR NOT NULL,
+	input_key VARCHAR NOT NULL,
+	etag VARCHAR NOT NULL DEFAULT '',
+	account VARCHAR NOT NULL,
+	status VARCHAR NOT NULL,
+	stage VARCHAR NOT NULL,
+	rows_parsed INTEGER,
+	rows_rejected INTEGER,
+	summary_record_id INTEGER REFERENCES summary_records (id),
+	output_key VARCHAR,
+	error TEXT,
+	rejection_report JSONB,
+	started_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	finished_at TIMESTAMPTZ);
+
+	CREATE INDEX IF NOT EXISTS processing_runs_started_at_idx ON processing_runs (started_at DESC);`
+
+	_, err = db.ExecContext(ctx, createProcessingRunsQuery)
+	if err != nil {
+		return fmt.Errorf("failed to create processing_runs table: %w", err)
+	}
+
+	// Who got the summary of a run, so a retried send skips them
+	createDeliveriesQuery := `CREATE TABLE IF NOT EXISTS summary_deliveries (
+	run_id VARCHAR NOT NULL,
+	email VARCHAR NOT NULL,
+	message_id VARCHAR,
+	sent_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (run_id, email));`
+
+	_, err = db.ExecContext(ctx, createDeliveriesQuery)
+	if err != nil {
+		return fmt.Errorf("failed to create summary_deliveries table: %w", err)
+	}
+
+	return nil
+}
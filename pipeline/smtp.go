@@ -0,0 +1,43 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"net/smtp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+)
+
+// SMTPSender sends the emails through a plain SMTP server instead of SES, e.g. MailHog when running against local
+// stand-ins. Configuration sets are SES only and ignored.
+type SMTPSender struct {
+	Addr string
+	// Auth is optional, local SMTP sinks accept unauthenticated mail.
+	Auth smtp.Auth
+}
+
+// SendRawEmail delivers the MIME message as it is to every destination address.
+func (s *SMTPSender) SendRawEmail(_ context.Context, params *ses.SendRawEmailInput, _ ...func(*ses.Options)) (*ses.SendRawEmailOutput, error) {
+	if len(params.Destinations) == 0 {
+		return nil, fmt.Errorf("email has no recipient")
+	}
+	if params.RawMessage == nil {
+		return nil, fmt.Errorf("email has no message")
+	}
+
+	header, _, _, err := readMessage(params.RawMessage.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = smtp.SendMail(s.Addr, s.Auth, aws.ToString(params.Source), params.Destinations, params.RawMessage.Data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send email through %s: %w", s.Addr, err)
+	}
+
+	messageID := strings.Trim(header.Get("Message-ID"), "<>")
+
+	return &ses.SendRawEmailOutput{MessageId: aws.String(messageID)}, nil
+}
@@ -0,0 +1,46 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"stori-challenge/metrics"
+	"stori-challenge/runs"
+	"stori-challenge/summary"
+	"stori-challenge/tracing"
+)
+
+// SummaryRepository persists the summaries.
+type SummaryRepository interface {
+	// StoreSummary inserts the summary of a run and returns the id of its summary_records row. Storing the same
+	// run twice returns the existing row.
+	StoreSummary(ctx context.Context, message *summary.Message) (int64, error)
+}
+
+// Storer is the store step, it persists the summary of a run.
+type Storer struct {
+	Summaries SummaryRepository
+	Tracker   runs.Tracker
+}
+
+// Store stores the summary data and returns the message with the record id set, so the next step can link the
+// email output to it.
+func (s *Storer) Store(ctx context.Context, message *summary.Message) (_ *summary.Message, err error) {
+	ctx, endStep := tracing.StartStep(ctx, "store", message.RunID, message.TraceHeader)
+	defer func() { endStep(err) }()
+	ctx = WithRun(ctx, message)
+	start := time.Now()
+	recordID, err := s.Summaries.StoreSummary(ctx, message)
+	if err != nil {
+		err = fmt.Errorf("failed to store summary data: %w", err)
+		s.Tracker.Failed(ctx, message.RunID, runs.StageStore, err, nil)
+		return nil, err
+	}
+
+	metrics.Emit(ctx, metrics.Duration(metrics.DBInsertLatency, time.Since(start)))
+	message.RecordID = recordID
+	s.Tracker.Stored(ctx, message.RunID, recordID)
+
+	return message, nil
+}
@@ -0,0 +1,27 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"stori-challenge/summary"
+)
+
+func TestStore(t *testing.T) {
+	summaries := &fakeSummaries{}
+	storer := &Storer{Summaries: summaries}
+
+	stored, err := storer.Store(context.Background(), &summary.Message{RunID: "run-1"})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), stored.RecordID)
+	require.Len(t, summaries.stored, 1)
+}
+
+func TestStoreFailure(t *testing.T) {
+	storer := &Storer{Summaries: &fakeSummaries{err: errors.New("connection refused")}}
+
+	_, err := storer.Store(context.Background(), &summary.Message{RunID: "run-1"})
+	require.ErrorContains(t, err, "failed to store summary data: connection refused")
+}
@@ -0,0 +1,42 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"stori-challenge/templates"
+)
+
+// UploadEmailTemplates pushes every embedded template to the bucket under its versioned key.
+func UploadEmailTemplates(ctx context.Context, s3Client ObjectPutter, bucket string) error {
+	emailTemplates, err := templates.All()
+	if err != nil {
+		return fmt.Errorf("failed to load embedded templates: %w", err)
+	}
+
+	// Reject the whole set before uploading anything if one of them would fail at send time
+	for _, emailTemplate := range emailTemplates {
+		if err = templates.Validate(emailTemplate.Body); err != nil {
+			return fmt.Errorf("template %s rejected: %w", emailTemplate.Key(), err)
+		}
+	}
+
+	for _, emailTemplate := range emailTemplates {
+		input := &s3.PutObjectInput{
+			Bucket:      aws.String(bucket),
+			Key:         aws.String(emailTemplate.Key()),
+			Body:        strings.NewReader(emailTemplate.Body),
+			ContentType: aws.String("text/html"),
+		}
+
+		_, err = s3Client.PutObject(ctx, input)
+		if err != nil {
+			return fmt.Errorf("failed to upload email template %s: %w", emailTemplate.Key(), err)
+		}
+	}
+
+	return nil
+}
@@ -2,189 +2,281 @@ package main
 
 import (
 	"context"
-	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"io"
-	"log"
+	"net/url"
 	"os"
-	"strings"
 
 	"github.com/aws/aws-lambda-go/events"
 	lmbda "github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/lambda"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"strconv"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snsTypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"stori-challenge/logging"
+	"stori-challenge/pipeline"
+	"stori-challenge/runs"
+	"stori-challenge/summary"
 )
 
-type SummaryData struct {
-	TotalBalance        float64
-	TransactionsByMonth map[string]int
-	AvgCreditsByMonth   map[string]float64
-	AvgDebitsByMonth    map[string]float64
-	DebitTotal          float64
-	CreditTotal         float64
+// lambdaInvoker is the part of the Lambda client used to chain the next steps.
+type lambdaInvoker interface {
+	Invoke(ctx context.Context, params *lambda.InvokeInput, optFns ...func(*lambda.Options)) (*lambda.InvokeOutput, error)
+}
+
+// snsPublisher is the part of the SNS client used to publish the summary to the topic of the store queue.
+type snsPublisher interface {
+	Publish(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error)
+}
+
+// runReader reads the processing runs for 'stori runs', which cannot reach the database from outside the VPC.
+type runReader interface {
+	Runs(ctx context.Context, query runs.Query) ([]runs.Run, error)
+}
+
+// errorPayload is the response payload of a lambda that returned an error or panicked.
+type errorPayload struct {
+	ErrorMessage string   `json:"errorMessage"`
+	ErrorType    string   `json:"errorType"`
+	StackTrace   []string `json:"stackTrace,omitempty"`
+}
+
+// FunctionError is returned when the invoked lambda ran but failed, as opposed to the invocation itself failing.
+type FunctionError struct {
+	FunctionName string
+	// Kind is the X-Amz-Function-Error value, 'Unhandled' for errors returned by the handler or panics.
+	Kind    string
+	Type    string
+	Message string
 }
 
-// readCsvFromS3 reads a CSV file from S3 and returns its contents as a string.
-func readCsvFromS3(bucket, key string) (string, error) {
-	cfg, err := config.LoadDefaultConfig(context.Background())
+func (e *FunctionError) Error() string {
+	if e.Type == "" {
+		return fmt.Sprintf("%s failed (%s): %s", e.FunctionName, e.Kind, e.Message)
+	}
+
+	return fmt.Sprintf("%s failed (%s %s): %s", e.FunctionName, e.Kind, e.Type, e.Message)
+}
+
+// Invokes lambdas for next steps, decoding the response payload into response. A function error reported by
+// the invoked lambda is returned as a *FunctionError carrying the remote error message.
+func invokeLambda(ctx context.Context, lambdaClient lambdaInvoker, message *summary.Message, lambdaName string, response interface{}) error {
+	data, err := json.Marshal(message)
 	if err != nil {
-		return "", fmt.Errorf("failed to load configuration: %w", err)
+		return fmt.Errorf("failed to marshal summary message: %v", err)
 	}
 
-	s3Client := s3.NewFromConfig(cfg)
-	input := &s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
+	input := &lambda.InvokeInput{
+		FunctionName: aws.String(lambdaName),
+		Payload:      data,
 	}
 
-	result, err := s3Client.GetObject(context.Background(), input)
+	output, err := lambdaClient.Invoke(ctx, input)
 	if err != nil {
-		return "", fmt.Errorf("failed to get object from S3: %w", err)
+		return fmt.Errorf("failed to invoke %s: %v", lambdaName, err)
 	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			return
+
+	if output.FunctionError != nil {
+		functionErr := &FunctionError{FunctionName: lambdaName, Kind: aws.ToString(output.FunctionError)}
+
+		var payload errorPayload
+		if err = json.Unmarshal(output.Payload, &payload); err == nil && payload.ErrorMessage != "" {
+			functionErr.Type = payload.ErrorType
+			functionErr.Message = payload.ErrorMessage
+		} else {
+			functionErr.Message = string(output.Payload)
 		}
-	}(result.Body)
 
-	buf := new(strings.Builder)
-	_, err = io.Copy(buf, result.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to read object body: %w", err)
+		return functionErr
+	}
+
+	if output.StatusCode < 200 || output.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code %d invoking %s", output.StatusCode, lambdaName)
+	}
+
+	if response == nil || len(output.Payload) == 0 {
+		return nil
+	}
+
+	if err = json.Unmarshal(output.Payload, response); err != nil {
+		return fmt.Errorf("failed to decode %s response: %w", lambdaName, err)
 	}
 
-	return buf.String(), nil
+	return nil
 }
 
-// processCsvData processes the CSV data and returns a SummaryData struct containing the total debit and credit amounts.
-func processCsvData(csvData string) (SummaryData, error) {
-	var debitTotal float64
-	var creditTotal float64
-	monthTransactions := make(map[string]int)
-	monthCredits := make(map[string]float64)
-	monthDebits := make(map[string]float64)
-
-	reader := csv.NewReader(strings.NewReader(csvData))
-	// Read and ignore the header line
-	if _, err := reader.Read(); err != nil {
-		return SummaryData{}, fmt.Errorf("failed to read header line: %w", err)
-	}
-
-	// Process each record in the CSV file
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return SummaryData{}, fmt.Errorf("failed to read record: %w", err)
-		}
+// Handler runs the parse step. It is either triggered by an S3 event, chaining the next steps itself, or invoked
+// as the parse task of the state machine.
+type Handler struct {
+	Parser  *pipeline.Parser
+	Lambda  lambdaInvoker
+	SNS     snsPublisher
+	Tracker runs.Tracker
+	Runs    runReader
 
-		// Check that the record has the required columns
-		if len(record) < 4 {
-			return SummaryData{}, fmt.Errorf("record has missing columns: %v", record)
-		}
+	// TopicArn selects the 'queue' orchestration, the summary is published instead of invoking the next steps.
+	TopicArn string
+	StoreArn string
+	SendArn  string
+}
 
-		// Get the transaction type (debit or credit)
-		typ := strings.ToLower(record[1])
-		if typ != "debit" && typ != "credit" {
-			return SummaryData{}, fmt.Errorf("invalid transaction type: %s", typ)
+// handleS3Event reads and processes the CSV files of an S3 event. With the 'invoke' orchestration it invokes two
+// separate Lambda functions with the resulting summary data, with the 'queue' orchestration it publishes the
+// summary to the topic the store queue is subscribed to.
+func (h *Handler) handleS3Event(ctx context.Context, s3Event events.S3Event) error {
+	for _, record := range s3Event.Records {
+		var err error
+		if h.TopicArn != "" {
+			err = h.publishRecord(ctx, record)
+		} else {
+			err = h.processRecord(ctx, record)
 		}
-
-		// Get the transaction amount
-		amount, err := strconv.ParseFloat(record[2], 64)
 		if err != nil {
-			return SummaryData{}, fmt.Errorf("failed to parse amount: %w", err)
+			return err
 		}
+	}
+	return nil
+}
 
-		month := record[3][:7] // Extract year-month from the date
-		monthTransactions[month]++
-		if typ == "credit" {
-			creditTotal += amount
-			monthCredits[month] += amount
-		} else if typ == "debit" {
-			debitTotal += amount
-			monthDebits[month] += amount
-		}
+// publishRecord processes one uploaded file and publishes the summary message to the topic. The file is only
+// archived once published, a failed publish leaves it under the input prefix for the event to be retried.
+func (h *Handler) publishRecord(ctx context.Context, record events.S3EventRecord) error {
+	s3Entity := record.S3
 
+	message, err := h.Parser.Parse(ctx, s3Entity.Bucket.Name, s3Entity.Object.URLDecodedKey, s3Entity.Object.ETag,
+		s3Entity.Object.Sequencer, record.EventTime)
+	if err != nil {
+		return err
 	}
 
-	return SummaryData{
-		DebitTotal:          debitTotal,
-		CreditTotal:         creditTotal,
-		TotalBalance:        creditTotal + debitTotal,
-		TransactionsByMonth: monthTransactions,
-		AvgCreditsByMonth:   monthCredits,
-		AvgDebitsByMonth:    monthDebits,
-	}, nil
-}
+	data, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal summary message: %v", err)
+	}
 
-// Invokes lambdas for next steps
-func invokeLambda(ctx context.Context, summaryData *SummaryData, lambdaName string) error {
-	cfg, err := config.LoadDefaultConfig(context.Background())
+	output, err := h.SNS.Publish(ctx, &sns.PublishInput{
+		TopicArn: aws.String(h.TopicArn),
+		Message:  aws.String(string(data)),
+		MessageAttributes: map[string]snsTypes.MessageAttributeValue{
+			"account": {DataType: aws.String("String"), StringValue: aws.String(message.Account)},
+			"run-id":  {DataType: aws.String("String"), StringValue: aws.String(message.RunID)},
+		},
+	})
 	if err != nil {
-		log.Fatalf("Failed to load SDK configuration: %v", err)
+		err = fmt.Errorf("failed to publish summary message: %w", err)
+		h.Tracker.Failed(ctx, message.RunID, runs.StageParse, err, nil)
+		return err
 	}
+	h.Parser.Archive(ctx, &message)
 
-	lambdaClient := lambda.NewFromConfig(cfg)
+	logging.InfoContext(pipeline.WithRun(ctx, &message), "run published", logging.Fields{"message_id": aws.ToString(output.MessageId)})
 
-	data, err := json.Marshal(summaryData)
+	return nil
+}
+
+// processRecord processes one uploaded file and chains the store and send lambdas.
+func (h *Handler) processRecord(ctx context.Context, record events.S3EventRecord) error {
+	s3Entity := record.S3
+
+	message, err := h.Parser.Parse(ctx, s3Entity.Bucket.Name, s3Entity.Object.URLDecodedKey, s3Entity.Object.ETag,
+		s3Entity.Object.Sequencer, record.EventTime)
 	if err != nil {
-		return fmt.Errorf("failed to marshal summary data: %v", err)
+		return err
 	}
 
-	input := &lambda.InvokeInput{
-		FunctionName: aws.String(lambdaName),
-		Payload:      data,
+	// Store records, the store lambda returns the message with the summary record id set
+	var stored summary.Message
+	if err = invokeLambda(ctx, h.Lambda, &message, h.StoreArn, &stored); err != nil {
+		err = fmt.Errorf("failed to store summary: %w", err)
+		h.Tracker.Failed(ctx, message.RunID, runs.StageStore, err, nil)
+		return err
 	}
+	message.RecordID = stored.RecordID
 
-	_, err = lambdaClient.Invoke(context.TODO(), input)
-	if err != nil {
-		return fmt.Errorf("failed to invoke %s: %v", lambdaName, err)
+	// Send email
+	var notified summary.NotifyResult
+	if err = invokeLambda(ctx, h.Lambda, &message, h.SendArn, &notified); err != nil {
+		err = fmt.Errorf("failed to send summary: %w", err)
+		h.Tracker.Failed(ctx, message.RunID, runs.StageNotify, err, nil)
+		return err
 	}
+	h.Parser.Archive(ctx, &message)
+
+	logging.InfoContext(pipeline.WithRun(ctx, &message), "run stored and notified", logging.Fields{
+		"record_id": message.RecordID, "output_key": notified.OutputKey,
+	})
 
 	return nil
 }
 
-// This function is the main entry point for the Lambda function. It takes in an S3 event, reads and processes
-// the corresponding CSV file, and invokes two separate Lambda functions with the resulting summary data.
-func handler(ctx context.Context, s3Event events.S3Event) error {
+// handleParseRequest is the parse step of the state machine, its output is the input of the store step. The input
+// file stays under the input prefix until the archive step.
+func (h *Handler) handleParseRequest(ctx context.Context, request summary.ParseRequest) (summary.Message, error) {
+	// Keys in S3 events are URL encoded
+	key, err := url.QueryUnescape(request.Key)
+	if err != nil {
+		return summary.Message{}, fmt.Errorf("invalid object key %q: %w", request.Key, err)
+	}
 
-	for _, record := range s3Event.Records {
-		s3Entity := record.S3
-		bucket := s3Entity.Bucket.Name
-		key := s3Entity.Object.Key
+	return h.Parser.Parse(ctx, request.Bucket, key, request.ETag, request.Sequencer, request.ReceivedAt)
+}
 
-		csvData, err := readCsvFromS3(bucket, key)
-		if err != nil {
-			return fmt.Errorf("failed to read CSV from S3: %w", err)
-		}
+// handleArchiveRequest is the archive step of the state machine, run once the summary was notified, or once
+// storing or notifying it failed to quarantine the input file.
+func (h *Handler) handleArchiveRequest(ctx context.Context, request summary.ArchiveRequest) (summary.Message, error) {
+	message := request.Message
+	switch request.Outcome {
+	case summary.OutcomeProcessed:
+		h.Parser.Archive(ctx, &message)
+	case summary.OutcomeQuarantined:
+		h.Parser.Quarantine(ctx, &message, errors.New(request.Reason))
+	default:
+		return summary.Message{}, fmt.Errorf("unknown archive outcome %q", request.Outcome)
+	}
 
-		summary, err := processCsvData(csvData)
-		if err != nil {
-			return fmt.Errorf("failed to process CSV data: %w", err)
-		}
+	return message, nil
+}
 
-		// Store records
-		err = invokeLambda(ctx, &summary, os.Getenv("STORE_ARN"))
-		if err != nil {
-			return err
-		}
+// Handle is the main entry point for the Lambda function. It is either triggered by an S3 event, invoked as the
+// parse or archive tasks of the state machine, or invoked by 'stori runs' to read the processing runs.
+func (h *Handler) Handle(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	var s3Event events.S3Event
+	if err := json.Unmarshal(payload, &s3Event); err == nil && len(s3Event.Records) > 0 {
+		return nil, h.handleS3Event(ctx, s3Event)
+	}
 
-		// Send email
-		err = invokeLambda(ctx, &summary, os.Getenv("SEND_ARN"))
-		if err != nil {
-			return err
-		}
+	var queryRequest runs.QueryRequest
+	if err := json.Unmarshal(payload, &queryRequest); err == nil && queryRequest.RunsQuery != nil {
+		return h.Runs.Runs(ctx, *queryRequest.RunsQuery)
 	}
-	return nil
+
+	var archiveRequest summary.ArchiveRequest
+	if err := json.Unmarshal(payload, &archiveRequest); err == nil && archiveRequest.Outcome != "" {
+		return h.handleArchiveRequest(ctx, archiveRequest)
+	}
+
+	var request summary.ParseRequest
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return nil, fmt.Errorf("failed to decode parse request: %w", err)
+	}
+
+	return h.handleParseRequest(ctx, request)
 }
 
 func main() {
-	lmbda.Start(handler)
+	cfg, db := pipeline.Bootstrap(context.Background())
+	tracker := runs.Tracker{DB: db}
+	handler := &Handler{
+		Parser:   &pipeline.Parser{S3: pipeline.NewS3Client(cfg), Tracker: tracker, Prefixes: pipeline.PrefixesFromEnv()},
+		Lambda:   lambda.NewFromConfig(cfg),
+		SNS:      sns.NewFromConfig(cfg),
+		Tracker:  tracker,
+		Runs:     runs.Reader{DB: db},
+		TopicArn: os.Getenv("SUMMARY_TOPIC_ARN"),
+		StoreArn: os.Getenv("STORE_ARN"),
+		SendArn:  os.Getenv("SEND_ARN"),
+	}
+
+	lmbda.Start(handler.Handle)
 }
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/stretchr/testify/require"
+	"stori-challenge/pipeline"
+	"stori-challenge/runs"
+	"stori-challenge/summary"
+)
+
+// fakeLambdaClient records the invocations and answers with a canned output, or the output of the invoked
+// function when outputs is set.
+type fakeLambdaClient struct {
+	inputs  []*lambda.InvokeInput
+	output  *lambda.InvokeOutput
+	outputs map[string]*lambda.InvokeOutput
+	err     error
+}
+
+func (f *fakeLambdaClient) Invoke(_ context.Context, params *lambda.InvokeInput, _ ...func(*lambda.Options)) (*lambda.InvokeOutput, error) {
+	f.inputs = append(f.inputs, params)
+	if output, ok := f.outputs[aws.ToString(params.FunctionName)]; ok {
+		return output, f.err
+	}
+
+	return f.output, f.err
+}
+
+func TestInvokeLambdaDecodesResponse(t *testing.T) {
+	client := &fakeLambdaClient{output: &lambda.InvokeOutput{
+		StatusCode: 200,
+		Payload:    []byte(`{"RunID":"run-1","RecordID":42}`),
+	}}
+	message := &summary.Message{RunID: "run-1"}
+
+	var stored summary.Message
+	err := invokeLambda(context.Background(), client, message, "store", &stored)
+	require.NoError(t, err)
+	require.Equal(t, int64(42), stored.RecordID)
+
+	require.Len(t, client.inputs, 1)
+	require.Equal(t, "store", aws.ToString(client.inputs[0].FunctionName))
+
+	var sent summary.Message
+	require.NoError(t, json.Unmarshal(client.inputs[0].Payload, &sent))
+	require.Equal(t, "run-1", sent.RunID)
+}
+
+func TestInvokeLambdaSurfacesFunctionError(t *testing.T) {
+	client := &fakeLambdaClient{output: &lambda.InvokeOutput{
+		StatusCode:    200,
+		FunctionError: aws.String("Unhandled"),
+		Payload:       []byte(`{"errorMessage":"failed to store summary data: connection refused","errorType":"wrapError"}`),
+	}}
+
+	var stored summary.Message
+	err := invokeLambda(context.Background(), client, &summary.Message{}, "store", &stored)
+	require.Error(t, err)
+
+	var functionErr *FunctionError
+	require.True(t, errors.As(err, &functionErr), "expected a FunctionError, got %T", err)
+	require.Equal(t, "store", functionErr.FunctionName)
+	require.Equal(t, "Unhandled", functionErr.Kind)
+	require.Equal(t, "wrapError", functionErr.Type)
+	require.Equal(t, "failed to store summary data: connection refused", functionErr.Message)
+	require.Contains(t, err.Error(), "connection refused")
+	require.Zero(t, stored.RecordID, "a failed invocation must not be decoded as a response")
+}
+
+func TestInvokeLambdaFunctionErrorWithoutEnvelope(t *testing.T) {
+	client := &fakeLambdaClient{output: &lambda.InvokeOutput{
+		StatusCode:    200,
+		FunctionError: aws.String("Unhandled"),
+		Payload:       []byte(`Runtime exited with error: signal: killed`),
+	}}
+
+	err := invokeLambda(context.Background(), client, &summary.Message{}, "send", nil)
+
+	var functionErr *FunctionError
+	require.True(t, errors.As(err, &functionErr))
+	require.Equal(t, "Runtime exited with error: signal: killed", functionErr.Message)
+}
+
+func TestInvokeLambdaTransportError(t *testing.T) {
+	client := &fakeLambdaClient{err: errors.New("throttled")}
+
+	err := invokeLambda(context.Background(), client, &summary.Message{}, "send", nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "throttled")
+
+	var functionErr *FunctionError
+	require.False(t, errors.As(err, &functionErr))
+}
+
+func TestInvokeLambdaInvalidResponse(t *testing.T) {
+	client := &fakeLambdaClient{output: &lambda.InvokeOutput{StatusCode: 200, Payload: []byte(`not json`)}}
+
+	var stored summary.Message
+	err := invokeLambda(context.Background(), client, &summary.Message{}, "store", &stored)
+	require.Error(t, err)
+}
+
+// fakeS3 serves the uploaded files and records the ones moved out of the input prefix.
+type fakeS3 struct {
+	objects map[string]string
+	copies  []*s3.CopyObjectInput
+}
+
+func (f *fakeS3) GetObject(_ context.Context, params *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	body, ok := f.objects[aws.ToString(params.Key)]
+	if !ok {
+		return nil, errors.New("NoSuchKey")
+	}
+
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(body))}, nil
+}
+
+func (f *fakeS3) HeadObject(_ context.Context, params *s3.HeadObjectInput, _ ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	if _, ok := f.objects[aws.ToString(params.Key)]; !ok {
+		return nil, errors.New("NotFound")
+	}
+
+	return &s3.HeadObjectOutput{ContentType: aws.String("text/csv")}, nil
+}
+
+func (f *fakeS3) CopyObject(_ context.Context, params *s3.CopyObjectInput, _ ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	f.copies = append(f.copies, params)
+
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (f *fakeS3) DeleteObject(_ context.Context, params *s3.DeleteObjectInput, _ ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	delete(f.objects, aws.ToString(params.Key))
+
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// fakeSNSClient records the published messages.
+type fakeSNSClient struct {
+	inputs []*sns.PublishInput
+	err    error
+}
+
+func (f *fakeSNSClient) Publish(_ context.Context, params *sns.PublishInput, _ ...func(*sns.Options)) (*sns.PublishOutput, error) {
+	f.inputs = append(f.inputs, params)
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	return &sns.PublishOutput{MessageId: aws.String("message-1")}, nil
+}
+
+const sampleCSV = "Id,Type,Amount,Date\n0,credit,60.5,2023-07-15\n1,debit,-10.3,2023-07-28\n"
+
+func s3Event(key string) json.RawMessage {
+	event := events.S3Event{Records: []events.S3EventRecord{{
+		EventTime: time.Date(2023, 8, 3, 10, 0, 0, 0, time.UTC),
+		S3: events.S3Entity{
+			Bucket: events.S3Bucket{Name: "bucket"},
+			Object: events.S3Object{Key: key, URLDecodedKey: key, ETag: "etag", Sequencer: "seq"},
+		},
+	}}}
+	payload, _ := json.Marshal(event)
+
+	return payload
+}
+
+func newHandler(objects map[string]string) (*Handler, *fakeS3, *fakeLambdaClient, *fakeSNSClient) {
+	bucket := &fakeS3{objects: objects}
+	lambdaClient := &fakeLambdaClient{outputs: map[string]*lambda.InvokeOutput{
+		"store": {StatusCode: 200, Payload: []byte(`{"RecordID":42}`)},
+		"send":  {StatusCode: 200, Payload: []byte(`{"OutputKey":"output/default/2023-08/july.html","Recipients":1}`)},
+	}}
+	snsClient := &fakeSNSClient{}
+
+	return &Handler{
+		Parser:   &pipeline.Parser{S3: bucket},
+		Lambda:   lambdaClient,
+		SNS:      snsClient,
+		StoreArn: "store",
+		SendArn:  "send",
+	}, bucket, lambdaClient, snsClient
+}
+
+func TestHandleS3EventInvokesStoreThenSend(t *testing.T) {
+	handler, bucket, lambdaClient, snsClient := newHandler(map[string]string{"input/july.csv": sampleCSV})
+
+	_, err := handler.Handle(context.Background(), s3Event("input/july.csv"))
+	require.NoError(t, err)
+	require.Empty(t, snsClient.inputs)
+
+	require.Len(t, lambdaClient.inputs, 2)
+	require.Equal(t, "store", aws.ToString(lambdaClient.inputs[0].FunctionName))
+	require.Equal(t, "send", aws.ToString(lambdaClient.inputs[1].FunctionName))
+
+	var sent summary.Message
+	require.NoError(t, json.Unmarshal(lambdaClient.inputs[1].Payload, &sent))
+	require.Equal(t, int64(42), sent.RecordID, "the send step gets the record id returned by the store step")
+
+	require.Len(t, bucket.copies, 1)
+	require.Equal(t, "processed/july.csv", aws.ToString(bucket.copies[0].Key))
+}
+
+func TestHandleS3EventKeepsFileWhenStoreFails(t *testing.T) {
+	handler, bucket, lambdaClient, _ := newHandler(map[string]string{"input/july.csv": sampleCSV})
+	lambdaClient.outputs["store"] = &lambda.InvokeOutput{
+		StatusCode:    200,
+		FunctionError: aws.String("Unhandled"),
+		Payload:       []byte(`{"errorMessage":"connection refused","errorType":"wrapError"}`),
+	}
+
+	_, err := handler.Handle(context.Background(), s3Event("input/july.csv"))
+	require.ErrorContains(t, err, "connection refused")
+	require.Len(t, lambdaClient.inputs, 1, "send must not run after a failed store")
+	require.Empty(t, bucket.copies, "the file stays under input/ so the event can be retried")
+}
+
+func TestHandleS3EventQuarantinesMalformedFile(t *testing.T) {
+	handler, bucket, lambdaClient, _ := newHandler(map[string]string{"input/july.csv": "Id,Type,Amount,Date\n0,credit,abc,2023-07-15\n"})
+
+	_, err := handler.Handle(context.Background(), s3Event("input/july.csv"))
+	require.ErrorContains(t, err, "failed to process CSV data")
+	require.Empty(t, lambdaClient.inputs)
+
+	require.Len(t, bucket.copies, 1)
+	require.Equal(t, "quarantine/july.csv", aws.ToString(bucket.copies[0].Key))
+}
+
+func TestHandleS3EventPublishesWithQueueOrchestration(t *testing.T) {
+	handler, bucket, lambdaClient, snsClient := newHandler(map[string]string{"input/acme/july.csv": sampleCSV})
+	handler.TopicArn = "arn:aws:sns:us-east-1:123456789012:summaries"
+
+	_, err := handler.Handle(context.Background(), s3Event("input/acme/july.csv"))
+	require.NoError(t, err)
+	require.Empty(t, lambdaClient.inputs)
+
+	require.Len(t, snsClient.inputs, 1)
+	published := snsClient.inputs[0]
+	require.Equal(t, handler.TopicArn, aws.ToString(published.TopicArn))
+	require.Equal(t, "acme", aws.ToString(published.MessageAttributes["account"].StringValue))
+
+	var message summary.Message
+	require.NoError(t, json.Unmarshal([]byte(aws.ToString(published.Message)), &message))
+	require.Empty(t, message.ArchivedKey, "the file is archived once published")
+	require.InDelta(t, 60.5, message.Summary.CreditTotal, 0.001)
+
+	require.Len(t, bucket.copies, 1)
+	require.Equal(t, "processed/acme/july.csv", aws.ToString(bucket.copies[0].Key))
+}
+
+func TestHandleS3EventKeepsFileWhenPublishFails(t *testing.T) {
+	handler, bucket, _, snsClient := newHandler(map[string]string{"input/acme/july.csv": sampleCSV})
+	handler.TopicArn = "arn:aws:sns:us-east-1:123456789012:summaries"
+	snsClient.err = errors.New("AuthorizationError")
+
+	_, err := handler.Handle(context.Background(), s3Event("input/acme/july.csv"))
+	require.ErrorContains(t, err, "failed to publish summary message")
+	require.Empty(t, bucket.copies, "the file stays under input/ so the event can be retried")
+	require.Contains(t, bucket.objects, "input/acme/july.csv")
+}
+
+func TestHandleParseRequest(t *testing.T) {
+	handler, bucket, lambdaClient, _ := newHandler(map[string]string{"input/acme/july 2023.csv": sampleCSV})
+
+	payload, err := json.Marshal(summary.ParseRequest{Bucket: "bucket", Key: "input/acme/july+2023.csv", ETag: "etag", Sequencer: "seq"})
+	require.NoError(t, err)
+
+	response, err := handler.Handle(context.Background(), payload)
+	require.NoError(t, err)
+	require.Empty(t, lambdaClient.inputs, "the state machine chains the next steps")
+
+	message, ok := response.(summary.Message)
+	require.True(t, ok, "expected a summary.Message, got %T", response)
+	require.Equal(t, "input/acme/july 2023.csv", message.SourceKey)
+	require.Empty(t, message.ArchivedKey)
+	require.Empty(t, bucket.copies, "the file is archived by the last step once notified")
+	require.Contains(t, bucket.objects, "input/acme/july 2023.csv")
+}
+
+func TestHandleArchiveRequest(t *testing.T) {
+	tests := []struct {
+		outcome     string
+		archivedKey string
+	}{
+		{outcome: summary.OutcomeProcessed, archivedKey: "processed/acme/july.csv"},
+		{outcome: summary.OutcomeQuarantined, archivedKey: "quarantine/acme/july.csv"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.outcome, func(t *testing.T) {
+			handler, bucket, _, _ := newHandler(map[string]string{"input/acme/july.csv": sampleCSV})
+
+			payload, err := json.Marshal(summary.ArchiveRequest{
+				Outcome: test.outcome,
+				Message: summary.Message{RunID: "run-1", SourceBucket: "bucket", SourceKey: "input/acme/july.csv"},
+				Reason:  "failed to store summary",
+			})
+			require.NoError(t, err)
+
+			response, err := handler.Handle(context.Background(), payload)
+			require.NoError(t, err)
+			require.Equal(t, test.archivedKey, response.(summary.Message).ArchivedKey)
+			require.NotContains(t, bucket.objects, "input/acme/july.csv")
+			require.Contains(t, aws.ToString(bucket.copies[0].Tagging), "outcome="+test.outcome)
+		})
+	}
+}
+
+func TestHandleArchiveRequestRejectsUnknownOutcome(t *testing.T) {
+	handler, bucket, _, _ := newHandler(map[string]string{"input/acme/july.csv": sampleCSV})
+
+	_, err := handler.Handle(context.Background(), json.RawMessage(`{"Outcome":"lost","Message":{"SourceKey":"input/acme/july.csv"}}`))
+	require.ErrorContains(t, err, `unknown archive outcome "lost"`)
+	require.Empty(t, bucket.copies)
+}
+
+// fakeRuns records the queries of 'stori runs'.
+type fakeRuns struct {
+	queries []runs.Query
+}
+
+func (f *fakeRuns) Runs(_ context.Context, query runs.Query) ([]runs.Run, error) {
+	f.queries = append(f.queries, query)
+	return []runs.Run{{RunID: "run-1", Status: runs.StatusFailed}}, nil
+}
+
+func TestHandleRunsQuery(t *testing.T) {
+	handler, bucket, _, _ := newHandler(map[string]string{"input/acme/july.csv": sampleCSV})
+	reader := &fakeRuns{}
+	handler.Runs = reader
+
+	payload, err := json.Marshal(runs.QueryRequest{RunsQuery: &runs.Query{Status: runs.StatusFailed, Limit: 5}})
+	require.NoError(t, err)
+
+	response, err := handler.Handle(context.Background(), payload)
+	require.NoError(t, err)
+	require.Equal(t, []runs.Run{{RunID: "run-1", Status: runs.StatusFailed}}, response)
+	require.Equal(t, []runs.Query{{Status: runs.StatusFailed, Limit: 5}}, reader.queries)
+	require.Empty(t, bucket.copies)
+}
@@ -0,0 +1,229 @@
+package runs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"stori-challenge/logging"
+	"stori-challenge/summary"
+)
+
+// Statuses a run goes through, every pipeline stage moves it forward or marks it as failed.
+const (
+	StatusParsing   = "parsing"
+	StatusParsed    = "parsed"
+	StatusStored    = "stored"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+)
+
+// Stages of the pipeline, recorded along with the error of a failed run.
+const (
+	StageParse  = "parse"
+	StageStore  = "store"
+	StageNotify = "notify"
+)
+
+// Run is a row of the processing_runs table.
+type Run struct {
+	RunID           string
+	Bucket          string
+	InputKey        string
+	ETag            string
+	Account         string
+	Status          string
+	Stage           string
+	RowsParsed      int
+	RowsRejected    int
+	SummaryRecordID *int64
+	OutputKey       string
+	Error           string
+	RejectionReport []summary.Rejection
+	StartedAt       time.Time
+	FinishedAt      *time.Time
+}
+
+// Tracker records the progress of runs in the processing_runs table. Tracking is best effort, failures are
+// logged and never fail the pipeline, and a nil DB or an empty run id turns every call into a no-op.
+type Tracker struct {
+	DB *sql.DB
+}
+
+// Close releases the database connection of the tracker, lambdas keep it open since it is the pool of the container.
+func (t Tracker) Close() {
+	if t.DB != nil {
+		t.DB.Close()
+	}
+}
+
+func (t Tracker) exec(ctx context.Context, runID, query string, args ...interface{}) {
+	if t.DB == nil || runID == "" {
+		return
+	}
+
+	if _, err := t.DB.ExecContext(ctx, query, append([]interface{}{runID}, args...)...); err != nil {
+		logging.ErrorContext(ctx, "failed to track run", logging.Fields{logging.RunIDKey: runID, "error": err})
+	}
+}
+
+// Started records a run entering the parse stage, starting a run again resets it.
+func (t Tracker) Started(ctx context.Context, run Run) {
+	t.exec(ctx, run.RunID, `
+	INSERT INTO processing_runs (run_id, bucket, input_key, etag, account, status, stage, started_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, now())
+	ON CONFLICT (run_id) DO UPDATE SET status = EXCLUDED.status, stage = EXCLUDED.stage, error = NULL,
+		rejection_report = NULL, started_at = now(), finished_at = NULL`,
+		run.Bucket, run.InputKey, run.ETag, run.Account, StatusParsing, StageParse)
+}
+
+// Parsed records the row counts of a successfully parsed file.
+func (t Tracker) Parsed(ctx context.Context, runID string, report summary.ParseReport) {
+	t.exec(ctx, runID, `
+	UPDATE processing_runs SET status = $2, rows_parsed = $3, rows_rejected = $4
+	WHERE run_id = $1 AND status = 'parsing'`,
+		StatusParsed, report.RowsParsed, len(report.Rejections))
+}
+
+// Stored records the summary_records row of a run. Storing a run again, e.g. when a redriven message is stored
+// after the run ended, keeps the status and stage it ended with.
+func (t Tracker) Stored(ctx context.Context, runID string, recordID int64) {
+	t.exec(ctx, runID, `
+	UPDATE processing_runs SET summary_record_id = $2,
+		stage = CASE WHEN status IN ('completed', 'failed') THEN stage ELSE $3 END,
+		status = CASE WHEN status IN ('completed', 'failed') THEN status ELSE $4 END
+	WHERE run_id = $1`,
+		recordID, StageStore, StatusStored)
+}
+
+// Completed records the generated email of a run and closes it.
+func (t Tracker) Completed(ctx context.Context, runID, outputKey string) {
+	t.exec(ctx, runID, `
+	UPDATE processing_runs SET output_key = $2, stage = $3,
+		status = CASE WHEN status = 'failed' THEN status ELSE $4 END, finished_at = now()
+	WHERE run_id = $1`,
+		outputKey, StageNotify, StatusCompleted)
+}
+
+// Failed records the error of a run and the rejection report when rows were rejected.
+func (t Tracker) Failed(ctx context.Context, runID, stage string, err error, report *summary.ParseReport) {
+	var rowsParsed, rowsRejected int
+	// Without rejections the parameter is SQL NULL, so the report of an earlier failure is kept; a JSON null
+	// would be a jsonb value and overwrite it
+	var rejectionReport sql.NullString
+	if report != nil {
+		rowsParsed, rowsRejected = report.RowsParsed, len(report.Rejections)
+		if encoded, encodeErr := json.Marshal(report.Rejections); encodeErr == nil && rowsRejected > 0 {
+			rejectionReport = sql.NullString{String: string(encoded), Valid: true}
+		}
+	}
+
+	t.exec(ctx, runID, `
+	UPDATE processing_runs SET status = $2, stage = $3, error = $4, finished_at = now(),
+		rows_parsed = COALESCE(NULLIF($5, 0), rows_parsed), rows_rejected = COALESCE(NULLIF($6, 0), rows_rejected),
+		rejection_report = COALESCE($7::jsonb, rejection_report)
+	WHERE run_id = $1`,
+		StatusFailed, stage, err.Error(), rowsParsed, rowsRejected, rejectionReport)
+}
+
+const selectRuns = `
+	SELECT run_id, bucket, input_key, etag, account, status, stage, COALESCE(rows_parsed, 0), COALESCE(rows_rejected, 0),
+		summary_record_id, COALESCE(output_key, ''), COALESCE(error, ''), COALESCE(rejection_report, 'null'),
+		started_at, finished_at
+	FROM processing_runs`
+
+func scanRun(row interface{ Scan(...interface{}) error }) (Run, error) {
+	var run Run
+	var recordID sql.NullInt64
+	var finishedAt sql.NullTime
+	var rejectionReport []byte
+
+	err := row.Scan(&run.RunID, &run.Bucket, &run.InputKey, &run.ETag, &run.Account, &run.Status, &run.Stage,
+		&run.RowsParsed, &run.RowsRejected, &recordID, &run.OutputKey, &run.Error, &rejectionReport,
+		&run.StartedAt, &finishedAt)
+	if err != nil {
+		return Run{}, err
+	}
+
+	if recordID.Valid {
+		run.SummaryRecordID = &recordID.Int64
+	}
+	if finishedAt.Valid {
+		run.FinishedAt = &finishedAt.Time
+	}
+	if err = json.Unmarshal(rejectionReport, &run.RejectionReport); err != nil {
+		return Run{}, fmt.Errorf("invalid rejection report of run %s: %w", run.RunID, err)
+	}
+
+	return run, nil
+}
+
+// List returns the most recent runs, optionally only the ones with the given status.
+func List(ctx context.Context, db *sql.DB, status string, limit int) ([]Run, error) {
+	rows, err := db.QueryContext(ctx, selectRuns+`
+	WHERE $1 = '' OR status = $1
+	ORDER BY started_at DESC
+	LIMIT $2`, status, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query runs: %w", err)
+	}
+	defer rows.Close()
+
+	var list []Run
+	for rows.Next() {
+		run, err := scanRun(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read run: %w", err)
+		}
+		list = append(list, run)
+	}
+
+	return list, rows.Err()
+}
+
+// Get returns a single run.
+func Get(ctx context.Context, db *sql.DB, runID string) (Run, error) {
+	run, err := scanRun(db.QueryRowContext(ctx, selectRuns+`
+	WHERE run_id = $1`, runID))
+	if err == sql.ErrNoRows {
+		return Run{}, fmt.Errorf("run %s not found", runID)
+	}
+	if err != nil {
+		return Run{}, fmt.Errorf("failed to query run %s: %w", runID, err)
+	}
+
+	return run, nil
+}
+
+// Query asks the process-csv-lambda for runs, the database is only reachable from inside the VPC so 'stori runs'
+// reads them through the lambda. A RunID returns that run, otherwise the latest Limit runs with Status are listed.
+type Query struct {
+	RunID  string
+	Status string
+	Limit  int
+}
+
+// QueryRequest is the lambda payload carrying a Query, the field tells it apart from the other payloads.
+type QueryRequest struct {
+	RunsQuery *Query
+}
+
+// Reader answers the queries from the processing_runs table.
+type Reader struct {
+	DB *sql.DB
+}
+
+// Runs returns the runs matching the query.
+func (r Reader) Runs(ctx context.Context, query Query) ([]Run, error) {
+	if query.RunID != "" {
+		run, err := Get(ctx, r.DB, query.RunID)
+		if err != nil {
+			return nil, err
+		}
+		return []Run{run}, nil
+	}
+
+	return List(ctx, r.DB, query.Status, query.Limit)
+}
@@ -0,0 +1,76 @@
+package runs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"stori-challenge/summary"
+)
+
+// fakeRow scans canned values, in the order of selectRuns.
+type fakeRow []interface{}
+
+func (f fakeRow) Scan(dest ...interface{}) error {
+	for i, value := range f {
+		switch d := dest[i].(type) {
+		case *string:
+			*d = value.(string)
+		case *int:
+			*d = value.(int)
+		case *[]byte:
+			*d = []byte(value.(string))
+		case *time.Time:
+			*d = value.(time.Time)
+		case *sql.NullInt64:
+			if value != nil {
+				*d = sql.NullInt64{Int64: value.(int64), Valid: true}
+			}
+		case *sql.NullTime:
+			if value != nil {
+				*d = sql.NullTime{Time: value.(time.Time), Valid: true}
+			}
+		}
+	}
+
+	return nil
+}
+
+func TestScanFailedRun(t *testing.T) {
+	started := time.Date(2023, 4, 12, 10, 0, 0, 0, time.UTC)
+	run, err := scanRun(fakeRow{"run-1", "bucket", "input/acme/march.csv", "etag", "acme", StatusFailed, StageParse, 3, 1,
+		nil, "", "failed to process CSV data: rejected line 3: invalid date: march", `[{"Line":3,"Reason":"invalid date: march"}]`,
+		started, started.Add(time.Second)})
+	require.NoError(t, err)
+
+	require.Equal(t, StatusFailed, run.Status)
+	require.Nil(t, run.SummaryRecordID)
+	require.NotNil(t, run.FinishedAt)
+	require.Equal(t, []summary.Rejection{{Line: 3, Reason: "invalid date: march"}}, run.RejectionReport)
+}
+
+func TestScanCompletedRun(t *testing.T) {
+	run, err := scanRun(fakeRow{"run-2", "bucket", "input/file.csv", "", "default", StatusCompleted, StageNotify, 4, 0,
+		int64(7), "output/default/2023-04/file.html", "", "null", time.Now(), nil})
+	require.NoError(t, err)
+
+	require.Equal(t, int64(7), *run.SummaryRecordID)
+	require.Nil(t, run.FinishedAt)
+	require.Empty(t, run.RejectionReport)
+}
+
+func TestTrackerWithoutDatabaseIsNoop(t *testing.T) {
+	tracker := Tracker{}
+	ctx := context.Background()
+
+	// None of these may panic or fail the caller
+	tracker.Started(ctx, Run{RunID: "run-1"})
+	tracker.Parsed(ctx, "run-1", summary.ParseReport{RowsParsed: 1})
+	tracker.Stored(ctx, "run-1", 1)
+	tracker.Failed(ctx, "run-1", StageNotify, errors.New("boom"), nil)
+	tracker.Completed(ctx, "run-1", "output/key.html")
+	tracker.Close()
+}
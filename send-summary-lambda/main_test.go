@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/require"
+	"stori-challenge/pipeline"
+	"stori-challenge/summary"
+	"stori-challenge/templates"
+)
+
+// fakeS3 serves the email template and records the generated emails.
+type fakeS3 struct {
+	template string
+	outputs  map[string]string
+	putErr   error
+}
+
+func (f *fakeS3) GetObject(_ context.Context, _ *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(f.template))}, nil
+}
+
+func (f *fakeS3) PutObject(_ context.Context, params *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if f.putErr != nil {
+		return nil, f.putErr
+	}
+
+	body, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.outputs[aws.ToString(params.Key)] = string(body)
+
+	return &s3.PutObjectOutput{}, nil
+}
+
+func newHandler(t *testing.T) (*Handler, *fakeS3) {
+	emailTemplate, err := templates.Get(templates.DefaultBrand, "")
+	require.NoError(t, err)
+
+	bucket := &fakeS3{template: emailTemplate.Body, outputs: map[string]string{}}
+
+	return &Handler{Notifier: &pipeline.Notifier{
+		S3:          bucket,
+		Bucket:      "bucket",
+		TemplateKey: emailTemplate.Key(),
+		Brand:       templates.DefaultBrand,
+	}}, bucket
+}
+
+func TestHandleDirectInvocation(t *testing.T) {
+	handler, bucket := newHandler(t)
+
+	message := summary.Message{RunID: "run-1", Account: "acme", SourceKey: "input/acme/july.csv", Summary: *templates.Fixture()}
+	payload, err := json.Marshal(message)
+	require.NoError(t, err)
+
+	response, err := handler.Handle(context.Background(), payload)
+	require.NoError(t, err)
+
+	result, ok := response.(summary.NotifyResult)
+	require.True(t, ok, "expected a summary.NotifyResult, got %T", response)
+	require.Contains(t, bucket.outputs, result.OutputKey)
+	require.True(t, strings.HasPrefix(result.OutputKey, "output/acme/"))
+}
+
+func TestHandleSQSEventReportsFailedMessages(t *testing.T) {
+	handler, bucket := newHandler(t)
+	bucket.putErr = errors.New("access denied")
+
+	payload, err := json.Marshal(events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "m1", EventSource: "aws:sqs", Body: `{"RunID":"run-1"}`},
+	}})
+	require.NoError(t, err)
+
+	response, err := handler.Handle(context.Background(), payload)
+	require.NoError(t, err)
+	require.Equal(t, events.SQSEventResponse{BatchItemFailures: []events.SQSBatchItemFailure{{ItemIdentifier: "m1"}}}, response)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"stori-challenge/pipeline"
+)
+
+// SesEvent is the notification published by the SES configuration set event destination.
+type SesEvent struct {
+	EventType        string `json:"eventType"`
+	NotificationType string `json:"notificationType"`
+	Mail             struct {
+		MessageID   string   `json:"messageId"`
+		Destination []string `json:"destination"`
+	} `json:"mail"`
+	Bounce *struct {
+		BounceType        string `json:"bounceType"`
+		BounceSubType     string `json:"bounceSubType"`
+		BouncedRecipients []struct {
+			EmailAddress   string `json:"emailAddress"`
+			DiagnosticCode string `json:"diagnosticCode"`
+		} `json:"bouncedRecipients"`
+	} `json:"bounce"`
+	Complaint *struct {
+		ComplaintFeedbackType string `json:"complaintFeedbackType"`
+		ComplainedRecipients  []struct {
+			EmailAddress string `json:"emailAddress"`
+		} `json:"complainedRecipients"`
+	} `json:"complaint"`
+	Delivery *struct {
+		Recipients []string `json:"recipients"`
+	} `json:"delivery"`
+}
+
+// toEmailEvents flattens an SES notification into one event per affected recipient. Hard bounces and
+// complaints are flagged so the address is added to the suppression list.
+func toEmailEvents(message string) ([]pipeline.EmailEvent, error) {
+	var sesEvent SesEvent
+	if err := json.Unmarshal([]byte(message), &sesEvent); err != nil {
+		return nil, fmt.Errorf("failed to decode SES event: %w", err)
+	}
+
+	// Configuration set events use eventType, identity notifications use notificationType
+	eventType := sesEvent.EventType
+	if eventType == "" {
+		eventType = sesEvent.NotificationType
+	}
+
+	var emailEvents []pipeline.EmailEvent
+	switch strings.ToLower(eventType) {
+	case "bounce":
+		if sesEvent.Bounce == nil {
+			return nil, fmt.Errorf("bounce event %s has no bounce details", sesEvent.Mail.MessageID)
+		}
+		hardBounce := sesEvent.Bounce.BounceType == "Permanent"
+		for _, recipient := range sesEvent.Bounce.BouncedRecipients {
+			emailEvents = append(emailEvents, pipeline.EmailEvent{
+				MessageID: sesEvent.Mail.MessageID,
+				EventType: "bounce",
+				Email:     recipient.EmailAddress,
+				Detail:    strings.TrimSpace(fmt.Sprintf("%s/%s %s", sesEvent.Bounce.BounceType, sesEvent.Bounce.BounceSubType, recipient.DiagnosticCode)),
+				Suppress:  hardBounce,
+			})
+		}
+	case "complaint":
+		if sesEvent.Complaint == nil {
+			return nil, fmt.Errorf("complaint event %s has no complaint details", sesEvent.Mail.MessageID)
+		}
+		for _, recipient := range sesEvent.Complaint.ComplainedRecipients {
+			emailEvents = append(emailEvents, pipeline.EmailEvent{
+				MessageID: sesEvent.Mail.MessageID,
+				EventType: "complaint",
+				Email:     recipient.EmailAddress,
+				Detail:    sesEvent.Complaint.ComplaintFeedbackType,
+				Suppress:  true,
+			})
+		}
+	case "delivery":
+		recipients := sesEvent.Mail.Destination
+		if sesEvent.Delivery != nil && len(sesEvent.Delivery.Recipients) > 0 {
+			recipients = sesEvent.Delivery.Recipients
+		}
+		for _, recipient := range recipients {
+			emailEvents = append(emailEvents, pipeline.EmailEvent{
+				MessageID: sesEvent.Mail.MessageID,
+				EventType: "delivery",
+				Email:     recipient,
+			})
+		}
+	default:
+		for _, recipient := range sesEvent.Mail.Destination {
+			emailEvents = append(emailEvents, pipeline.EmailEvent{
+				MessageID: sesEvent.Mail.MessageID,
+				EventType: strings.ToLower(eventType),
+				Email:     recipient,
+			})
+		}
+	}
+
+	return emailEvents, nil
+}
+
+// eventRecorder persists the email events.
+type eventRecorder interface {
+	// RecordEmailEvents stores the events and suppresses the addresses flagged by them.
+	RecordEmailEvents(ctx context.Context, emailEvents []pipeline.EmailEvent) error
+}
+
+// Handler consumes the SES delivery events published to SNS.
+type Handler struct {
+	Events eventRecorder
+}
+
+// Handle records the events of every SNS notification of the batch.
+func (h *Handler) Handle(ctx context.Context, snsEvent events.SNSEvent) error {
+	var emailEvents []pipeline.EmailEvent
+	for _, record := range snsEvent.Records {
+		recordEvents, err := toEmailEvents(record.SNS.Message)
+		if err != nil {
+			return err
+		}
+		emailEvents = append(emailEvents, recordEvents...)
+	}
+
+	if len(emailEvents) == 0 {
+		return nil
+	}
+
+	if err := h.Events.RecordEmailEvents(ctx, emailEvents); err != nil {
+		return fmt.Errorf("failed to record email events: %w", err)
+	}
+
+	return nil
+}
+
+func main() {
+	_, db := pipeline.Bootstrap(context.Background())
+
+	handler := &Handler{Events: &pipeline.Postgres{DB: db}}
+
+	lambda.Start(handler.Handle)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/require"
+	"stori-challenge/pipeline"
+)
+
+const bounceEvent = `{
+  "eventType": "Bounce",
+  "mail": {"messageId": "message-1", "destination": ["gone@example.com", "full@example.com"]},
+  "bounce": {
+    "bounceType": "Permanent",
+    "bounceSubType": "General",
+    "bouncedRecipients": [{"emailAddress": "gone@example.com", "diagnosticCode": "smtp; 550 5.1.1 user unknown"}]
+  }
+}`
+
+const softBounceEvent = `{
+  "eventType": "Bounce",
+  "mail": {"messageId": "message-2"},
+  "bounce": {"bounceType": "Transient", "bounceSubType": "MailboxFull", "bouncedRecipients": [{"emailAddress": "full@example.com"}]}
+}`
+
+const complaintEvent = `{
+  "notificationType": "Complaint",
+  "mail": {"messageId": "message-3"},
+  "complaint": {"complaintFeedbackType": "abuse", "complainedRecipients": [{"emailAddress": "angry@example.com"}]}
+}`
+
+const deliveryEvent = `{
+  "eventType": "Delivery",
+  "mail": {"messageId": "message-4", "destination": ["happy@example.com"]},
+  "delivery": {"recipients": ["happy@example.com"]}
+}`
+
+// fakeEvents records the events it is given.
+type fakeEvents struct {
+	recorded []pipeline.EmailEvent
+	err      error
+}
+
+func (f *fakeEvents) RecordEmailEvents(_ context.Context, emailEvents []pipeline.EmailEvent) error {
+	f.recorded = append(f.recorded, emailEvents...)
+
+	return f.err
+}
+
+func TestToEmailEvents(t *testing.T) {
+	emailEvents, err := toEmailEvents(bounceEvent)
+	require.NoError(t, err)
+	require.Equal(t, []pipeline.EmailEvent{{
+		MessageID: "message-1",
+		EventType: "bounce",
+		Email:     "gone@example.com",
+		Detail:    "Permanent/General smtp; 550 5.1.1 user unknown",
+		Suppress:  true,
+	}}, emailEvents)
+
+	emailEvents, err = toEmailEvents(softBounceEvent)
+	require.NoError(t, err)
+	require.Len(t, emailEvents, 1)
+	require.False(t, emailEvents[0].Suppress, "soft bounces must not suppress the recipient")
+
+	emailEvents, err = toEmailEvents(complaintEvent)
+	require.NoError(t, err)
+	require.Equal(t, []pipeline.EmailEvent{{MessageID: "message-3", EventType: "complaint", Email: "angry@example.com", Detail: "abuse", Suppress: true}}, emailEvents)
+
+	emailEvents, err = toEmailEvents(deliveryEvent)
+	require.NoError(t, err)
+	require.Equal(t, []pipeline.EmailEvent{{MessageID: "message-4", EventType: "delivery", Email: "happy@example.com"}}, emailEvents)
+}
+
+func TestToEmailEventsRejectsInvalidEvents(t *testing.T) {
+	_, err := toEmailEvents(`not json`)
+	require.Error(t, err)
+
+	_, err = toEmailEvents(`{"eventType": "Bounce", "mail": {"messageId": "message-1"}}`)
+	require.ErrorContains(t, err, "no bounce details")
+}
+
+func snsEvent(messages ...string) events.SNSEvent {
+	var snsEvent events.SNSEvent
+	for _, message := range messages {
+		snsEvent.Records = append(snsEvent.Records, events.SNSEventRecord{SNS: events.SNSEntity{Message: message}})
+	}
+
+	return snsEvent
+}
+
+func TestHandle(t *testing.T) {
+	recorder := &fakeEvents{}
+	handler := &Handler{Events: recorder}
+
+	require.NoError(t, handler.Handle(context.Background(), snsEvent(bounceEvent, deliveryEvent)))
+	require.Len(t, recorder.recorded, 2)
+}
+
+func TestHandleFailures(t *testing.T) {
+	recorder := &fakeEvents{}
+	handler := &Handler{Events: recorder}
+	require.Error(t, handler.Handle(context.Background(), snsEvent(deliveryEvent, `not json`)))
+	require.Empty(t, recorder.recorded, "nothing is recorded when a notification of the batch is invalid")
+
+	handler = &Handler{Events: &fakeEvents{err: errors.New("connection refused")}}
+	require.ErrorContains(t, handler.Handle(context.Background(), snsEvent(complaintEvent)), "connection refused")
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/pipelines"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+	"stori-challenge/config"
+)
+
+// lambdaDirs are the folders of the lambdas, each built to a 'main' binary before synthesis.
+var lambdaDirs = []string{
+	"init-lambda", "process-csv-lambda", "store-summary-lambda", "send-summary-lambda", "unsubscribe-lambda",
+	"ses-events-lambda",
+}
+
+// NewEnvironmentStage creates the stage of a deployment environment holding the stack. The context values of the
+// environment are set on the stage so they override the top level ones for the stack.
+func NewEnvironmentStage(scope constructs.Construct, environment config.Environment) awscdk.Stage {
+	stage := awscdk.NewStage(scope, jsii.String(environment.Name), &awscdk.StageProps{
+		Env: environmentEnv(environment.Account, environment.Region),
+	})
+	for key, value := range environment.Context {
+		stage.Node().SetContext(jsii.String(key), value)
+	}
+
+	NewStoriChallengeStack(stage, stackName(stage), nil)
+
+	return stage
+}
+
+// NewDeploymentPipelineStack creates the CDK pipeline that builds the lambdas, synthesizes the app and deploys the
+// stage of every environment in order, waiting for a manual approval before the ones listed in ApprovalBefore.
+func NewDeploymentPipelineStack(scope constructs.Construct, id string, deployment config.DeploymentPipeline, environments []config.Environment) awscdk.Stack {
+	stack := awscdk.NewStack(scope, &id, &awscdk.StackProps{
+		Env: environmentEnv(deployment.Account, deployment.Region),
+	})
+
+	buildCommands := make([]*string, 0, len(lambdaDirs)+2)
+	for _, dir := range lambdaDirs {
+		buildCommands = append(buildCommands, jsii.String("(cd "+dir+` && GOOS=linux GOARCH=amd64 go build -ldflags="-s -w" -o main .)`))
+	}
+	buildCommands = append(buildCommands, jsii.String("npm install -g aws-cdk"), jsii.String("cdk synth"))
+
+	pipeline := pipelines.NewCodePipeline(stack, jsii.String("Pipeline"), &pipelines.CodePipelineProps{
+		// Environments may live in other accounts, their deploy roles need access to the artifacts
+		CrossAccountKeys: jsii.Bool(true),
+		Synth: pipelines.NewShellStep(jsii.String("Synth"), &pipelines.ShellStepProps{
+			Input: pipelines.CodePipelineSource_Connection(jsii.String(deployment.Repository), jsii.String(deployment.Branch),
+				&pipelines.ConnectionSourceOptions{ConnectionArn: jsii.String(deployment.ConnectionArn)}),
+			Commands: &buildCommands,
+		}),
+	})
+
+	for _, environment := range environments {
+		var opts pipelines.AddStageOpts
+		if contains(deployment.ApprovalBefore, environment.Name) {
+			opts.Pre = &[]pipelines.Step{pipelines.NewManualApprovalStep(jsii.String("Promote to "+environment.Name), nil)}
+		}
+
+		pipeline.AddStage(NewEnvironmentStage(stack, environment), &opts)
+	}
+
+	return stack
+}
+
+// stackName returns the configured stack name. Problems of the configuration are left to the stack, which reports
+// them along with the overrides of its stage.
+func stackName(scope constructs.Construct) string {
+	cfg, _ := config.Load(scope)
+
+	return cfg.StackName
+}
+
+// environmentEnv returns the environment of a stage, the account and region default to the ones of the CLI.
+func environmentEnv(account, region string) *awscdk.Environment {
+	if account == "" {
+		account = os.Getenv("CDK_DEFAULT_ACCOUNT")
+	}
+	if region == "" {
+		region = os.Getenv("CDK_DEFAULT_REGION")
+	}
+
+	return &awscdk.Environment{
+		Account: jsii.String(account),
+		Region:  jsii.String(region),
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/assertions"
+	"github.com/aws/jsii-runtime-go"
+	"github.com/stretchr/testify/require"
+	"stori-challenge/config"
+)
+
+// testEnvironments mirrors the profiles of cdk.json, prod is sized up and protected.
+var testEnvironments = []interface{}{
+	map[string]interface{}{"name": "dev", "account": "111111111111", "region": "us-east-1"},
+	map[string]interface{}{
+		"name": "prod", "account": "222222222222", "region": "us-west-2", "enableSES": true,
+		"dbInstanceType": "t3.medium", "dbMultiAz": true, "dbBackupRetentionDays": 30, "deletionProtection": true,
+		"logRetentionDays": 365,
+	},
+}
+
+func TestEnvironmentStages(t *testing.T) {
+	app := awscdk.NewApp(&awscdk.AppProps{
+		Context: testContext(map[string]interface{}{
+			"environments":  testEnvironments,
+			"stackName":     "Stori",
+			"accountBrands": map[string]interface{}{"222222222222": "stori-plus"},
+		}),
+	})
+
+	environments, err := config.Environments(app)
+	require.NoError(t, err)
+	require.Len(t, environments, 2)
+
+	stacks := make(map[string]awscdk.Stack)
+	for _, environment := range environments {
+		stage := NewEnvironmentStage(app, environment)
+		stack := awscdk.Stack_Of(stage.Node().FindChild(jsii.String("Stori")))
+		require.Equal(t, environment.Account, *stack.Account())
+		require.Equal(t, environment.Region, *stack.Region())
+
+		stacks[environment.Name] = stack
+	}
+
+	// A stage is synthesized once, so every stage is created before the templates are read
+	templates := make(map[string]assertions.Template)
+	for name, stack := range stacks {
+		templates[name] = assertions.Template_FromStack(stack, nil)
+	}
+
+	// dev keeps the top level defaults
+	templates["dev"].HasResource(jsii.String("AWS::RDS::DBInstance"), map[string]interface{}{
+		"DeletionPolicy": "Delete",
+		"Properties": assertions.Match_ObjectLike(&map[string]interface{}{
+			"DBInstanceClass":       "db.t3.micro",
+			"MultiAZ":               false,
+			"BackupRetentionPeriod": 1,
+			"DeletionProtection":    false,
+		}),
+	})
+	templates["dev"].HasResourceProperties(jsii.String("Custom::LogRetention"), map[string]interface{}{"RetentionInDays": 7})
+	templates["dev"].HasResourceProperties(jsii.String("AWS::Lambda::Function"), map[string]interface{}{
+		"Environment": map[string]interface{}{"Variables": assertions.Match_ObjectLike(&map[string]interface{}{"USE_SES": "false"})},
+	})
+	templates["dev"].HasResourceProperties(jsii.String("AWS::Lambda::Function"), map[string]interface{}{
+		"Environment": map[string]interface{}{"Variables": assertions.Match_ObjectLike(&map[string]interface{}{"BRAND": "stori"})},
+	})
+
+	// prod overrides them
+	templates["prod"].HasResource(jsii.String("AWS::RDS::DBInstance"), map[string]interface{}{
+		"DeletionPolicy": "Snapshot",
+		"Properties": assertions.Match_ObjectLike(&map[string]interface{}{
+			"DBInstanceClass":       "db.t3.medium",
+			"MultiAZ":               true,
+			"BackupRetentionPeriod": 30,
+			"DeletionProtection":    true,
+		}),
+	})
+	templates["prod"].HasResourceProperties(jsii.String("Custom::LogRetention"), map[string]interface{}{"RetentionInDays": 365})
+	templates["prod"].HasResourceProperties(jsii.String("AWS::Lambda::Function"), map[string]interface{}{
+		"Environment": map[string]interface{}{"Variables": assertions.Match_ObjectLike(&map[string]interface{}{"USE_SES": "true"})},
+	})
+	// and its account gets its own brand, whatever the account of the CLI
+	templates["prod"].HasResourceProperties(jsii.String("AWS::Lambda::Function"), map[string]interface{}{
+		"Environment": map[string]interface{}{"Variables": assertions.Match_ObjectLike(&map[string]interface{}{"BRAND": "stori-plus"})},
+	})
+}
+
+// TestShippedEnvironments synthesizes every environment of cdk.json as it ships, the stages load their
+// configuration when created and panic on problems.
+func TestShippedEnvironments(t *testing.T) {
+	// The environments default to the account and region of the CLI
+	t.Setenv("CDK_DEFAULT_ACCOUNT", "123456789012")
+	t.Setenv("CDK_DEFAULT_REGION", "us-east-1")
+
+	content, err := os.ReadFile("cdk.json")
+	require.NoError(t, err)
+	var cdkJSON struct {
+		Context map[string]interface{} `json:"context"`
+	}
+	require.NoError(t, json.Unmarshal(content, &cdkJSON))
+
+	app := awscdk.NewApp(&awscdk.AppProps{Context: &cdkJSON.Context})
+	environments, err := config.Environments(app)
+	require.NoError(t, err)
+	require.NotEmpty(t, environments)
+
+	for _, environment := range environments {
+		require.NotPanics(t, func() { NewEnvironmentStage(app, environment) }, environment.Name)
+	}
+	app.Synth(nil)
+}
+
+func TestSelectedEnvironments(t *testing.T) {
+	app := awscdk.NewApp(&awscdk.AppProps{
+		Context: &map[string]interface{}{"environments": testEnvironments, "env": "prod"},
+	})
+
+	environments, err := config.Environments(app)
+	require.NoError(t, err)
+
+	selected, err := config.SelectedEnvironments(app, environments)
+	require.NoError(t, err)
+	require.Len(t, selected, 1)
+	require.Equal(t, "prod", selected[0].Name)
+	require.Equal(t, true, selected[0].Context["deletionProtection"])
+
+	app = awscdk.NewApp(&awscdk.AppProps{
+		Context: &map[string]interface{}{"environments": testEnvironments, "env": "qa"},
+	})
+	_, err = config.SelectedEnvironments(app, environments)
+	require.EqualError(t, err, `unknown environment "qa"`)
+
+	app = awscdk.NewApp(&awscdk.AppProps{
+		Context: &map[string]interface{}{"environments": []interface{}{
+			map[string]interface{}{"name": "dev"}, map[string]interface{}{"name": "dev"},
+		}},
+	})
+	_, err = config.Environments(app)
+	require.EqualError(t, err, "environment dev is declared twice")
+
+	// Overrides must be configuration keys, a mistyped one is reported
+	app = awscdk.NewApp(&awscdk.AppProps{
+		Context: &map[string]interface{}{"environments": []interface{}{
+			map[string]interface{}{"name": "dev", "dbInstanceTyp": "t3.small"},
+		}},
+	})
+	_, err = config.Environments(app)
+	require.EqualError(t, err, `environment dev: unknown key "dbInstanceTyp"`)
+}
+
+func TestDeploymentPipelineStack(t *testing.T) {
+	app := awscdk.NewApp(&awscdk.AppProps{
+		Context: testContext(map[string]interface{}{"environments": testEnvironments}),
+	})
+
+	environments, err := config.Environments(app)
+	require.NoError(t, err)
+
+	stack := NewDeploymentPipelineStack(app, "StoriPipeline", config.DeploymentPipeline{
+		Repository:     "owner/stori-challenge",
+		Branch:         "main",
+		ConnectionArn:  "arn:aws:codestar-connections:us-east-1:111111111111:connection/test",
+		Account:        "111111111111",
+		Region:         "us-east-1",
+		ApprovalBefore: []string{"prod"},
+	}, environments)
+
+	// Source, synth and self mutation come first, then the environments in order with an approval before prod
+	template := assertions.Template_FromStack(stack, nil)
+	template.HasResourceProperties(jsii.String("AWS::CodePipeline::Pipeline"), map[string]interface{}{
+		"Stages": assertions.Match_ArrayWith(&[]interface{}{
+			assertions.Match_ObjectLike(&map[string]interface{}{"Name": "dev"}),
+			assertions.Match_ObjectLike(&map[string]interface{}{
+				"Name": "prod",
+				"Actions": assertions.Match_ArrayWith(&[]interface{}{assertions.Match_ObjectLike(&map[string]interface{}{
+					"ActionTypeId": assertions.Match_ObjectLike(&map[string]interface{}{"Category": "Approval"}),
+				})}),
+			}),
+		}),
+	})
+	template.ResourcePropertiesCountIs(jsii.String("AWS::CodePipeline::Pipeline"), map[string]interface{}{
+		"Stages": assertions.Match_ArrayWith(&[]interface{}{assertions.Match_ObjectLike(&map[string]interface{}{
+			"Name": "dev",
+			"Actions": assertions.Match_ArrayWith(&[]interface{}{assertions.Match_ObjectLike(&map[string]interface{}{
+				"ActionTypeId": assertions.Match_ObjectLike(&map[string]interface{}{"Category": "Approval"}),
+			})}),
+		})}),
+	}, jsii.Number(0))
+}
@@ -0,0 +1,172 @@
+package statementpipeline
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awscloudwatch"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awscloudwatchactions"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awssns"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+	"stori-challenge/metrics"
+)
+
+// Thresholds of the alarms.
+const (
+	// errorRateThreshold is the percentage of failed invocations of a lambda over a period.
+	errorRateThreshold = 5
+	// durationThreshold is the share of its timeout the slowest invocations of a lambda may take.
+	durationThreshold = 0.8
+	// defaultFunctionTimeout is the timeout of the lambdas that do not set one, in seconds.
+	defaultFunctionTimeout = 3
+	// monitoringPeriodMinutes is the period of the alarms and of the dashboard graphs.
+	monitoringPeriodMinutes = 5
+)
+
+// monitoredFunction is a lambda of the pipeline, named after its id.
+type monitoredFunction struct {
+	name     string
+	function awslambda.Function
+}
+
+// newMonitoring creates the alarms of the pipeline, notifying the topic when set, and the dashboard charting them
+// along with the custom metrics the lambdas emit.
+func newMonitoring(scope constructs.Construct, statementPipeline *StatementPipeline, alarmTopic awssns.ITopic) (awscloudwatch.Dashboard, []awscloudwatch.Alarm) {
+	construct := constructs.NewConstruct(scope, jsii.String("Monitoring"))
+	pipelinePath := *statementPipeline.Node().Path()
+	monitoringPeriod := awscdk.Duration_Minutes(jsii.Number(monitoringPeriodMinutes))
+
+	functions := []monitoredFunction{
+		{"ProcessCsvLambda", statementPipeline.ProcessCsvLambda},
+		{"StoreSummaryLambda", statementPipeline.StoreSummaryLambda},
+		{"SendSummaryLambda", statementPipeline.SendSummaryLambda},
+		{"SesEventsLambda", statementPipeline.SesEventsLambda},
+		{"UnsubscribeLambda", statementPipeline.UnsubscribeLambda},
+		{"InitLambda", statementPipeline.InitLambda},
+	}
+
+	var alarms []awscloudwatch.Alarm
+	newAlarm := func(id string, metric awscloudwatch.IMetric, threshold float64, operator awscloudwatch.ComparisonOperator, description string) {
+		alarm := awscloudwatch.NewAlarm(construct, jsii.String(id), &awscloudwatch.AlarmProps{
+			Metric:             metric,
+			Threshold:          jsii.Number(threshold),
+			ComparisonOperator: operator,
+			EvaluationPeriods:  jsii.Number(1),
+			TreatMissingData:   awscloudwatch.TreatMissingData_NOT_BREACHING,
+			AlarmDescription:   jsii.String(fmt.Sprintf("%s: %s", pipelinePath, description)),
+		})
+		if alarmTopic != nil {
+			alarm.AddAlarmAction(awscloudwatchactions.NewSnsAction(alarmTopic))
+		}
+		alarms = append(alarms, alarm)
+	}
+
+	var errorMetrics, durationMetrics []awscloudwatch.IMetric
+	for _, monitored := range functions {
+		function := monitored.function
+		// The alarms take the metrics as they are, labels would turn them into metric math
+		errors := function.MetricErrors(&awscloudwatch.MetricOptions{Period: monitoringPeriod})
+		invocations := function.MetricInvocations(&awscloudwatch.MetricOptions{Period: monitoringPeriod})
+		duration := function.MetricDuration(&awscloudwatch.MetricOptions{Period: monitoringPeriod, Statistic: jsii.String("Maximum")})
+		errorMetrics = append(errorMetrics, labeled(errors, monitored.name))
+		durationMetrics = append(durationMetrics, labeled(duration, monitored.name))
+
+		errorRate := awscloudwatch.NewMathExpression(&awscloudwatch.MathExpressionProps{
+			Expression:   jsii.String("IF(invocations > 0, 100 * errors / invocations, 0)"),
+			UsingMetrics: &map[string]awscloudwatch.IMetric{"errors": errors, "invocations": invocations},
+			Label:        jsii.String(monitored.name + " error rate"),
+			Period:       monitoringPeriod,
+		})
+		newAlarm(monitored.name+"ErrorRateAlarm", errorRate, errorRateThreshold, awscloudwatch.ComparisonOperator_GREATER_THAN_THRESHOLD,
+			fmt.Sprintf("more than %d%% of the %s invocations failed", errorRateThreshold, monitored.name))
+
+		timeoutSeconds := float64(defaultFunctionTimeout)
+		if timeout := function.Timeout(); timeout != nil {
+			timeoutSeconds = *timeout.ToSeconds(nil)
+		}
+		newAlarm(monitored.name+"DurationAlarm", duration, timeoutSeconds*1000*durationThreshold,
+			awscloudwatch.ComparisonOperator_GREATER_THAN_THRESHOLD,
+			fmt.Sprintf("%s invocations took more than %d%% of its timeout", monitored.name, int(durationThreshold*100)))
+	}
+
+	// Orchestration failures: messages given up on by a consumer, or failed executions
+	var orchestrationMetrics []awscloudwatch.IMetric
+	var orchestrationTitle string
+	for _, consumer := range []struct {
+		name  string
+		queue ConsumerQueue
+	}{{"StoreSummary", statementPipeline.StoreSummaryQueue}, {"SendSummary", statementPipeline.SendSummaryQueue}} {
+		if consumer.queue.DeadLetterQueue == nil {
+			continue
+		}
+		depth := consumer.queue.DeadLetterQueue.MetricApproximateNumberOfMessagesVisible(&awscloudwatch.MetricOptions{
+			Period: monitoringPeriod, Statistic: jsii.String("Maximum"),
+		})
+		orchestrationMetrics = append(orchestrationMetrics, labeled(depth, consumer.name+" DLQ"))
+		orchestrationTitle = "Dead-letter queue depth"
+		newAlarm(consumer.name+"DLQDepthAlarm", depth, 1, awscloudwatch.ComparisonOperator_GREATER_THAN_OR_EQUAL_TO_THRESHOLD,
+			fmt.Sprintf("messages landed in the %s dead-letter queue, redrive them once fixed", consumer.name))
+	}
+	if statementPipeline.StateMachine != nil {
+		failed := statementPipeline.StateMachine.MetricFailed(&awscloudwatch.MetricOptions{Period: monitoringPeriod})
+		succeeded := statementPipeline.StateMachine.MetricSucceeded(&awscloudwatch.MetricOptions{Period: monitoringPeriod})
+		orchestrationMetrics = append(orchestrationMetrics, labeled(failed, "Failed"), labeled(succeeded, "Succeeded"))
+		orchestrationTitle = "Executions"
+		newAlarm("ExecutionsFailedAlarm", failed, 1, awscloudwatch.ComparisonOperator_GREATER_THAN_OR_EQUAL_TO_THRESHOLD,
+			"executions of the state machine failed")
+	}
+
+	// The custom metrics the lambdas emit in Embedded Metric Format
+	customMetric := func(name, statistic, label string) awscloudwatch.IMetric {
+		return awscloudwatch.NewMetric(&awscloudwatch.MetricProps{
+			Namespace:     jsii.String(metrics.DefaultNamespace),
+			MetricName:    jsii.String(name),
+			DimensionsMap: &map[string]*string{metrics.PipelineDimension: jsii.String(pipelinePath)},
+			Statistic:     jsii.String(statistic),
+			Period:        monitoringPeriod,
+			Label:         jsii.String(label),
+		})
+	}
+	graph := func(title string, left ...awscloudwatch.IMetric) awscloudwatch.IWidget {
+		return awscloudwatch.NewGraphWidget(&awscloudwatch.GraphWidgetProps{
+			Title: jsii.String(title),
+			Left:  &left,
+			Width: jsii.Number(6),
+		})
+	}
+
+	dashboard := awscloudwatch.NewDashboard(construct, jsii.String("Dashboard"), &awscloudwatch.DashboardProps{})
+	dashboard.AddWidgets(
+		graph("Files processed", customMetric(metrics.FilesProcessed, "Sum", "Files")),
+		graph("Rows", customMetric(metrics.RowsParsed, "Sum", "Parsed"), customMetric(metrics.RowsRejected, "Sum", "Rejected")),
+		graph("Emails sent", customMetric(metrics.EmailsSent, "Sum", "Emails")),
+		graph("DB insert latency (ms)",
+			customMetric(metrics.DBInsertLatency, "Average", "Average"), customMetric(metrics.DBInsertLatency, "p99", "p99")),
+	)
+	lambdaWidgets := []awscloudwatch.IWidget{
+		graph("Lambda errors", errorMetrics...),
+		graph("Lambda max duration (ms)", durationMetrics...),
+	}
+	if len(orchestrationMetrics) > 0 {
+		lambdaWidgets = append(lambdaWidgets, graph(orchestrationTitle, orchestrationMetrics...))
+	}
+	dashboard.AddWidgets(lambdaWidgets...)
+	alarmList := make([]awscloudwatch.IAlarm, 0, len(alarms))
+	for _, alarm := range alarms {
+		alarmList = append(alarmList, alarm)
+	}
+	dashboard.AddWidgets(awscloudwatch.NewAlarmStatusWidget(&awscloudwatch.AlarmStatusWidgetProps{
+		Title:  jsii.String("Alarms"),
+		Alarms: &alarmList,
+		Width:  jsii.Number(24),
+	}))
+
+	return dashboard, alarms
+}
+
+// labeled returns the metric named for the dashboard legend.
+func labeled(metric awscloudwatch.Metric, label string) awscloudwatch.IMetric {
+	return metric.With(&awscloudwatch.MetricOptions{Label: jsii.String(label)})
+}
@@ -0,0 +1,608 @@
+// Package statementpipeline exposes the statement pipeline as a CDK construct, so it can be embedded in any stack.
+// Several pipelines can live in the same stack, e.g. one per tenant, each with its own bucket or its own prefixes
+// of a shared bucket.
+package statementpipeline
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awscloudwatch"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsec2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsevents"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awseventstargets"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslambdaeventsources"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslogs"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsrds"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awss3"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awss3notifications"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awssecretsmanager"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsses"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awssns"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awssnssubscriptions"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awssqs"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsstepfunctions"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsstepfunctionstasks"
+	"github.com/aws/aws-cdk-go/awscdk/v2/customresources"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+	"stori-challenge/config"
+	"stori-challenge/logging"
+	"stori-challenge/metrics"
+	"stori-challenge/pipeline"
+	"stori-challenge/summary"
+	"stori-challenge/templates"
+)
+
+// defaultDatabasePort is the Postgres port the lambdas connect to.
+const defaultDatabasePort = 5432
+
+// StatementPipelineProps configures a StatementPipeline.
+type StatementPipelineProps struct {
+	// Bucket receives the uploaded statements and stores the generated emails, one is created when nil. Pipelines
+	// can share a bucket as long as their prefixes do not overlap. With the step functions orchestration a given
+	// bucket must have EventBridge notifications enabled.
+	Bucket awss3.IBucket
+	// Database stores the summaries, recipients and runs, it is required.
+	Database *DatabaseProps
+	// Notifier configures the summary emails.
+	Notifier *NotifierProps
+	// Prefixes of the bucket, empty ones keep the default.
+	Prefixes summary.Prefixes
+	// Orchestration chains the parse, store and notify steps, one of the config.Orchestration modes. Empty uses
+	// config.OrchestrationStepFunctions.
+	Orchestration string
+	// CodeDir holds the lambda folders, empty uses the working directory.
+	CodeDir string
+	// LogRetention of the store lambda logs, empty keeps them one week.
+	LogRetention awslogs.RetentionDays
+	// LogEmails keeps the email addresses in the lambda logs, they are redacted otherwise.
+	LogEmails bool
+	// AlarmTopic is notified when an alarm of the pipeline goes off, nil leaves the alarms without action.
+	AlarmTopic awssns.ITopic
+}
+
+// DatabaseProps describes the Postgres database used by the pipeline.
+type DatabaseProps struct {
+	Vpc awsec2.IVpc
+	// LambdaSubnets the lambdas are placed in, nil uses the private subnets of Vpc. The lambdas are never placed in
+	// public subnets, they reach the AWS services through NAT gateways or VPC endpoints.
+	LambdaSubnets *awsec2.SubnetSelection
+	// SecurityGroup of the database, or of the proxy when set, the lambdas are allowed to reach it on Port.
+	SecurityGroup awsec2.ISecurityGroup
+	// Secret holds the host, port, username and password of the database.
+	Secret awssecretsmanager.ISecret
+	// Proxy, when set, is the RDS Proxy the lambdas connect through with IAM authentication as User, they are not
+	// granted access to the secret then.
+	Proxy awsrds.IDatabaseProxy
+	User  string
+	// Name of the database the lambdas connect to, empty uses the name of the secret or "postgres".
+	Name string
+	// Port defaults to 5432.
+	Port float64
+}
+
+// NotifierProps configures the summary emails.
+type NotifierProps struct {
+	// EnableSES sends the emails, otherwise they are only stored in the bucket.
+	EnableSES bool
+	Sender    string
+	// Recipient gets the summaries of the accounts without registered recipients.
+	Recipient string
+	// Brand and TemplateVersion pick the email template, an empty version uses the latest one.
+	Brand           string
+	TemplateVersion string
+}
+
+// StatementPipeline summarizes the statements uploaded under the input prefix of its bucket, stores the summaries
+// in the database and emails them to the account recipients.
+type StatementPipeline struct {
+	constructs.Construct
+
+	Bucket   awss3.IBucket
+	Prefixes summary.Prefixes
+
+	InitLambda         awslambda.Function
+	ProcessCsvLambda   awslambda.Function
+	StoreSummaryLambda awslambda.Function
+	SendSummaryLambda  awslambda.Function
+	UnsubscribeLambda  awslambda.Function
+	SesEventsLambda    awslambda.Function
+
+	// LambdaSecurityGroup is shared by every lambda of the pipeline.
+	LambdaSecurityGroup awsec2.SecurityGroup
+	// UnsubscribeURL serves the unsubscribe links included in the emails.
+	UnsubscribeURL awslambda.FunctionUrl
+
+	// StateMachine is only set with the step functions orchestration.
+	StateMachine awsstepfunctions.StateMachine
+	// Queues are only set with the queue orchestration, the summary topic feeds the store queue whose lambda feeds
+	// the send queue.
+	StoreSummaryQueue ConsumerQueue
+	SendSummaryQueue  ConsumerQueue
+
+	// Dashboard charts the custom metrics of the lambdas, their errors and durations and the state of the Alarms.
+	Dashboard awscloudwatch.Dashboard
+	Alarms    []awscloudwatch.Alarm
+}
+
+// ConsumerQueue is a queue consumed by a lambda along with its dead-letter queue.
+type ConsumerQueue struct {
+	Queue           awssqs.Queue
+	DeadLetterQueue awssqs.Queue
+}
+
+// NewStatementPipeline creates the lambdas of the pipeline, chains them with the orchestration and grants them
+// access to the bucket and the database.
+func NewStatementPipeline(scope constructs.Construct, id string, props *StatementPipelineProps) *StatementPipeline {
+	if props == nil || props.Database == nil {
+		panic(fmt.Sprintf("statement pipeline %s: Database is required", id))
+	}
+	if props.Database.Proxy != nil && props.Database.User == "" {
+		panic(fmt.Sprintf("statement pipeline %s: Database.User is required with a Proxy", id))
+	}
+
+	// The resources are created in the embedded construct, jsii cannot take the Go struct embedding it as a scope
+	construct := constructs.NewConstruct(scope, &id)
+	this := &StatementPipeline{
+		Construct: construct,
+		Prefixes:  props.Prefixes.WithDefaults(),
+	}
+	stack := awscdk.Stack_Of(construct)
+
+	orchestration := props.Orchestration
+	if orchestration == "" {
+		orchestration = config.OrchestrationStepFunctions
+	}
+
+	notifier := props.Notifier
+	if notifier == nil {
+		notifier = &NotifierProps{}
+	}
+	brand := notifier.Brand
+	if brand == "" {
+		brand = templates.DefaultBrand
+	}
+
+	// Resolve the email template version to use for this deployment
+	emailTemplate, err := templates.Get(brand, notifier.TemplateVersion)
+	if err != nil {
+		panic(err)
+	}
+
+	database := props.Database
+	databasePort := database.Port
+	if databasePort == 0 {
+		databasePort = defaultDatabasePort
+	}
+	vpc := database.Vpc
+	lambdaSubnets := database.LambdaSubnets
+
+	logRetention := props.LogRetention
+	if logRetention == "" {
+		logRetention = awslogs.RetentionDays_ONE_WEEK
+	}
+
+	code := func(lambdaDir string) awslambda.Code {
+		return awslambda.Code_FromAsset(jsii.String(filepath.Join(props.CodeDir, lambdaDir)), nil)
+	}
+
+	/* -----------------------------------------------------------------------------------------------------------------
+	    RESOURCE DEFINITION
+
+	-------------------------------------------------------------------------------------------------------------------*/
+
+	// Create an S3 bucket, uploads are routed through EventBridge when the state machine drives the pipeline
+	this.Bucket = props.Bucket
+	if this.Bucket == nil {
+		this.Bucket = awss3.NewBucket(construct, jsii.String("Bucket"), &awss3.BucketProps{
+			Versioned:          jsii.Bool(false),
+			EventBridgeEnabled: jsii.Bool(orchestration == config.OrchestrationStepFunctions),
+		})
+	}
+	bucket := this.Bucket
+
+	// Create the init-lambda function
+	this.InitLambda = awslambda.NewFunction(construct, jsii.String("InitLambda"), &awslambda.FunctionProps{
+		Runtime: awslambda.Runtime_GO_1_X(),
+		Code:    code("init-lambda"),
+		Handler: jsii.String("main"),
+		Tracing: awslambda.Tracing_ACTIVE,
+		Environment: &map[string]*string{
+			"BUCKET_NAME": bucket.BucketName(),
+		},
+		Vpc:        vpc,
+		VpcSubnets: lambdaSubnets,
+	})
+
+	// Create the unsubscribe-lambda function, exposed through a public function URL linked from the emails
+	this.UnsubscribeLambda = awslambda.NewFunction(construct, jsii.String("UnsubscribeLambda"), &awslambda.FunctionProps{
+		Runtime:    awslambda.Runtime_GO_1_X(),
+		Code:       code("unsubscribe-lambda"),
+		Handler:    jsii.String("main"),
+		Tracing:    awslambda.Tracing_ACTIVE,
+		Vpc:        vpc,
+		VpcSubnets: lambdaSubnets,
+	})
+
+	this.UnsubscribeURL = this.UnsubscribeLambda.AddFunctionUrl(&awslambda.FunctionUrlOptions{
+		AuthType: awslambda.FunctionUrlAuthType_NONE,
+	})
+
+	// SES configuration set publishing bounce, complaint and delivery events to an SNS topic
+	sesEventsTopic := awssns.NewTopic(construct, jsii.String("SesEventsTopic"), &awssns.TopicProps{})
+
+	sesEventsTopic.AddToResourcePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Actions:    &[]*string{jsii.String("sns:Publish")},
+		Principals: &[]awsiam.IPrincipal{awsiam.NewServicePrincipal(jsii.String("ses.amazonaws.com"), nil)},
+		Resources:  &[]*string{sesEventsTopic.TopicArn()},
+		Conditions: &map[string]interface{}{
+			"StringEquals": map[string]interface{}{"AWS:SourceAccount": stack.Account()},
+		},
+	}))
+
+	sesConfigurationSet := awsses.NewConfigurationSet(construct, jsii.String("SesConfigurationSet"), &awsses.ConfigurationSetProps{})
+
+	awsses.NewCfnConfigurationSetEventDestination(construct, jsii.String("SesEventsDestination"), &awsses.CfnConfigurationSetEventDestinationProps{
+		ConfigurationSetName: sesConfigurationSet.ConfigurationSetName(),
+		EventDestination: &awsses.CfnConfigurationSetEventDestination_EventDestinationProperty{
+			Enabled: jsii.Bool(true),
+			MatchingEventTypes: &[]*string{
+				jsii.String("bounce"), jsii.String("complaint"), jsii.String("delivery"), jsii.String("reject"),
+			},
+			SnsDestination: &awsses.CfnConfigurationSetEventDestination_SnsDestinationProperty{
+				TopicArn: sesEventsTopic.TopicArn(),
+			},
+		},
+	})
+
+	// Create the ses-events-lambda function, recording delivery outcomes and suppressing hard bounces
+	this.SesEventsLambda = awslambda.NewFunction(construct, jsii.String("SesEventsLambda"), &awslambda.FunctionProps{
+		Runtime:    awslambda.Runtime_GO_1_X(),
+		Code:       code("ses-events-lambda"),
+		Handler:    jsii.String("main"),
+		Tracing:    awslambda.Tracing_ACTIVE,
+		Vpc:        vpc,
+		VpcSubnets: lambdaSubnets,
+	})
+
+	sesEventsTopic.AddSubscription(awssnssubscriptions.NewLambdaSubscription(this.SesEventsLambda, nil))
+
+	// Create the send-summary-lambda function
+	this.SendSummaryLambda = awslambda.NewFunction(construct, jsii.String("SendSummaryLambda"), &awslambda.FunctionProps{
+		Runtime: awslambda.Runtime_GO_1_X(),
+		Code:    code("send-summary-lambda"),
+		Handler: jsii.String("main"),
+		Tracing: awslambda.Tracing_ACTIVE,
+		Timeout: awscdk.Duration_Seconds(jsii.Number(30)),
+		Environment: &map[string]*string{
+			"BUCKET_NAME":            bucket.BucketName(),
+			"TEMPLATE_KEY":           jsii.String(emailTemplate.Key()),
+			"BRAND":                  jsii.String(brand),
+			"USE_SES":                jsii.String(strconv.FormatBool(notifier.EnableSES)),
+			"SENDER":                 jsii.String(notifier.Sender),
+			"RECIPIENT":              jsii.String(notifier.Recipient),
+			"UNSUBSCRIBE_URL":        this.UnsubscribeURL.Url(),
+			"CONFIGURATION_SET":      sesConfigurationSet.ConfigurationSetName(),
+			pipeline.OutputPrefixEnv: jsii.String(this.Prefixes.Output),
+		},
+		Vpc:        vpc,
+		VpcSubnets: lambdaSubnets,
+	})
+
+	// Create store-summary-lambda
+	this.StoreSummaryLambda = awslambda.NewFunction(construct, jsii.String("StoreSummaryLambda"), &awslambda.FunctionProps{
+		Runtime:      awslambda.Runtime_GO_1_X(),
+		Code:         code("store-summary-lambda"),
+		Handler:      jsii.String("main"),
+		Tracing:      awslambda.Tracing_ACTIVE,
+		Timeout:      awscdk.Duration_Seconds(jsii.Number(30)),
+		LogRetention: logRetention,
+		Vpc:          vpc,
+		VpcSubnets:   lambdaSubnets,
+	})
+
+	// Create the process-csv-lambda function
+	this.ProcessCsvLambda = awslambda.NewFunction(construct, jsii.String("ProcessCsvLambda"), &awslambda.FunctionProps{
+		Runtime: awslambda.Runtime_GO_1_X(),
+		Code:    code("process-csv-lambda"),
+		Handler: jsii.String("main"),
+		Tracing: awslambda.Tracing_ACTIVE,
+		Environment: &map[string]*string{
+			"SEND_ARN":                   this.SendSummaryLambda.FunctionArn(),
+			"STORE_ARN":                  this.StoreSummaryLambda.FunctionArn(),
+			pipeline.InputPrefixEnv:      jsii.String(this.Prefixes.Input),
+			pipeline.ProcessedPrefixEnv:  jsii.String(this.Prefixes.Processed),
+			pipeline.QuarantinePrefixEnv: jsii.String(this.Prefixes.Quarantine),
+		},
+		Timeout:    awscdk.Duration_Seconds(jsii.Number(30)),
+		Vpc:        vpc,
+		VpcSubnets: lambdaSubnets,
+	})
+
+	/* -----------------------------------------------------------------------------------------------------------------
+	    PERMISSION GRANTING
+
+	-------------------------------------------------------------------------------------------------------------------*/
+
+	lambdas := []awslambda.Function{
+		this.InitLambda, this.StoreSummaryLambda, this.SendSummaryLambda, this.SesEventsLambda,
+		this.UnsubscribeLambda, this.ProcessCsvLambda,
+	}
+
+	// Through the proxy the lambdas authenticate with IAM tokens, otherwise with the credentials of the secret
+	databaseEndpoint := awsec2.Port_Tcp(jsii.Number(databasePort))
+	for _, function := range lambdas {
+		function.Connections().AllowTo(database.SecurityGroup, databaseEndpoint, jsii.String("Allow Lambda to access RDS instance"))
+		if database.Name != "" {
+			function.AddEnvironment(jsii.String(pipeline.DBNameEnv), jsii.String(database.Name), nil)
+		}
+		if database.Proxy != nil {
+			function.AddEnvironment(jsii.String(pipeline.DBProxyEndpointEnv), database.Proxy.Endpoint(), nil)
+			function.AddEnvironment(jsii.String(pipeline.DBUserEnv), jsii.String(database.User), nil)
+			database.Proxy.GrantConnect(function, jsii.String(database.User))
+		} else {
+			function.AddEnvironment(jsii.String(pipeline.SecretArnEnv), database.Secret.SecretArn(), nil)
+			database.Secret.GrantRead(function, nil)
+		}
+	}
+
+	// The lambdas emit their metrics under the path of the pipeline, so pipelines sharing a stack are told apart
+	for _, function := range lambdas {
+		function.AddEnvironment(jsii.String(metrics.NamespaceEnv), jsii.String(metrics.DefaultNamespace), nil)
+		function.AddEnvironment(jsii.String(metrics.PipelineEnv), construct.Node().Path(), nil)
+	}
+
+	// The lambdas redact the email addresses from their logs unless told otherwise
+	if props.LogEmails {
+		for _, function := range lambdas {
+			function.AddEnvironment(jsii.String(logging.LogEmailsEnv), jsii.String("true"), nil)
+		}
+	}
+
+	// Attach the IAM policy to the init-lambda function's execution role
+	bucket.GrantReadWrite(this.InitLambda, "*")
+
+	// The process lambda moves input files to processed/ or quarantine/ once done with them
+	bucket.GrantReadWrite(this.ProcessCsvLambda, "*")
+	bucket.GrantDelete(this.ProcessCsvLambda, this.Prefixes.Input+"*")
+
+	bucket.GrantReadWrite(this.SendSummaryLambda, "*")
+
+	// Attach the IAM policy to the process-csv-lambda function's execution role
+	bucket.GrantPut(this.InitLambda, "*")
+
+	if orchestration == config.OrchestrationInvoke {
+		// Grant permission for process-csv-lambda to invoke store-summary-lambda
+		this.StoreSummaryLambda.GrantInvoke(this.ProcessCsvLambda)
+
+		// Grant permission for process-csv-lambda to invoke send-summary-lambda
+		this.SendSummaryLambda.GrantInvoke(this.ProcessCsvLambda)
+	}
+
+	// Configure the security group to allow connections between Lambda functions and RDS instance
+	this.LambdaSecurityGroup = awsec2.NewSecurityGroup(construct, jsii.String("LambdaSecurityGroup"), &awsec2.SecurityGroupProps{
+		Vpc: vpc,
+	})
+	for _, function := range lambdas {
+		function.Connections().AddSecurityGroup(this.LambdaSecurityGroup)
+	}
+
+	this.LambdaSecurityGroup.AddIngressRule(awsec2.Peer_SecurityGroupId(database.SecurityGroup.SecurityGroupId(), stack.Account()),
+		databaseEndpoint, jsii.String("Allow Lambda to access RDS instance"), jsii.Bool(false))
+
+	// Grant send email permission to the Lambda function
+	this.SendSummaryLambda.AddToRolePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Actions:   &[]*string{jsii.String("ses:SendEmail"), jsii.String("ses:SendRawEmail")},
+		Resources: &[]*string{jsii.String("*")},
+	}))
+
+	/* -----------------------------------------------------------------------------------------------------------------
+	    RESOURCE HELPERS
+
+	-------------------------------------------------------------------------------------------------------------------*/
+
+	// Invoke the init Lambda on creation, and again whenever the selected template changes so new
+	// template versions get uploaded to the bucket
+	initCall := &customresources.AwsSdkCall{
+		Service: jsii.String("Lambda"),
+		Action:  jsii.String("invoke"),
+		Parameters: map[string]interface{}{
+			"FunctionName": this.InitLambda.FunctionArn(),
+			"Payload":      jsii.String(fmt.Sprintf(`{"templateKey":%q}`, emailTemplate.Key())),
+		},
+		PhysicalResourceId: customresources.PhysicalResourceId_Of(jsii.String("init-lambda")),
+	}
+
+	// Create the custom resource to trigger the init Lambda
+	initTrigger := customresources.NewAwsCustomResource(construct, jsii.String("InitLambdaTrigger"), &customresources.AwsCustomResourceProps{
+		OnCreate: initCall,
+		OnUpdate: initCall,
+		Policy: customresources.AwsCustomResourcePolicy_FromStatements(&[]awsiam.PolicyStatement{awsiam.NewPolicyStatement(
+			&awsiam.PolicyStatementProps{
+				Actions:   &[]*string{jsii.String("lambda:InvokeFunction")},
+				Resources: &[]*string{this.InitLambda.FunctionArn()},
+			})}),
+	})
+
+	// Add rds instance secret as custom resource dependency
+	initTrigger.Node().AddDependency(database.Secret)
+	if database.Proxy != nil {
+		initTrigger.Node().AddDependency(database.Proxy)
+	}
+
+	if orchestration == config.OrchestrationQueue {
+		// Queue the summaries so a slow or failing step does not hold the upload. The store lambda hands every
+		// stored summary on to the send queue, so an email always goes out after its summary is stored
+		summaryTopic := awssns.NewTopic(construct, jsii.String("SummaryTopic"), &awssns.TopicProps{})
+		summaryTopic.GrantPublish(this.ProcessCsvLambda)
+		this.ProcessCsvLambda.AddEnvironment(jsii.String("SUMMARY_TOPIC_ARN"), summaryTopic.TopicArn(), nil)
+
+		this.StoreSummaryQueue = newConsumerQueue(construct, "StoreSummary", this.StoreSummaryLambda)
+		summaryTopic.AddSubscription(awssnssubscriptions.NewSqsSubscription(this.StoreSummaryQueue.Queue, &awssnssubscriptions.SqsSubscriptionProps{
+			RawMessageDelivery: jsii.Bool(true),
+		}))
+
+		this.SendSummaryQueue = newConsumerQueue(construct, "SendSummary", this.SendSummaryLambda)
+		this.SendSummaryQueue.Queue.GrantSendMessages(this.StoreSummaryLambda)
+		this.StoreSummaryLambda.AddEnvironment(jsii.String("SEND_QUEUE_URL"), this.SendSummaryQueue.Queue.QueueUrl(), nil)
+	}
+
+	if orchestration == config.OrchestrationInvoke || orchestration == config.OrchestrationQueue {
+		// Configure the S3 bucket to trigger the process CSV Lambda when a file is uploaded
+		bucket.AddEventNotification(
+			awss3.EventType_OBJECT_CREATED_PUT,
+			awss3notifications.NewLambdaDestination(this.ProcessCsvLambda),
+			&awss3.NotificationKeyFilter{
+				Prefix: jsii.String(this.Prefixes.Input),
+			},
+		)
+	} else {
+		this.StateMachine = newPipelineStateMachine(construct, this.ProcessCsvLambda, this.StoreSummaryLambda, this.SendSummaryLambda)
+
+		// Start an execution for every object created under the input prefix
+		awsevents.NewRule(construct, jsii.String("InputUploadedRule"), &awsevents.RuleProps{
+			EventPattern: &awsevents.EventPattern{
+				Source:     jsii.Strings("aws.s3"),
+				DetailType: jsii.Strings("Object Created"),
+				Detail: &map[string]interface{}{
+					"bucket": map[string]interface{}{"name": []interface{}{bucket.BucketName()}},
+					"object": map[string]interface{}{"key": []interface{}{map[string]interface{}{"prefix": this.Prefixes.Input}}},
+				},
+			},
+			Targets: &[]awsevents.IRuleTarget{awseventstargets.NewSfnStateMachine(this.StateMachine, nil)},
+		})
+	}
+
+	this.Dashboard, this.Alarms = newMonitoring(construct, this, props.AlarmTopic)
+
+	return this
+}
+
+// newConsumerQueue creates a queue with a dead-letter queue and has the lambda consume it, reporting partial batch
+// failures so only the failed messages are retried.
+func newConsumerQueue(scope constructs.Construct, name string, consumer awslambda.Function) ConsumerQueue {
+	deadLetterQueue := awssqs.NewQueue(scope, jsii.String(name+"DLQ"), &awssqs.QueueProps{
+		RetentionPeriod: awscdk.Duration_Days(jsii.Number(14)),
+	})
+
+	// The visibility timeout must outlast the consumer timeout, or messages get delivered twice
+	queue := awssqs.NewQueue(scope, jsii.String(name+"Queue"), &awssqs.QueueProps{
+		VisibilityTimeout: awscdk.Duration_Seconds(jsii.Number(6 * 30)),
+		DeadLetterQueue: &awssqs.DeadLetterQueue{
+			Queue:           deadLetterQueue,
+			MaxReceiveCount: jsii.Number(3),
+		},
+	})
+
+	consumer.AddEventSource(awslambdaeventsources.NewSqsEventSource(queue, &awslambdaeventsources.SqsEventSourceProps{
+		BatchSize:               jsii.Number(10),
+		ReportBatchItemFailures: jsii.Bool(true),
+	}))
+
+	return ConsumerQueue{Queue: queue, DeadLetterQueue: deadLetterQueue}
+}
+
+// newPipelineStateMachine chains the lambdas as parse → store → notify → archive tasks, the parse lambda also
+// archiving the input file once the summary was notified. Each task gets the previous task output as input,
+// transient failures are retried and a failure of any step ends the execution in a dedicated fail state carrying
+// the error, the input file being quarantined first when storing or notifying failed.
+func newPipelineStateMachine(scope constructs.Construct, parse, store, notify awslambda.IFunction) awsstepfunctions.StateMachine {
+	// The parse input is built from the S3 'Object Created' event delivered by EventBridge
+	parseTask := awsstepfunctionstasks.NewLambdaInvoke(scope, jsii.String("Parse"), &awsstepfunctionstasks.LambdaInvokeProps{
+		LambdaFunction: parse,
+		Payload: awsstepfunctions.TaskInput_FromObject(&map[string]interface{}{
+			"Bucket":     awsstepfunctions.JsonPath_StringAt(jsii.String("$.detail.bucket.name")),
+			"Key":        awsstepfunctions.JsonPath_StringAt(jsii.String("$.detail.object.key")),
+			"ETag":       awsstepfunctions.JsonPath_StringAt(jsii.String("$.detail.object.etag")),
+			"Sequencer":  awsstepfunctions.JsonPath_StringAt(jsii.String("$.detail.object.sequencer")),
+			"ReceivedAt": awsstepfunctions.JsonPath_StringAt(jsii.String("$.time")),
+		}),
+		PayloadResponseOnly: jsii.Bool(true),
+	})
+
+	// Storing is idempotent per run, so any failure can be retried
+	storeTask := awsstepfunctionstasks.NewLambdaInvoke(scope, jsii.String("Store"), &awsstepfunctionstasks.LambdaInvokeProps{
+		LambdaFunction:      store,
+		PayloadResponseOnly: jsii.Bool(true),
+	})
+	storeTask.AddRetry(&awsstepfunctions.RetryProps{
+		Errors:      jsii.Strings("States.TaskFailed"),
+		Interval:    awscdk.Duration_Seconds(jsii.Number(5)),
+		MaxAttempts: jsii.Number(3),
+		BackoffRate: jsii.Number(2),
+	})
+
+	// Sending is only retried on Lambda service errors, a failed send could otherwise reach recipients twice
+	notifyTask := awsstepfunctionstasks.NewLambdaInvoke(scope, jsii.String("Notify"), &awsstepfunctionstasks.LambdaInvokeProps{
+		LambdaFunction:      notify,
+		PayloadResponseOnly: jsii.Bool(true),
+		ResultPath:          jsii.String("$.Notification"),
+	})
+
+	// The input file only leaves the input prefix once the run is over, moved to the processed prefix on success
+	archiveTask := newArchiveTask(scope, "Archive", parse, summary.OutcomeProcessed)
+
+	parseFailed := awsstepfunctions.NewFail(scope, jsii.String("ParseFailed"), &awsstepfunctions.FailProps{
+		Error: jsii.String("ParseFailed"),
+		Cause: jsii.String("The uploaded file could not be read or processed"),
+	})
+	storeFailed := awsstepfunctions.NewFail(scope, jsii.String("StoreFailed"), &awsstepfunctions.FailProps{
+		Error: jsii.String("StoreFailed"),
+		Cause: jsii.String("The summary could not be stored in the database"),
+	})
+	notifyFailed := awsstepfunctions.NewFail(scope, jsii.String("NotifyFailed"), &awsstepfunctions.FailProps{
+		Error: jsii.String("NotifyFailed"),
+		Cause: jsii.String("The summary was stored but the email could not be generated or sent"),
+	})
+
+	// The parse step quarantines the files it cannot parse itself, the ones it could not read are left to be retried
+	catchError := &awsstepfunctions.CatchProps{ResultPath: jsii.String("$.Error")}
+	parseTask.AddCatch(parseFailed, catchError)
+
+	// A file whose summary could not be stored or sent is quarantined before failing, so it does not stay under the
+	// input prefix as if it were still being processed
+	quarantineStore := newArchiveTask(scope, "QuarantineStoreFailure", parse, summary.OutcomeQuarantined)
+	quarantineStore.AddCatch(storeFailed, catchError)
+	storeTask.AddCatch(quarantineStore.Next(storeFailed), catchError)
+
+	quarantineNotify := newArchiveTask(scope, "QuarantineNotifyFailure", parse, summary.OutcomeQuarantined)
+	quarantineNotify.AddCatch(notifyFailed, catchError)
+	notifyTask.AddCatch(quarantineNotify.Next(notifyFailed), catchError)
+
+	definition := awsstepfunctions.Chain_Start(parseTask).
+		Next(storeTask).
+		Next(notifyTask).
+		Next(archiveTask).
+		Next(awsstepfunctions.NewSucceed(scope, jsii.String("Done"), nil))
+
+	return awsstepfunctions.NewStateMachine(scope, jsii.String("PipelineStateMachine"), &awsstepfunctions.StateMachineProps{
+		Definition:     definition,
+		Timeout:        awscdk.Duration_Minutes(jsii.Number(15)),
+		TracingEnabled: jsii.Bool(true),
+	})
+}
+
+// newArchiveTask invokes the parse lambda to move the input file of the run with the outcome, the failure caught in
+// $.Error being the reason of a quarantined run. The archived key is kept under $.Archive.
+func newArchiveTask(scope constructs.Construct, id string, parse awslambda.IFunction, outcome string) awsstepfunctionstasks.LambdaInvoke {
+	payload := map[string]interface{}{
+		"Outcome": outcome,
+		"Message": awsstepfunctions.JsonPath_EntirePayload(),
+	}
+	if outcome == summary.OutcomeQuarantined {
+		payload["Reason"] = awsstepfunctions.JsonPath_StringAt(jsii.String("$.Error.Cause"))
+	}
+
+	return awsstepfunctionstasks.NewLambdaInvoke(scope, jsii.String(id), &awsstepfunctionstasks.LambdaInvokeProps{
+		LambdaFunction:      parse,
+		Payload:             awsstepfunctions.TaskInput_FromObject(&payload),
+		PayloadResponseOnly: jsii.Bool(true),
+		ResultSelector:      &map[string]interface{}{"ArchivedKey": awsstepfunctions.JsonPath_StringAt(jsii.String("$.ArchivedKey"))},
+		ResultPath:          jsii.String("$.Archive"),
+	})
+}
@@ -0,0 +1,184 @@
+package statementpipeline
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/assertions"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsec2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsrds"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awss3"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awssecretsmanager"
+	"github.com/aws/jsii-runtime-go"
+	"github.com/stretchr/testify/require"
+	"stori-challenge/config"
+	"stori-challenge/summary"
+)
+
+// newDatabaseProps creates the network and secret the pipelines of a test stack share.
+func newDatabaseProps(stack awscdk.Stack) *DatabaseProps {
+	vpc := awsec2.NewVpc(stack, jsii.String("Vpc"), &awsec2.VpcProps{NatGateways: jsii.Number(0)})
+
+	return &DatabaseProps{
+		Vpc:           vpc,
+		SecurityGroup: awsec2.NewSecurityGroup(stack, jsii.String("DatabaseSecurityGroup"), &awsec2.SecurityGroupProps{Vpc: vpc}),
+		Secret:        awssecretsmanager.NewSecret(stack, jsii.String("DatabaseSecret"), nil),
+	}
+}
+
+func TestStatementPipelinesSharingABucket(t *testing.T) {
+	app := awscdk.NewApp(nil)
+	stack := awscdk.NewStack(app, jsii.String("TenantStack"), nil)
+	database := newDatabaseProps(stack)
+	bucket := awss3.NewBucket(stack, jsii.String("SharedBucket"), &awss3.BucketProps{EventBridgeEnabled: jsii.Bool(true)})
+
+	tenants := map[string]summary.Prefixes{
+		"TenantA": {Input: "tenant-a/input", Processed: "tenant-a/processed", Quarantine: "tenant-a/quarantine", Output: "tenant-a/output"},
+		"TenantB": {Input: "tenant-b/input/", Processed: "tenant-b/processed/", Quarantine: "tenant-b/quarantine/", Output: "tenant-b/output/"},
+	}
+	for id, prefixes := range tenants {
+		pipeline := NewStatementPipeline(stack, id, &StatementPipelineProps{
+			Bucket:   bucket,
+			Database: database,
+			Prefixes: prefixes,
+			CodeDir:  "..",
+		})
+		require.Equal(t, prefixes.WithDefaults(), pipeline.Prefixes)
+		require.NotNil(t, pipeline.StateMachine, id)
+	}
+
+	template := assertions.Template_FromStack(stack, nil)
+	template.ResourceCountIs(jsii.String("AWS::S3::Bucket"), jsii.Number(1))
+	template.ResourceCountIs(jsii.String("AWS::StepFunctions::StateMachine"), jsii.Number(2))
+	template.ResourceCountIs(jsii.String("AWS::Lambda::Function"), jsii.Number(2*6+3))
+
+	for _, tenant := range []string{"tenant-a", "tenant-b"} {
+		// Each pipeline only starts on the uploads under its own input prefix
+		template.HasResourceProperties(jsii.String("AWS::Events::Rule"), map[string]interface{}{
+			"EventPattern": assertions.Match_ObjectLike(&map[string]interface{}{
+				"detail": assertions.Match_ObjectLike(&map[string]interface{}{
+					"object": map[string]interface{}{"key": []interface{}{map[string]interface{}{"prefix": tenant + "/input/"}}},
+				}),
+			}),
+		})
+
+		// and reads, archives and writes under its own prefixes
+		template.HasResourceProperties(jsii.String("AWS::Lambda::Function"), map[string]interface{}{
+			"Environment": map[string]interface{}{"Variables": assertions.Match_ObjectLike(&map[string]interface{}{
+				"INPUT_PREFIX":      tenant + "/input/",
+				"PROCESSED_PREFIX":  tenant + "/processed/",
+				"QUARANTINE_PREFIX": tenant + "/quarantine/",
+			})},
+		})
+		template.HasResourceProperties(jsii.String("AWS::Lambda::Function"), map[string]interface{}{
+			"Environment": map[string]interface{}{"Variables": assertions.Match_ObjectLike(&map[string]interface{}{
+				"OUTPUT_PREFIX": tenant + "/output/",
+			})},
+		})
+	}
+}
+
+func TestStatementPipelineInvokeOrchestrationCreatesBucket(t *testing.T) {
+	app := awscdk.NewApp(nil)
+	stack := awscdk.NewStack(app, jsii.String("InvokeStack"), nil)
+
+	pipeline := NewStatementPipeline(stack, "Pipeline", &StatementPipelineProps{
+		Database:      newDatabaseProps(stack),
+		Orchestration: config.OrchestrationInvoke,
+		CodeDir:       "..",
+		LogEmails:     true,
+	})
+	require.NotNil(t, pipeline.Bucket)
+	require.Nil(t, pipeline.StateMachine)
+	require.Equal(t, summary.DefaultPrefixes, pipeline.Prefixes)
+
+	template := assertions.Template_FromStack(stack, nil)
+	template.ResourceCountIs(jsii.String("AWS::S3::Bucket"), jsii.Number(1))
+	template.ResourceCountIs(jsii.String("AWS::Events::Rule"), jsii.Number(0))
+	// Every lambda of the pipeline keeps the email addresses in its logs
+	logEmails := template.FindResources(jsii.String("AWS::Lambda::Function"), map[string]interface{}{
+		"Properties": map[string]interface{}{
+			"Environment": map[string]interface{}{"Variables": assertions.Match_ObjectLike(&map[string]interface{}{"LOG_EMAILS": "true"})},
+		},
+	})
+	require.Len(t, *logEmails, 6)
+	template.HasResourceProperties(jsii.String("Custom::S3BucketNotifications"), map[string]interface{}{
+		"NotificationConfiguration": map[string]interface{}{
+			"LambdaFunctionConfigurations": []interface{}{assertions.Match_ObjectLike(&map[string]interface{}{
+				"Filter": map[string]interface{}{"Key": map[string]interface{}{"FilterRules": []interface{}{
+					map[string]interface{}{"Name": "prefix", "Value": "input/"},
+				}}},
+			})},
+		},
+	})
+}
+
+func TestStatementPipelineRequiresDatabase(t *testing.T) {
+	app := awscdk.NewApp(nil)
+	stack := awscdk.NewStack(app, jsii.String("NoDatabaseStack"), nil)
+
+	require.PanicsWithValue(t, "statement pipeline Pipeline: Database is required", func() {
+		NewStatementPipeline(stack, "Pipeline", &StatementPipelineProps{})
+	})
+
+	// The lambdas connect to a proxy as a given user
+	database := newDatabaseProps(stack)
+	database.Proxy = awsrds.DatabaseProxy_FromDatabaseProxyAttributes(stack, jsii.String("Proxy"), &awsrds.DatabaseProxyAttributes{
+		DbProxyArn:  jsii.String("arn:aws:rds:us-east-1:123456789012:db-proxy:prx-0123456789abcdef"),
+		DbProxyName: jsii.String("proxy"),
+		Endpoint:    jsii.String("proxy.local"),
+		SecurityGroups: &[]awsec2.ISecurityGroup{
+			awsec2.SecurityGroup_FromSecurityGroupId(stack, jsii.String("ProxySecurityGroup"), jsii.String("sg-0123456789abcdef"), nil),
+		},
+	})
+	require.PanicsWithValue(t, "statement pipeline Pipeline: Database.User is required with a Proxy", func() {
+		NewStatementPipeline(stack, "Pipeline", &StatementPipelineProps{Database: database})
+	})
+}
+
+func TestStatementPipelineStateMachineArchivesLast(t *testing.T) {
+	app := awscdk.NewApp(nil)
+	stack := awscdk.NewStack(app, jsii.String("StateMachineStack"), nil)
+	NewStatementPipeline(stack, "Pipeline", &StatementPipelineProps{Database: newDatabaseProps(stack), CodeDir: ".."})
+
+	// The definition is joined with the ARNs of the lambdas, replaced by a placeholder to read it as JSON
+	template := assertions.Template_FromStack(stack, nil)
+	stateMachines := template.FindResources(jsii.String("AWS::StepFunctions::StateMachine"), nil)
+	require.Len(t, *stateMachines, 1)
+	var definition strings.Builder
+	for _, resource := range *stateMachines {
+		join := (*resource)["Properties"].(map[string]interface{})["DefinitionString"].(map[string]interface{})["Fn::Join"].([]interface{})
+		for _, part := range join[1].([]interface{}) {
+			if text, ok := part.(string); ok {
+				definition.WriteString(text)
+			} else {
+				definition.WriteString("token")
+			}
+		}
+	}
+
+	var machine struct {
+		States map[string]struct {
+			Next       string
+			Parameters map[string]interface{}
+			Catch      []struct{ Next string }
+		}
+	}
+	require.NoError(t, json.Unmarshal([]byte(definition.String()), &machine))
+
+	// The input file is archived once notified, not when parsed
+	require.Equal(t, "Store", machine.States["Parse"].Next)
+	require.Equal(t, "Archive", machine.States["Notify"].Next)
+	require.Equal(t, "Done", machine.States["Archive"].Next)
+	require.Equal(t, summary.OutcomeProcessed, machine.States["Archive"].Parameters["Outcome"])
+
+	// and quarantined before failing when storing or notifying failed
+	require.Equal(t, "ParseFailed", machine.States["Parse"].Catch[0].Next)
+	for step, quarantine := range map[string]string{"Store": "QuarantineStoreFailure", "Notify": "QuarantineNotifyFailure"} {
+		require.Equal(t, quarantine, machine.States[step].Catch[0].Next, step)
+		require.Equal(t, step+"Failed", machine.States[quarantine].Next, step)
+		require.Equal(t, summary.OutcomeQuarantined, machine.States[quarantine].Parameters["Outcome"])
+	}
+}
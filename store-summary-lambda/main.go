@@ -2,100 +2,82 @@ package main
 
 import (
 	"context"
-	"database/sql"
 	"encoding/json"
 	"fmt"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
 	"os"
-	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
-	_ "github.com/lib/pq"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqsTypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"stori-challenge/pipeline"
+	"stori-challenge/runs"
+	"stori-challenge/summary"
 )
 
-type SummaryData struct {
-	TotalBalance        float64
-	TransactionsByMonth map[string]int
-	AvgCreditsByMonth   map[string]float64
-	AvgDebitsByMonth    map[string]float64
-	DebitTotal          float64
-	CreditTotal         float64
-}
-
 func main() {
-	lambda.Start(handler)
-}
-
-// handler function that stores summary data into a PostgreSQL database using a secret retrieved from AWS Secrets Manager.
-func handler(ctx context.Context, summaryData *SummaryData) error {
-	secretName := os.Getenv("SECRET_ARN")            // retrieve the name of the secret from an environment variable
-	err := storeSummaryData(summaryData, secretName) // call function to store the summary data using the secret
-	if err != nil {
-		return fmt.Errorf("failed to store summary data: %v", err)
+	cfg, db := pipeline.Bootstrap(context.Background())
+	tracker := runs.Tracker{DB: db}
+	handler := &Handler{
+		Storer: &pipeline.Storer{
+			Summaries: &pipeline.Postgres{DB: db},
+			Tracker:   tracker,
+		},
+		SQS:          sqs.NewFromConfig(cfg),
+		SendQueueURL: os.Getenv("SEND_QUEUE_URL"),
 	}
 
-	return nil // return nil to indicate success
+	lambda.Start(handler.Handle)
 }
 
-func storeSummaryData(summaryData *SummaryData, secretName string) error {
-	var dbParams map[string]interface{}
-	cfg, err := config.LoadDefaultConfig(context.Background())
-	if err != nil {
-		return fmt.Errorf("failed to load configuration: %w", err)
-	}
+// Handler stores summary data into the PostgreSQL database, connecting through the RDS Proxy with IAM auth tokens.
+type Handler struct {
+	Storer *pipeline.Storer
+	// SQS and SendQueueURL chain the send step after the store step with the queue orchestration, so the email of
+	// a run is only sent once its summary is stored and carries its record id.
+	SQS          pipeline.MessageSender
+	SendQueueURL string
+}
 
-	smClient := secretsmanager.NewFromConfig(cfg)
-	smOutput, err := smClient.GetSecretValue(context.Background(), &secretsmanager.GetSecretValueInput{SecretId: aws.String(secretName)})
-	if err != nil {
-		return fmt.Errorf("failed to get secret: %w", err)
+// Handle routes batches from the store queue to storeAndForward, and direct or state machine invocations to the
+// storer, which returns the message with the record id set.
+func (h *Handler) Handle(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	if sqsEvent, ok := pipeline.SQSEvent(payload); ok {
+		return pipeline.HandleSQSEvent(ctx, sqsEvent, h.storeAndForward), nil
 	}
 
-	err = json.Unmarshal([]byte(*smOutput.SecretString), &dbParams)
-	if err != nil {
-		return err
+	var message summary.Message
+	if err := json.Unmarshal(payload, &message); err != nil {
+		return nil, fmt.Errorf("failed to decode summary message: %w", err)
 	}
 
-	connStr := fmt.Sprintf(
-		"host=%s port=%d dbname=postgres user=%s password=%s sslmode=require", // construct the connection string for the database
-		dbParams["host"].(string), int(dbParams["port"].(float64)), dbParams["username"].(string), dbParams["password"].(string))
-
-	db, err := sql.Open("postgres", connStr)
-	if err != nil {
-		return fmt.Errorf("failed to open database connection: %v", err)
-	}
-	defer db.Close()
+	return h.Storer.Store(ctx, &message)
+}
 
-	// Convert maps to JSON strings
-	transactionsByMonthJSON, err := json.Marshal(summaryData.TransactionsByMonth)
-	if err != nil {
-		return err
-	}
-	avgCreditsByMonthJSON, err := json.Marshal(summaryData.AvgCreditsByMonth)
+// storeAndForward stores the summary of a queued message and sends it on to the send queue. Storing is idempotent
+// per run, so a message whose forwarding failed is simply stored again when retried.
+func (h *Handler) storeAndForward(ctx context.Context, message *summary.Message) error {
+	stored, err := h.Storer.Store(ctx, message)
 	if err != nil {
 		return err
 	}
-	avgDebitsByMonthJSON, err := json.Marshal(summaryData.AvgDebitsByMonth)
+
+	data, err := json.Marshal(stored)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to marshal summary message: %w", err)
 	}
 
-	query := `
-	INSERT INTO summary_records (debit_total, credit_total, transactions_by_month, avg_credits_by_month, avg_debits_by_month, total_balance, created_at)
-	VALUES ($1, $2, $3, $4, $5, $6, $7)`
-
-	date := time.Now().Format("02-01-2006")
-
-	res, err := db.Exec(query, summaryData.DebitTotal, summaryData.CreditTotal, transactionsByMonthJSON,
-		avgCreditsByMonthJSON, avgDebitsByMonthJSON, summaryData.TotalBalance, date) // execute the SQL query to insert the summary data into the database
+	_, err = h.SQS.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(h.SendQueueURL),
+		MessageBody: aws.String(string(data)),
+		MessageAttributes: map[string]sqsTypes.MessageAttributeValue{
+			"account": {DataType: aws.String("String"), StringValue: aws.String(stored.Account)},
+			"run-id":  {DataType: aws.String("String"), StringValue: aws.String(stored.RunID)},
+		},
+	})
 	if err != nil {
-		return fmt.Errorf("failed to insert summary data into the database: %v", err)
+		return fmt.Errorf("failed to forward summary message to the send queue: %w", err)
 	}
 
-	recIns, _ := res.RowsAffected()
-
-	fmt.Printf("Successfully inserted to db: %v rows affected", recIns)
-
 	return nil
 }
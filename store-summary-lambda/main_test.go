@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/stretchr/testify/require"
+	"stori-challenge/pipeline"
+	"stori-challenge/summary"
+)
+
+// fakeSummaries stores every run but the ones listed in fail.
+type fakeSummaries struct {
+	stored []string
+	fail   map[string]bool
+}
+
+func (f *fakeSummaries) StoreSummary(_ context.Context, message *summary.Message) (int64, error) {
+	if f.fail[message.RunID] {
+		return 0, errors.New("connection refused")
+	}
+	f.stored = append(f.stored, message.RunID)
+
+	return int64(len(f.stored)), nil
+}
+
+// fakeSQS records the forwarded messages.
+type fakeSQS struct {
+	sent []*sqs.SendMessageInput
+	err  error
+}
+
+func (f *fakeSQS) SendMessage(_ context.Context, params *sqs.SendMessageInput, _ ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.sent = append(f.sent, params)
+
+	return &sqs.SendMessageOutput{}, nil
+}
+
+func newHandler(summaries *fakeSummaries) (*Handler, *fakeSQS) {
+	queue := &fakeSQS{}
+
+	return &Handler{Storer: &pipeline.Storer{Summaries: summaries}, SQS: queue, SendQueueURL: "https://sqs.local/send"}, queue
+}
+
+func TestHandleDirectInvocation(t *testing.T) {
+	handler, queue := newHandler(&fakeSummaries{})
+
+	response, err := handler.Handle(context.Background(), json.RawMessage(`{"RunID":"run-1","Account":"acme"}`))
+	require.NoError(t, err)
+
+	stored, ok := response.(*summary.Message)
+	require.True(t, ok, "expected a *summary.Message, got %T", response)
+	require.Equal(t, int64(1), stored.RecordID)
+	require.Equal(t, "acme", stored.Account)
+	require.Empty(t, queue.sent, "the state machine and the process lambda chain the send step")
+}
+
+func TestHandleDirectInvocationFailure(t *testing.T) {
+	handler, _ := newHandler(&fakeSummaries{fail: map[string]bool{"run-1": true}})
+
+	_, err := handler.Handle(context.Background(), json.RawMessage(`{"RunID":"run-1"}`))
+	require.ErrorContains(t, err, "connection refused")
+}
+
+func TestHandleSQSEventReportsFailedMessages(t *testing.T) {
+	summaries := &fakeSummaries{fail: map[string]bool{"run-2": true}}
+	handler, queue := newHandler(summaries)
+
+	payload, err := json.Marshal(events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "m1", EventSource: "aws:sqs", Body: `{"RunID":"run-1"}`},
+		{MessageId: "m2", EventSource: "aws:sqs", Body: `{"RunID":"run-2"}`},
+		{MessageId: "m3", EventSource: "aws:sqs", Body: `not json`},
+	}})
+	require.NoError(t, err)
+
+	response, err := handler.Handle(context.Background(), payload)
+	require.NoError(t, err)
+	require.Equal(t, events.SQSEventResponse{BatchItemFailures: []events.SQSBatchItemFailure{
+		{ItemIdentifier: "m2"},
+		{ItemIdentifier: "m3"},
+	}}, response)
+	require.Equal(t, []string{"run-1"}, summaries.stored)
+
+	// Only the stored summary goes on to the send queue, with its record id
+	require.Len(t, queue.sent, 1)
+	require.Equal(t, "https://sqs.local/send", aws.ToString(queue.sent[0].QueueUrl))
+	var forwarded summary.Message
+	require.NoError(t, json.Unmarshal([]byte(aws.ToString(queue.sent[0].MessageBody)), &forwarded))
+	require.Equal(t, "run-1", forwarded.RunID)
+	require.Equal(t, int64(1), forwarded.RecordID)
+}
+
+func TestHandleSQSEventRetriesWhenForwardFails(t *testing.T) {
+	summaries := &fakeSummaries{}
+	handler, queue := newHandler(summaries)
+	queue.err = errors.New("AccessDenied")
+
+	payload, err := json.Marshal(events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "m1", EventSource: "aws:sqs", Body: `{"RunID":"run-1"}`},
+	}})
+	require.NoError(t, err)
+
+	response, err := handler.Handle(context.Background(), payload)
+	require.NoError(t, err)
+	require.Equal(t, events.SQSEventResponse{BatchItemFailures: []events.SQSBatchItemFailure{{ItemIdentifier: "m1"}}}, response)
+}
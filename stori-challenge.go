@@ -1,22 +1,18 @@
 package main
 
 import (
+	"fmt"
+
 	"github.com/aws/aws-cdk-go/awscdk/v2"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsec2"
-	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
-	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
-	"github.com/aws/aws-cdk-go/awscdk/v2/awslogs"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsrds"
-	"github.com/aws/aws-cdk-go/awscdk/v2/awss3"
-	"github.com/aws/aws-cdk-go/awscdk/v2/awss3assets"
-	"github.com/aws/aws-cdk-go/awscdk/v2/awss3notifications"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awssecretsmanager"
-	"github.com/aws/aws-cdk-go/awscdk/v2/customresources"
-	"os"
-
+	"github.com/aws/aws-cdk-go/awscdk/v2/awssns"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awssnssubscriptions"
 	"github.com/aws/constructs-go/constructs/v10"
 	"github.com/aws/jsii-runtime-go"
 	"stori-challenge/config"
+	"stori-challenge/statementpipeline"
 )
 
 type StoriChallengeStackProps struct {
@@ -30,206 +26,192 @@ func NewStoriChallengeStack(scope constructs.Construct, id string, props *StoriC
 	}
 	stack := awscdk.NewStack(scope, &id, &sprops)
 
+	// The configuration is read from the stack so the overrides of an environment stage apply
+	cfg, err := config.Load(stack)
+	if err != nil {
+		panic(err)
+	}
+
 	/* -----------------------------------------------------------------------------------------------------------------
 	    RESOURCE DEFINITION
 
 	-------------------------------------------------------------------------------------------------------------------*/
 
 	// Create a VPC for the RDS instance and Lambda functions
-	vpc := awsec2.NewVpc(stack, jsii.String("StoriVPC"), &awsec2.VpcProps{
-		MaxAzs: jsii.Number(2),
-	})
+	network := newNetwork(stack, cfg)
+	vpc := network.Vpc
 
 	rdsSecurityGroup := awsec2.NewSecurityGroup(stack, jsii.String("RdsSecurityGroup"), &awsec2.SecurityGroupProps{
 		Vpc: vpc,
 	})
 
-	// Create an S3 bucket
-	bucket := awss3.NewBucket(stack, jsii.String("storiChallenge-bucket"), &awss3.BucketProps{
-		Versioned: jsii.Bool(false),
-	})
-
-	// Secret for db details
-	rdsSecret := awssecretsmanager.NewSecret(stack, jsii.String("StoriRdsInstanceSecret"), &awssecretsmanager.SecretProps{
-		SecretObjectValue: &map[string]awscdk.SecretValue{
-			"username": awscdk.SecretValue_UnsafePlainText(jsii.String(config.DBUser(stack))),
-			"password": awscdk.SecretValue_UnsafePlainText(jsii.String(config.DBPass(stack))),
-		},
-	})
+	// Protected environments keep a snapshot of the database when it gets deleted
+	deletionProtection := cfg.DeletionProtection
+	removalPolicy := awscdk.RemovalPolicy_DESTROY
+	if deletionProtection {
+		removalPolicy = awscdk.RemovalPolicy_SNAPSHOT
+	}
 
-	// Create an RDS PostgreSQL instance
-	awsrds.NewDatabaseInstance(stack, jsii.String("StoriRdsInstance"), &awsrds.DatabaseInstanceProps{
+	// Create an RDS PostgreSQL instance, its password is generated by Secrets Manager and never leaves the secret
+	rdsInstance := awsrds.NewDatabaseInstance(stack, jsii.String("StoriRdsInstance"), &awsrds.DatabaseInstanceProps{
 		Engine: awsrds.DatabaseInstanceEngine_Postgres(&awsrds.PostgresInstanceEngineProps{
 			Version: awsrds.PostgresEngineVersion_VER_15_2(),
 		}),
-		InstanceType: awsec2.NewInstanceType(jsii.String("t3.micro")),
-		Vpc:          vpc,
-		Credentials:  awsrds.Credentials_FromSecret(rdsSecret, jsii.String(config.DBUser(stack))),
+		InstanceType:     awsec2.NewInstanceType(jsii.String(cfg.DBInstanceType)),
+		AllocatedStorage: jsii.Number(cfg.DBAllocatedStorage),
+		MultiAz:          jsii.Bool(cfg.DBMultiAz),
+		BackupRetention:  awscdk.Duration_Days(jsii.Number(cfg.DBBackupRetentionDays)),
+		Vpc:              vpc,
+		VpcSubnets:       network.DatabaseSubnets,
+		Credentials:      awsrds.Credentials_FromGeneratedSecret(jsii.String(cfg.DBUser), nil),
 		SecurityGroups: &[]awsec2.ISecurityGroup{
 			rdsSecurityGroup,
 		},
-		DatabaseName:       jsii.String(config.DBName(stack)),
-		PubliclyAccessible: jsii.Bool(true),
-		DeletionProtection: jsii.Bool(false),
-		RemovalPolicy:      awscdk.RemovalPolicy_DESTROY,
+		DatabaseName:       jsii.String(cfg.DBName),
+		PubliclyAccessible: jsii.Bool(false),
+		DeletionProtection: jsii.Bool(deletionProtection),
+		RemovalPolicy:      removalPolicy,
 	})
+	rdsSecret := rdsInstance.Secret()
 
-	// Create the init-lambda function
-	initLambda := awslambda.NewFunction(stack, jsii.String("InitLambda"), &awslambda.FunctionProps{
-		Runtime: awslambda.Runtime_GO_1_X(),
-		Code:    awslambda.Code_FromAsset(jsii.String("init-lambda"), nil),
-		Handler: jsii.String("main"),
-		Environment: &map[string]*string{
-			"SECRET_ARN":  rdsSecret.SecretArn(),
-			"BUCKET_NAME": bucket.BucketName(),
-		},
-		Vpc:               vpc,
-		AllowPublicSubnet: jsii.Bool(true),
-	})
-
-	// Create the process-csv-lambda function
-	sendSummaryLambda := awslambda.NewFunction(stack, jsii.String("SendSummaryLambda"), &awslambda.FunctionProps{
-		Runtime: awslambda.Runtime_GO_1_X(),
-		Code:    awslambda.Code_FromAsset(jsii.String("send-summary-lambda"), nil),
-		Handler: jsii.String("main"),
-		Environment: &map[string]*string{
-			"BUCKET_NAME":  bucket.BucketName(),
-			"TEMPLATE_KEY": jsii.String("email_template.html"),
-			"USE_SES":      jsii.String(config.EnableSES(stack)),
-			"SENDER":       jsii.String(config.SenderEmail(stack)),
-			"RECIPIENT":    jsii.String(config.RecipientEmail(stack)),
-		},
-		Vpc: vpc,
+	// Rotate the password with the single user rotation lambda, the lambdas read the secret again once it changed
+	rdsInstance.AddRotationSingleUser(&awsrds.RotationSingleUserOptions{
+		AutomaticallyAfter: awscdk.Duration_Days(jsii.Number(cfg.DBPasswordRotationDays)),
+		VpcSubnets:         network.LambdaSubnets,
+		Endpoint:           network.SecretsManagerEndpoint,
 	})
 
-	// Create store-summary-lambda
-	storeSummaryLambda := awslambda.NewFunction(stack, jsii.String("StoreSummaryLambda"), &awslambda.FunctionProps{
-		Runtime:      awslambda.Runtime_GO_1_X(),
-		Code:         awslambda.Code_FromAsset(jsii.String("store-summary-lambda"), &awss3assets.AssetOptions{}),
-		Handler:      jsii.String("main"),
-		Timeout:      awscdk.Duration_Seconds(jsii.Number(30)),
-		LogRetention: awslogs.RetentionDays_ONE_WEEK,
-		Environment: &map[string]*string{
-			"SECRET_ARN": rdsSecret.SecretArn(),
-		},
+	// The lambdas connect through an RDS Proxy pooling the connections to the instance, authenticating with IAM
+	proxySecurityGroup := awsec2.NewSecurityGroup(stack, jsii.String("RdsProxySecurityGroup"), &awsec2.SecurityGroupProps{
 		Vpc: vpc,
 	})
-
-	// Create the process-csv-lambda function
-	processCsvLambda := awslambda.NewFunction(stack, jsii.String("ProcessCsvLambda"), &awslambda.FunctionProps{
-		Runtime: awslambda.Runtime_GO_1_X(),
-		Code:    awslambda.Code_FromAsset(jsii.String("process-csv-lambda"), nil),
-		Handler: jsii.String("main"),
-		Environment: &map[string]*string{
-			"SEND_ARN":  sendSummaryLambda.FunctionArn(),
-			"STORE_ARN": storeSummaryLambda.FunctionArn(),
-		},
-		AllowPublicSubnet: jsii.Bool(true),
-		Vpc:               vpc,
+	rdsProxy := rdsInstance.AddProxy(jsii.String("StoriRdsProxy"), &awsrds.DatabaseProxyOptions{
+		// Proxy names are unique per account and region, the path of the instance tells the environments apart
+		DbProxyName: awscdk.Names_UniqueResourceName(rdsInstance, &awscdk.UniqueResourceNameOptions{
+			MaxLength: jsii.Number(63),
+			Separator: jsii.String("-"),
+		}),
+		Secrets:        &[]awssecretsmanager.ISecret{rdsSecret},
+		Vpc:            vpc,
+		VpcSubnets:     network.DatabaseSubnets,
+		SecurityGroups: &[]awsec2.ISecurityGroup{proxySecurityGroup},
+		IamAuth:        jsii.Bool(true),
+		RequireTLS:     jsii.Bool(true),
 	})
+	rdsInstance.Connections().AllowDefaultPortFrom(proxySecurityGroup, jsii.String("Allow RDS Proxy to access RDS instance"))
 
-	/* -----------------------------------------------------------------------------------------------------------------
-	    PERMISSION GRANTING
-
-	-------------------------------------------------------------------------------------------------------------------*/
-
-	initLambda.Connections().AllowTo(rdsSecurityGroup, awsec2.Port_Tcp(jsii.Number(5432)), jsii.String("Allow Lambda to access RDS instance"))
-	storeSummaryLambda.Connections().AllowTo(rdsSecurityGroup, awsec2.Port_Tcp(jsii.Number(5432)), jsii.String("Allow Lambda to access RDS instance"))
-
-	// Attach the IAM policy to the init-lambda function's execution role
-	bucket.GrantReadWrite(initLambda, "*")
-
-	bucket.GrantRead(processCsvLambda, "*")
-
-	bucket.GrantReadWrite(sendSummaryLambda, "*")
-
-	rdsSecret.GrantRead(initLambda, nil)
-
-	rdsSecret.GrantRead(storeSummaryLambda, nil)
-
-	// Attach the IAM policy to the process-csv-lambda function's execution role
-	bucket.GrantPut(initLambda, "*")
-
-	// Grant permission for process-csv-lambda to invoke store-summary-lambda
-	storeSummaryLambda.GrantInvoke(processCsvLambda)
+	// The alarms of the pipeline notify this topic, subscribe to it to get paged
+	alarmTopic := awssns.NewTopic(stack, jsii.String("AlarmTopic"), &awssns.TopicProps{})
+	if cfg.AlarmEmail != "" {
+		alarmTopic.AddSubscription(awssnssubscriptions.NewEmailSubscription(jsii.String(cfg.AlarmEmail), nil))
+	}
 
-	// Grant permission for process-csv-lambda to invoke send-summary-lambda
-	sendSummaryLambda.GrantInvoke(processCsvLambda)
-	//processCsvLambda.GrantInvoke(sendSummaryLambda)
+	// Per account brands resolve against the account the stack deploys to, the one of its environment stage or of
+	// the CLI, an environment agnostic stack gets the default brand
+	account := ""
+	if !*awscdk.Token_IsUnresolved(stack.Account()) {
+		account = *stack.Account()
+	}
 
-	// Configure the security group to allow connections between Lambda functions and RDS instance
-	lambdaSecurityGroup := awsec2.NewSecurityGroup(stack, jsii.String("LambdaSecurityGroup"), &awsec2.SecurityGroupProps{
-		Vpc: vpc,
+	// Everything past the database lives in the statement pipeline construct
+	statementPipeline := statementpipeline.NewStatementPipeline(stack, "StatementPipeline", &statementpipeline.StatementPipelineProps{
+		Database: &statementpipeline.DatabaseProps{
+			Vpc:           vpc,
+			LambdaSubnets: network.LambdaSubnets,
+			SecurityGroup: proxySecurityGroup,
+			Secret:        rdsSecret,
+			Proxy:         rdsProxy,
+			User:          cfg.DBUser,
+			Name:          cfg.DBName,
+		},
+		Notifier: &statementpipeline.NotifierProps{
+			EnableSES:       cfg.EnableSES,
+			Sender:          cfg.SenderEmail,
+			Recipient:       cfg.RecipientEmail,
+			Brand:           cfg.Brand(account),
+			TemplateVersion: cfg.EmailTemplateVersion,
+		},
+		Orchestration: cfg.Orchestration,
+		LogRetention:  cfg.LogRetention(),
+		LogEmails:     cfg.LogEmails,
+		AlarmTopic:    alarmTopic,
 	})
-	processCsvLambda.Connections().AddSecurityGroup(lambdaSecurityGroup)
-	sendSummaryLambda.Connections().AddSecurityGroup(lambdaSecurityGroup)
-	storeSummaryLambda.Connections().AddSecurityGroup(lambdaSecurityGroup)
-	initLambda.Connections().AddSecurityGroup(lambdaSecurityGroup)
-
-	lambdaSecurityGroup.AddIngressRule(awsec2.Peer_SecurityGroupId(rdsSecurityGroup.SecurityGroupId(), stack.Account()),
-		awsec2.Port_Tcp(jsii.Number(5432)), jsii.String("Allow Lambda to access RDS instance"), jsii.Bool(false))
 
-	// Grant send email permission to the Lambda function
-	sendSummaryLambda.AddToRolePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
-		Actions:   &[]*string{jsii.String("ses:SendEmail"), jsii.String("ses:SendRawEmail")},
-		Resources: &[]*string{jsii.String("*")},
-	}))
-
-	/* -----------------------------------------------------------------------------------------------------------------
-	    RESOURCE HELPERS
-
-	-------------------------------------------------------------------------------------------------------------------*/
+	if cfg.Orchestration == config.OrchestrationQueue {
+		newQueueOutputs(stack, "StoreSummary", statementPipeline.StoreSummaryQueue)
+		newQueueOutputs(stack, "SendSummary", statementPipeline.SendSummaryQueue)
+	}
 
-	// Create the custom resource to trigger the init Lambda
-	initTrigger := customresources.NewAwsCustomResource(stack, jsii.String("InitLambdaTrigger"), &customresources.AwsCustomResourceProps{
-		OnCreate: &customresources.AwsSdkCall{
-			Service: jsii.String("Lambda"),
-			Action:  jsii.String("invoke"),
-			Parameters: map[string]interface{}{
-				"FunctionName": initLambda.FunctionArn(),
-			},
-			PhysicalResourceId: customresources.PhysicalResourceId_Of(jsii.String("init-lambda")),
-		},
-		Policy: customresources.AwsCustomResourcePolicy_FromStatements(&[]awsiam.PolicyStatement{awsiam.NewPolicyStatement(
-			&awsiam.PolicyStatementProps{
-				Actions:   &[]*string{jsii.String("lambda:InvokeFunction")},
-				Resources: &[]*string{initLambda.FunctionArn()},
-			})}),
+	awscdk.NewCfnOutput(stack, jsii.String("AlarmTopicArn"), &awscdk.CfnOutputProps{
+		Value:       alarmTopic.TopicArn(),
+		Description: jsii.String("Topic notified by the alarms of the pipeline"),
+	})
+	awscdk.NewCfnOutput(stack, jsii.String("DashboardUrl"), &awscdk.CfnOutputProps{
+		Value: jsii.String(fmt.Sprintf("https://%s.console.aws.amazon.com/cloudwatch/home?region=%s#dashboards:name=%s",
+			*stack.Region(), *stack.Region(), *statementPipeline.Dashboard.DashboardName())),
 	})
 
-	// Add rds instance secret as custom resource dependency
-	initTrigger.Node().AddDependency(rdsSecret)
+	awscdk.NewCfnOutput(stack, jsii.String("UnsubscribeUrl"), &awscdk.CfnOutputProps{
+		Value:       statementPipeline.UnsubscribeURL.Url(),
+		Description: jsii.String("Endpoint handling the unsubscribe links included in the emails"),
+	})
+	awscdk.NewCfnOutput(stack, jsii.String("ProcessCsvLambdaName"), &awscdk.CfnOutputProps{
+		Value:       statementPipeline.ProcessCsvLambda.FunctionName(),
+		Description: jsii.String("Read the processing runs with: stori runs -function <this name>"),
+	})
 
-	// Configure the S3 bucket to trigger the process CSV Lambda when a file is uploaded
-	bucket.AddEventNotification(
-		awss3.EventType_OBJECT_CREATED_PUT,
-		awss3notifications.NewLambdaDestination(processCsvLambda),
-		&awss3.NotificationKeyFilter{
-			Prefix: jsii.String("input/"),
-		},
-	)
+	// Stacks deployed before the pipeline was extracted into its construct must not get their resources replaced
+	keepLogicalIDs(stack, statementPipeline)
 
 	return stack
 }
 
+// newQueueOutputs outputs the URLs of a consumer queue and its dead-letter queue, used by 'stori redrive'.
+func newQueueOutputs(stack awscdk.Stack, name string, consumer statementpipeline.ConsumerQueue) {
+	awscdk.NewCfnOutput(stack, jsii.String(name+"QueueUrl"), &awscdk.CfnOutputProps{
+		Value: consumer.Queue.QueueUrl(),
+	})
+	awscdk.NewCfnOutput(stack, jsii.String(name+"DLQUrl"), &awscdk.CfnOutputProps{
+		Value:       consumer.DeadLetterQueue.QueueUrl(),
+		Description: jsii.String("Redrive with: stori redrive -from <this url> -to <" + name + "QueueUrl>"),
+	})
+}
+
 func main() {
 	defer jsii.Close()
 
 	app := awscdk.NewApp(nil)
 
-	NewStoriChallengeStack(app, config.StackName(app), &StoriChallengeStackProps{
-		awscdk.StackProps{
-			Env: env(),
-		},
-	})
+	environments, err := config.Environments(app)
+	if err != nil {
+		panic(err)
+	}
 
-	app.Synth(nil)
-}
+	// Without environments a single stack is deployed to the account and region of the CLI
+	if len(environments) == 0 {
+		NewStoriChallengeStack(app, stackName(app), &StoriChallengeStackProps{
+			awscdk.StackProps{
+				Env: environmentEnv("", ""),
+			},
+		})
 
-func env() *awscdk.Environment {
+		app.Synth(nil)
+		return
+	}
 
-	return &awscdk.Environment{
-		Account: jsii.String(os.Getenv("CDK_DEFAULT_ACCOUNT")),
-		Region:  jsii.String(os.Getenv("CDK_DEFAULT_REGION")),
+	// The pipeline deploys every environment, otherwise a stage is synthesized per selected environment
+	if deployment, ok := config.Pipeline(app); ok {
+		NewDeploymentPipelineStack(app, stackName(app)+"Pipeline", deployment, environments)
+	} else {
+		selected, err := config.SelectedEnvironments(app, environments)
+		if err != nil {
+			panic(err)
+		}
+
+		for _, environment := range selected {
+			NewEnvironmentStage(app, environment)
+		}
 	}
+
+	app.Synth(nil)
 }
@@ -1,36 +1,630 @@
 package main
 
 import (
+	"reflect"
+	"regexp"
 	"testing"
 
 	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/assertions"
 	"github.com/aws/jsii-runtime-go"
 	"github.com/stretchr/testify/require"
+	"stori-challenge/templates"
 )
 
 func TestStoriChallengeStack(t *testing.T) {
 	// Create a new app for testing
-	app := awscdk.NewApp(nil)
+	app := awscdk.NewApp(&awscdk.AppProps{Context: testContext(nil)})
 
 	// Create a new StoriChallengeStack with the app
 	stack := NewStoriChallengeStack(app, "TestStack", nil)
 
 	// Test if resources exist in the stack
-	bucket := stack.Node().TryFindChild(jsii.String("storiChallenge-bucket"))
-	require.NotNil(t, bucket, "S3 bucket not found in stack")
-
 	rdsInstance := stack.Node().TryFindChild(jsii.String("StoriRdsInstance"))
 	require.NotNil(t, rdsInstance, "RDS instance not found in stack")
 
-	initLambda := stack.Node().TryFindChild(jsii.String("InitLambda"))
-	require.NotNil(t, initLambda, "InitLambda not found in stack")
+	pipeline := stack.Node().TryFindChild(jsii.String("StatementPipeline"))
+	require.NotNil(t, pipeline, "StatementPipeline not found in stack")
+
+	for _, id := range append(lambdaIDs, "Bucket", "PipelineStateMachine") {
+		require.NotNil(t, pipeline.Node().TryFindChild(jsii.String(id)), "%s not found in pipeline", id)
+	}
+}
+
+func TestStoriChallengeStackQueueOrchestration(t *testing.T) {
+	app := awscdk.NewApp(&awscdk.AppProps{
+		Context: testContext(map[string]interface{}{"orchestration": "queue", "alarmEmail": "ops@example.com"}),
+	})
+
+	stack := NewStoriChallengeStack(app, "TestStack", nil)
+
+	pipeline := stack.Node().TryFindChild(jsii.String("StatementPipeline"))
+	for _, id := range []string{"SummaryTopic", "StoreSummaryQueue", "StoreSummaryDLQ", "SendSummaryQueue", "SendSummaryDLQ"} {
+		require.NotNil(t, pipeline.Node().TryFindChild(jsii.String(id)), "%s not found in pipeline", id)
+	}
+
+	stateMachine := pipeline.Node().TryFindChild(jsii.String("PipelineStateMachine"))
+	require.Nil(t, stateMachine, "PipelineStateMachine should not be created with the queue orchestration")
+
+	template := assertions.Template_FromStack(stack, nil)
+	topicID := logicalID(t, template, "AWS::SNS::Topic", "SummaryTopic")
+
+	// The process lambda publishes to the summary topic instead of invoking the other lambdas
+	processActions := allowedActions(t, template, "ProcessCsvLambda")
+	require.Equal(t, []interface{}{ref(topicID)}, processActions["sns:Publish"])
+	require.NotContains(t, processActions, "lambda:InvokeFunction")
+	template.HasResourceProperties(jsii.String("AWS::Lambda::Function"), map[string]interface{}{
+		"Environment": map[string]interface{}{
+			"Variables": assertions.Match_ObjectLike(&map[string]interface{}{"SUMMARY_TOPIC_ARN": ref(topicID)}),
+		},
+	})
+
+	// The topic only feeds the store queue, the store lambda hands the stored summaries on to the send queue
+	storeQueueID := logicalID(t, template, "AWS::SQS::Queue", "StoreSummaryQueue")
+	sendQueueID := logicalID(t, template, "AWS::SQS::Queue", "SendSummaryQueue")
+	subscriptions := template.FindResources(jsii.String("AWS::SNS::Subscription"), map[string]interface{}{
+		"Properties": map[string]interface{}{"TopicArn": ref(topicID)},
+	})
+	require.Len(t, *subscriptions, 1)
+	for _, subscription := range *subscriptions {
+		require.Equal(t, getAtt(storeQueueID, "Arn"), (*subscription)["Properties"].(map[string]interface{})["Endpoint"])
+	}
+	require.Equal(t, []interface{}{getAtt(sendQueueID, "Arn")}, allowedActions(t, template, "StoreSummaryLambda")["sqs:SendMessage"])
+	template.HasResourceProperties(jsii.String("AWS::Lambda::Function"), map[string]interface{}{
+		"Environment": map[string]interface{}{
+			"Variables": assertions.Match_ObjectLike(&map[string]interface{}{"SEND_QUEUE_URL": ref(sendQueueID)}),
+		},
+	})
+
+	// Each consumer reports partial batch failures, and its queue hands failed messages to the dead-letter queue
+	for _, name := range []string{"StoreSummary", "SendSummary"} {
+		template.HasResourceProperties(jsii.String("AWS::Lambda::EventSourceMapping"), map[string]interface{}{
+			"EventSourceArn":        getAtt(logicalID(t, template, "AWS::SQS::Queue", name+"Queue"), "Arn"),
+			"FunctionName":          ref(logicalID(t, template, "AWS::Lambda::Function", name+"Lambda")),
+			"FunctionResponseTypes": []interface{}{"ReportBatchItemFailures"},
+			"BatchSize":             10,
+		})
+		template.HasResourceProperties(jsii.String("AWS::SQS::Queue"), map[string]interface{}{
+			"RedrivePolicy": map[string]interface{}{
+				"deadLetterTargetArn": getAtt(logicalID(t, template, "AWS::SQS::Queue", name+"DLQ"), "Arn"),
+				"maxReceiveCount":     3,
+			},
+		})
+	}
+
+	template.HasResourceProperties(jsii.String("Custom::S3BucketNotifications"), map[string]interface{}{
+		"NotificationConfiguration": map[string]interface{}{
+			"LambdaFunctionConfigurations": []interface{}{assertions.Match_ObjectLike(&map[string]interface{}{
+				"Filter": map[string]interface{}{"Key": map[string]interface{}{"FilterRules": []interface{}{
+					map[string]interface{}{"Name": "prefix", "Value": "input/"},
+				}}},
+			})},
+		},
+	})
+
+	// Messages landing in a dead-letter queue page the subscribers of the alarm topic
+	template.ResourceCountIs(jsii.String("AWS::CloudWatch::Alarm"), jsii.Number(float64(2*len(lambdaIDs)+2)))
+	for _, name := range []string{"StoreSummary", "SendSummary"} {
+		template.HasResourceProperties(jsii.String("AWS::CloudWatch::Alarm"), map[string]interface{}{
+			"MetricName": "ApproximateNumberOfMessagesVisible",
+			"Dimensions": []interface{}{map[string]interface{}{
+				"Name":  "QueueName",
+				"Value": getAtt(logicalID(t, template, "AWS::SQS::Queue", name+"DLQ"), "QueueName"),
+			}},
+			"Threshold": 1,
+		})
+	}
+	template.HasResourceProperties(jsii.String("AWS::SNS::Subscription"), map[string]interface{}{
+		"Protocol": "email",
+		"Endpoint": "ops@example.com",
+		"TopicArn": ref(logicalID(t, template, "AWS::SNS::Topic", "AlarmTopic")),
+	})
+}
+
+// testContext returns the context values along with the ones every valid configuration needs.
+func testContext(values map[string]interface{}) *map[string]interface{} {
+	context := map[string]interface{}{
+		"senderEmail":    "sender@example.com",
+		"recipientEmail": "recipient@example.com",
+	}
+	for key, value := range values {
+		context[key] = value
+	}
+
+	return &context
+}
+
+// lambdaIDs are the construct ids of every lambda of the stack.
+var lambdaIDs = []string{"InitLambda", "UnsubscribeLambda", "SesEventsLambda", "SendSummaryLambda", "StoreSummaryLambda", "ProcessCsvLambda"}
+
+// synth synthesizes the stack with the context values and returns its template.
+func synth(context map[string]interface{}) assertions.Template {
+	app := awscdk.NewApp(&awscdk.AppProps{Context: testContext(context)})
+	stack := NewStoriChallengeStack(app, "TestStack", nil)
+
+	return assertions.Template_FromStack(stack, nil)
+}
+
+// logicalID returns the logical id CDK generated for the construct, the construct id followed by a hash.
+func logicalID(t *testing.T, template assertions.Template, resourceType, constructID string) string {
+	t.Helper()
+
+	pattern := regexp.MustCompile("^" + regexp.QuoteMeta(constructID) + "[0-9A-F]{8}$")
+	var ids []string
+	for id := range *template.FindResources(jsii.String(resourceType), nil) {
+		if pattern.MatchString(id) {
+			ids = append(ids, id)
+		}
+	}
+	require.Len(t, ids, 1, "%s %s not found", resourceType, constructID)
+
+	return ids[0]
+}
+
+func ref(id string) map[string]interface{} {
+	return map[string]interface{}{"Ref": id}
+}
+
+func getAtt(id, attribute string) map[string]interface{} {
+	return map[string]interface{}{"Fn::GetAtt": []interface{}{id, attribute}}
+}
+
+// allowedActions returns the actions allowed to the execution role of the lambda, along with the resources of the
+// statements allowing them.
+func allowedActions(t *testing.T, template assertions.Template, lambdaID string) map[string][]interface{} {
+	t.Helper()
+
+	roleID := logicalID(t, template, "AWS::IAM::Role", lambdaID+"ServiceRole")
+	actions := make(map[string][]interface{})
+	for _, policy := range *template.FindResources(jsii.String("AWS::IAM::Policy"), nil) {
+		properties := (*policy)["Properties"].(map[string]interface{})
+		if !containsValue(properties["Roles"], ref(roleID)) {
+			continue
+		}
+
+		for _, statement := range properties["PolicyDocument"].(map[string]interface{})["Statement"].([]interface{}) {
+			statement := statement.(map[string]interface{})
+			require.Equal(t, "Allow", statement["Effect"])
+			for _, action := range toList(statement["Action"]) {
+				actions[action.(string)] = append(actions[action.(string)], toList(statement["Resource"])...)
+			}
+		}
+	}
+
+	return actions
+}
+
+func toList(value interface{}) []interface{} {
+	if list, ok := value.([]interface{}); ok {
+		return list
+	}
+
+	return []interface{}{value}
+}
+
+func containsValue(list interface{}, value interface{}) bool {
+	for _, item := range toList(list) {
+		if reflect.DeepEqual(item, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestStoriChallengeTemplate(t *testing.T) {
+	template := synth(nil)
+
+	bucketID := logicalID(t, template, "AWS::S3::Bucket", "storiChallengebucket")
+	// The proxy gets the secret through its attachment to the instance, which adds the host and port
+	secretID := logicalID(t, template, "AWS::SecretsManager::SecretTargetAttachment", "StoriRdsInstanceSecretAttachment")
+	proxyID := logicalID(t, template, "AWS::RDS::DBProxy", "StoriRdsInstanceStoriRdsProxy")
+	rdsSecurityGroupID := logicalID(t, template, "AWS::EC2::SecurityGroup", "RdsSecurityGroup")
+	proxySecurityGroupID := logicalID(t, template, "AWS::EC2::SecurityGroup", "RdsProxySecurityGroup")
+	functionIDs := make(map[string]string)
+	for _, id := range lambdaIDs {
+		functionIDs[id] = logicalID(t, template, "AWS::Lambda::Function", id)
+	}
+
+	t.Run("IAM policies", func(t *testing.T) {
+		proxyUser := map[string]interface{}{"Fn::Join": []interface{}{"", []interface{}{
+			"arn:", ref("AWS::Partition"), ":rds-db:", ref("AWS::Region"), ":", ref("AWS::AccountId"), ":dbuser:",
+			map[string]interface{}{"Fn::Select": []interface{}{6.0, map[string]interface{}{"Fn::Split": []interface{}{":", getAtt(proxyID, "DBProxyArn")}}}},
+			"/adminStori",
+		}}}
+		for _, id := range lambdaIDs {
+			actions := allowedActions(t, template, id)
+
+			// Every lambda connects to the proxy as the database user, and none reads the secret
+			require.Equal(t, []interface{}{proxyUser}, actions["rds-db:connect"], id)
+			require.NotContains(t, actions, "secretsmanager:GetSecretValue", id)
+
+			// Only the send lambda sends emails, and nothing invokes lambdas or publishes when the state machine
+			// drives the pipeline
+			_, sendsEmail := actions["ses:SendEmail"]
+			require.Equal(t, id == "SendSummaryLambda", sendsEmail, "%s ses:SendEmail", id)
+			require.NotContains(t, actions, "lambda:InvokeFunction", id)
+			require.NotContains(t, actions, "sns:Publish", id)
+
+			// and sends its traces
+			require.Equal(t, []interface{}{"*"}, actions["xray:PutTraceSegments"], id)
+			require.Equal(t, []interface{}{"*"}, actions["xray:PutTelemetryRecords"], id)
+		}
+
+		// The store, unsubscribe and ses events lambdas only talk to the database, besides tracing
+		for _, id := range []string{"StoreSummaryLambda", "UnsubscribeLambda", "SesEventsLambda"} {
+			actions := allowedActions(t, template, id)
+			delete(actions, "xray:PutTraceSegments")
+			delete(actions, "xray:PutTelemetryRecords")
+			require.Len(t, actions, 1, "%s should only connect to the database: %v", id, actions)
+		}
+
+		bucketObjects := map[string]interface{}{"Fn::Join": []interface{}{"", []interface{}{getAtt(bucketID, "Arn"), "/*"}}}
+		inputObjects := map[string]interface{}{"Fn::Join": []interface{}{"", []interface{}{getAtt(bucketID, "Arn"), "/input/*"}}}
+
+		processActions := allowedActions(t, template, "ProcessCsvLambda")
+		require.Contains(t, processActions["s3:GetObject*"], bucketObjects)
+		require.Contains(t, processActions["s3:PutObject"], bucketObjects)
+		require.Contains(t, processActions["s3:PutObjectTagging"], bucketObjects)
+		require.Contains(t, processActions["s3:DeleteObject*"], inputObjects)
+		// 'stori runs' reads the runs through the process lambda, the database is private to the VPC
+		template.HasOutput(jsii.String("ProcessCsvLambdaName"), map[string]interface{}{
+			"Value": ref(logicalID(t, template, "AWS::Lambda::Function", "ProcessCsvLambda")),
+		})
+
+		sendActions := allowedActions(t, template, "SendSummaryLambda")
+		require.Contains(t, sendActions["s3:GetObject*"], bucketObjects)
+		require.Contains(t, sendActions["s3:PutObject"], bucketObjects)
+		require.Contains(t, sendActions, "ses:SendRawEmail")
+
+		initActions := allowedActions(t, template, "InitLambda")
+		require.Contains(t, initActions["s3:PutObject"], bucketObjects)
+
+		// The state machine invokes the three pipeline lambdas
+		var invokeStatements []interface{}
+		for _, id := range []string{"ProcessCsvLambda", "StoreSummaryLambda", "SendSummaryLambda"} {
+			invokeStatements = append(invokeStatements, assertions.Match_ObjectLike(&map[string]interface{}{
+				"Action":   "lambda:InvokeFunction",
+				"Resource": assertions.Match_ArrayWith(&[]interface{}{getAtt(functionIDs[id], "Arn")}),
+			}))
+		}
+		template.HasResourceProperties(jsii.String("AWS::IAM::Policy"), map[string]interface{}{
+			"PolicyDocument": map[string]interface{}{
+				"Statement": assertions.Match_ArrayWith(&invokeStatements),
+			},
+			"Roles": []interface{}{ref(logicalID(t, template, "AWS::IAM::Role", "PipelineStateMachineRole"))},
+		})
+	})
+
+	t.Run("security groups", func(t *testing.T) {
+		// Every lambda reaches the proxy through its own security group and the shared one
+		for _, id := range append(lambdaIDs, "Lambda") {
+			template.HasResourceProperties(jsii.String("AWS::EC2::SecurityGroupIngress"), map[string]interface{}{
+				"GroupId":               getAtt(proxySecurityGroupID, "GroupId"),
+				"SourceSecurityGroupId": getAtt(logicalID(t, template, "AWS::EC2::SecurityGroup", id+"SecurityGroup"), "GroupId"),
+				"IpProtocol":            "tcp",
+				"FromPort":              5432,
+				"ToPort":                5432,
+			})
+		}
+
+		// and only the proxy and the rotation lambda reach the instance
+		var instanceSources []interface{}
+		for _, ingress := range *template.FindResources(jsii.String("AWS::EC2::SecurityGroupIngress"), nil) {
+			properties := (*ingress)["Properties"].(map[string]interface{})
+			if reflect.DeepEqual(properties["GroupId"], getAtt(rdsSecurityGroupID, "GroupId")) {
+				instanceSources = append(instanceSources, properties["SourceSecurityGroupId"])
+			}
+		}
+		require.ElementsMatch(t, []interface{}{
+			getAtt(proxySecurityGroupID, "GroupId"),
+			getAtt(logicalID(t, template, "AWS::EC2::SecurityGroup", "StoriRdsInstanceRotationSingleUserSecurityGroup"), "GroupId"),
+		}, instanceSources)
+
+		// The database port is never open to a CIDR range
+		for _, groupID := range []string{rdsSecurityGroupID, proxySecurityGroupID} {
+			template.ResourcePropertiesCountIs(jsii.String("AWS::EC2::SecurityGroupIngress"), map[string]interface{}{
+				"GroupId": getAtt(groupID, "GroupId"),
+				"CidrIp":  assertions.Match_AnyValue(),
+			}, jsii.Number(0))
+		}
+		template.HasResourceProperties(jsii.String("AWS::EC2::SecurityGroup"), map[string]interface{}{
+			"GroupDescription":     "TestStack/RdsSecurityGroup",
+			"SecurityGroupIngress": assertions.Match_Absent(),
+		})
+	})
+
+	t.Run("upload routing", func(t *testing.T) {
+		// Uploads under input/ start the state machine through EventBridge instead of a bucket notification
+		template.HasResourceProperties(jsii.String("Custom::S3BucketNotifications"), map[string]interface{}{
+			"BucketName":                ref(bucketID),
+			"NotificationConfiguration": assertions.Match_ObjectEquals(&map[string]interface{}{"EventBridgeConfiguration": map[string]interface{}{}}),
+		})
+		template.HasResourceProperties(jsii.String("AWS::Events::Rule"), map[string]interface{}{
+			"EventPattern": map[string]interface{}{
+				"source":      []interface{}{"aws.s3"},
+				"detail-type": []interface{}{"Object Created"},
+				"detail": map[string]interface{}{
+					"bucket": map[string]interface{}{"name": []interface{}{ref(bucketID)}},
+					"object": map[string]interface{}{"key": []interface{}{map[string]interface{}{"prefix": "input/"}}},
+				},
+			},
+			"Targets": []interface{}{assertions.Match_ObjectLike(&map[string]interface{}{
+				"Arn": ref(logicalID(t, template, "AWS::StepFunctions::StateMachine", "PipelineStateMachine")),
+			})},
+		})
+	})
+
+	t.Run("environment", func(t *testing.T) {
+		emailTemplate := templates.Default(templates.DefaultBrand)
+		environments := map[string]map[string]interface{}{
+			"InitLambda": {
+				"BUCKET_NAME": ref(bucketID),
+			},
+			"UnsubscribeLambda":  {},
+			"SesEventsLambda":    {},
+			"StoreSummaryLambda": {},
+			"ProcessCsvLambda": {
+				"STORE_ARN":         getAtt(functionIDs["StoreSummaryLambda"], "Arn"),
+				"SEND_ARN":          getAtt(functionIDs["SendSummaryLambda"], "Arn"),
+				"INPUT_PREFIX":      "input/",
+				"PROCESSED_PREFIX":  "processed/",
+				"QUARANTINE_PREFIX": "quarantine/",
+			},
+			"SendSummaryLambda": {
+				"BUCKET_NAME":       ref(bucketID),
+				"TEMPLATE_KEY":      emailTemplate.Key(),
+				"BRAND":             templates.DefaultBrand,
+				"USE_SES":           "false",
+				"SENDER":            "sender@example.com",
+				"RECIPIENT":         "recipient@example.com",
+				"UNSUBSCRIBE_URL":   getAtt(logicalID(t, template, "AWS::Lambda::Url", "UnsubscribeLambdaFunctionUrl"), "FunctionUrl"),
+				"OUTPUT_PREFIX":     "output/",
+				"CONFIGURATION_SET": ref(logicalID(t, template, "AWS::SES::ConfigurationSet", "SesConfigurationSet")),
+			},
+		}
+
+		functions := *template.FindResources(jsii.String("AWS::Lambda::Function"), nil)
+		for id, variables := range environments {
+			// Every lambda connects through the proxy
+			variables["DB_PROXY_ENDPOINT"] = getAtt(proxyID, "Endpoint")
+			variables["DB_USER"] = "adminStori"
+			variables["DB_NAME"] = "postgres"
+			// and emits its metrics under the path of the pipeline
+			variables["METRICS_NAMESPACE"] = "StoriChallenge"
+			variables["METRICS_PIPELINE"] = "TestStack/StatementPipeline"
+
+			properties := (*functions[functionIDs[id]])["Properties"].(map[string]interface{})
+			require.Equal(t, map[string]interface{}{"Variables": variables}, properties["Environment"], id)
+			require.Equal(t, "go1.x", properties["Runtime"], id)
+		}
+	})
+
+	t.Run("database", func(t *testing.T) {
+		// The password is generated by Secrets Manager, it is never part of the context nor the template
+		template.ResourceCountIs(jsii.String("AWS::SecretsManager::Secret"), jsii.Number(1))
+		template.HasResourceProperties(jsii.String("AWS::SecretsManager::Secret"), map[string]interface{}{
+			"GenerateSecretString": assertions.Match_ObjectLike(&map[string]interface{}{
+				"GenerateStringKey":    "password",
+				"SecretStringTemplate": `{"username":"adminStori"}`,
+			}),
+			"SecretString": assertions.Match_Absent(),
+		})
+		var generatedSecretID string
+		for id := range *template.FindResources(jsii.String("AWS::SecretsManager::Secret"), nil) {
+			generatedSecretID = id
+		}
+
+		// and rotated by the single user rotation application
+		template.ResourceCountIs(jsii.String("AWS::Serverless::Application"), jsii.Number(1))
+		template.HasResourceProperties(jsii.String("AWS::SecretsManager::RotationSchedule"), map[string]interface{}{
+			"SecretId":      ref(secretID),
+			"RotationRules": map[string]interface{}{"AutomaticallyAfterDays": 30},
+		})
+
+		// The proxy reaches the instance with the secret and requires IAM authentication and TLS from the lambdas
+		template.ResourceCountIs(jsii.String("AWS::RDS::DBProxy"), jsii.Number(1))
+		template.HasResourceProperties(jsii.String("AWS::RDS::DBProxy"), map[string]interface{}{
+			"Auth":                []interface{}{map[string]interface{}{"AuthScheme": "SECRETS", "IAMAuth": "REQUIRED", "SecretArn": ref(secretID)}},
+			"DBProxyName":         "TestStack-StoriRdsInstance-0295D4BA",
+			"EngineFamily":        "POSTGRESQL",
+			"RequireTLS":          true,
+			"VpcSecurityGroupIds": []interface{}{getAtt(proxySecurityGroupID, "GroupId")},
+			"VpcSubnetIds":        subnetRefs(t, template, "Database"),
+		})
+		template.HasResourceProperties(jsii.String("AWS::RDS::DBProxyTargetGroup"), map[string]interface{}{
+			"DBProxyName":           ref(proxyID),
+			"DBInstanceIdentifiers": []interface{}{ref(logicalID(t, template, "AWS::RDS::DBInstance", "StoriRdsInstance"))},
+		})
+
+		template.ResourceCountIs(jsii.String("AWS::RDS::DBInstance"), jsii.Number(1))
+		template.HasResource(jsii.String("AWS::RDS::DBInstance"), map[string]interface{}{
+			"DeletionPolicy": "Delete",
+			"Properties": assertions.Match_ObjectLike(&map[string]interface{}{
+				"Engine":             "postgres",
+				"EngineVersion":      "15.2",
+				"DBInstanceClass":    "db.t3.micro",
+				"DBName":             "postgres",
+				"MasterUsername":     "adminStori",
+				"DeletionProtection": false,
+				"PubliclyAccessible": false,
+				"VPCSecurityGroups":  []interface{}{getAtt(rdsSecurityGroupID, "GroupId")},
+				// The password is resolved from the secret at deploy time, never inlined
+				"MasterUserPassword": map[string]interface{}{"Fn::Join": []interface{}{"", []interface{}{
+					"{{resolve:secretsmanager:", ref(generatedSecretID), ":SecretString:password::}}",
+				}}},
+			}),
+		})
+	})
+
+	t.Run("network", func(t *testing.T) {
+		lambdaSubnets := subnetRefs(t, template, "Lambda")
+
+		// Without NAT gateways nothing in the VPC reaches the internet
+		template.ResourceCountIs(jsii.String("AWS::EC2::NatGateway"), jsii.Number(0))
+		template.ResourceCountIs(jsii.String("AWS::EC2::InternetGateway"), jsii.Number(0))
+
+		// The database only lives in the isolated database subnets
+		template.HasResourceProperties(jsii.String("AWS::RDS::DBSubnetGroup"), map[string]interface{}{
+			"SubnetIds": subnetRefs(t, template, "Database"),
+		})
+
+		// and the lambdas, including the rotation one, in the lambda subnets
+		functions := *template.FindResources(jsii.String("AWS::Lambda::Function"), nil)
+		for _, id := range lambdaIDs {
+			properties := (*functions[functionIDs[id]])["Properties"].(map[string]interface{})
+			require.Equal(t, lambdaSubnets, properties["VpcConfig"].(map[string]interface{})["SubnetIds"], id)
+		}
+		template.HasResourceProperties(jsii.String("AWS::Serverless::Application"), map[string]interface{}{
+			"Parameters": assertions.Match_ObjectLike(&map[string]interface{}{
+				"vpcSubnetIds": map[string]interface{}{"Fn::Join": []interface{}{"", []interface{}{lambdaSubnets[0], ",", lambdaSubnets[1]}}},
+				"endpoint": map[string]interface{}{"Fn::Join": []interface{}{"", []interface{}{
+					"https://", ref(logicalID(t, template, "AWS::EC2::VPCEndpoint", "StoriVPCSecretsManagerEndpoint")),
+					".secretsmanager.", ref("AWS::Region"), ".", ref("AWS::URLSuffix"),
+				}}},
+			}),
+		})
+
+		// reaching the AWS services through the endpoints
+		template.ResourceCountIs(jsii.String("AWS::EC2::VPCEndpoint"), jsii.Number(7))
+		template.HasResourceProperties(jsii.String("AWS::EC2::VPCEndpoint"), map[string]interface{}{
+			"ServiceName":     serviceName("s3"),
+			"VpcEndpointType": "Gateway",
+		})
+		for _, service := range []string{"secretsmanager", "lambda", "email", "sqs", "sns", "xray"} {
+			template.HasResourceProperties(jsii.String("AWS::EC2::VPCEndpoint"), map[string]interface{}{
+				"ServiceName":       serviceName(service),
+				"VpcEndpointType":   "Interface",
+				"PrivateDnsEnabled": true,
+				"SubnetIds":         lambdaSubnets,
+			})
+		}
+	})
+
+	t.Run("monitoring", func(t *testing.T) {
+		alarmTopicID := logicalID(t, template, "AWS::SNS::Topic", "AlarmTopic")
+
+		// An error rate and a duration alarm per lambda, and one on the failed executions, all notifying the topic
+		alarms := *template.FindResources(jsii.String("AWS::CloudWatch::Alarm"), nil)
+		require.Len(t, alarms, 2*len(lambdaIDs)+1)
+		for id, alarm := range alarms {
+			properties := (*alarm)["Properties"].(map[string]interface{})
+			require.Equal(t, []interface{}{ref(alarmTopicID)}, properties["AlarmActions"], id)
+			require.Equal(t, "notBreaching", properties["TreatMissingData"], id)
+		}
+		template.HasResourceProperties(jsii.String("AWS::CloudWatch::Alarm"), map[string]interface{}{
+			"MetricName":         "ExecutionsFailed",
+			"Namespace":          "AWS/States",
+			"Threshold":          1,
+			"ComparisonOperator": "GreaterThanOrEqualToThreshold",
+		})
+		// The slowest invocations alarm at 80% of the 30 seconds timeout
+		template.HasResourceProperties(jsii.String("AWS::CloudWatch::Alarm"), map[string]interface{}{
+			"MetricName": "Duration",
+			"Statistic":  "Maximum",
+			"Threshold":  24000,
+			"Dimensions": []interface{}{map[string]interface{}{"Name": "FunctionName", "Value": ref(functionIDs["ProcessCsvLambda"])}},
+		})
+		template.HasResourceProperties(jsii.String("AWS::CloudWatch::Alarm"), map[string]interface{}{
+			"Threshold": 5,
+			"Metrics": assertions.Match_ArrayWith(&[]interface{}{assertions.Match_ObjectLike(&map[string]interface{}{
+				"Expression": "IF(invocations > 0, 100 * errors / invocations, 0)",
+			})}),
+		})
+
+		// Without alarmEmail nobody is subscribed to the topic yet
+		subscriptions := template.FindResources(jsii.String("AWS::SNS::Subscription"), map[string]interface{}{
+			"Properties": map[string]interface{}{"TopicArn": ref(alarmTopicID)},
+		})
+		require.Empty(t, *subscriptions)
+		template.ResourceCountIs(jsii.String("AWS::CloudWatch::Dashboard"), jsii.Number(1))
+		template.HasOutput(jsii.String("AlarmTopicArn"), map[string]interface{}{"Value": ref(alarmTopicID)})
+	})
+
+	t.Run("tracing", func(t *testing.T) {
+		// Every lambda and the state machine are traced, so a run is one trace from the upload to the email
+		traced := template.FindResources(jsii.String("AWS::Lambda::Function"), map[string]interface{}{
+			"Properties": map[string]interface{}{"TracingConfig": map[string]interface{}{"Mode": "Active"}},
+		})
+		for _, id := range lambdaIDs {
+			require.Contains(t, *traced, functionIDs[id], id)
+		}
+		template.HasResourceProperties(jsii.String("AWS::StepFunctions::StateMachine"), map[string]interface{}{
+			"TracingConfiguration": map[string]interface{}{"Enabled": true},
+		})
+	})
+
+	t.Run("log retention", func(t *testing.T) {
+		template.ResourceCountIs(jsii.String("Custom::LogRetention"), jsii.Number(1))
+		template.HasResourceProperties(jsii.String("Custom::LogRetention"), map[string]interface{}{
+			"LogGroupName":    map[string]interface{}{"Fn::Join": []interface{}{"", []interface{}{"/aws/lambda/", ref(functionIDs["StoreSummaryLambda"])}}},
+			"RetentionInDays": 7,
+		})
+	})
+}
+
+func TestStoriChallengeTemplateNatGateways(t *testing.T) {
+	template := synth(map[string]interface{}{"natGateways": 1, "vpcEndpoints": []interface{}{"s3"}})
+
+	// The lambda subnets route to the internet through the NAT gateway of the public subnets
+	template.ResourceCountIs(jsii.String("AWS::EC2::NatGateway"), jsii.Number(1))
+	template.HasResourceProperties(jsii.String("AWS::EC2::Route"), map[string]interface{}{
+		"RouteTableId":         ref(logicalID(t, template, "AWS::EC2::RouteTable", "StoriVPCLambdaSubnet1RouteTable")),
+		"DestinationCidrBlock": "0.0.0.0/0",
+		"NatGatewayId":         ref(logicalID(t, template, "AWS::EC2::NatGateway", "StoriVPCPublicSubnet1NATGateway")),
+	})
+
+	// while the database subnets stay isolated
+	for _, route := range *template.FindResources(jsii.String("AWS::EC2::Route"), nil) {
+		routeTable := (*route)["Properties"].(map[string]interface{})["RouteTableId"]
+		require.NotContains(t, routeTable.(map[string]interface{})["Ref"], "StoriVPCDatabaseSubnet")
+	}
+
+	template.ResourceCountIs(jsii.String("AWS::EC2::VPCEndpoint"), jsii.Number(1))
+}
+
+// subnetRefs returns the references to the subnets of a group of the VPC, one per availability zone.
+func subnetRefs(t *testing.T, template assertions.Template, group string) []interface{} {
+	t.Helper()
+
+	var refs []interface{}
+	for _, zone := range []string{"1", "2"} {
+		refs = append(refs, ref(logicalID(t, template, "AWS::EC2::Subnet", "StoriVPC"+group+"Subnet"+zone+"Subnet")))
+	}
+
+	return refs
+}
+
+// serviceName is the name of the endpoint service of an AWS service in the region of the stack.
+func serviceName(service string) map[string]interface{} {
+	return map[string]interface{}{"Fn::Join": []interface{}{"", []interface{}{"com.amazonaws.", ref("AWS::Region"), "." + service}}}
+}
+
+func TestStoriChallengeTemplateInvokeOrchestration(t *testing.T) {
+	template := synth(map[string]interface{}{"orchestration": "invoke"})
 
-	sendSummaryLambda := stack.Node().TryFindChild(jsii.String("SendSummaryLambda"))
-	require.NotNil(t, sendSummaryLambda, "SendSummaryLambda not found in stack")
+	processID := logicalID(t, template, "AWS::Lambda::Function", "ProcessCsvLambda")
 
-	storeSummaryLambda := stack.Node().TryFindChild(jsii.String("StoreSummaryLambda"))
-	require.NotNil(t, storeSummaryLambda, "StoreSummaryLambda not found in stack")
+	// Only puts under input/ trigger the process lambda
+	template.HasResourceProperties(jsii.String("Custom::S3BucketNotifications"), map[string]interface{}{
+		"NotificationConfiguration": map[string]interface{}{
+			"LambdaFunctionConfigurations": []interface{}{map[string]interface{}{
+				"Events": []interface{}{"s3:ObjectCreated:Put"},
+				"Filter": map[string]interface{}{"Key": map[string]interface{}{"FilterRules": []interface{}{
+					map[string]interface{}{"Name": "prefix", "Value": "input/"},
+				}}},
+				"LambdaFunctionArn": getAtt(processID, "Arn"),
+			}},
+		},
+	})
+	template.ResourceCountIs(jsii.String("AWS::Events::Rule"), jsii.Number(0))
+	template.ResourceCountIs(jsii.String("AWS::StepFunctions::StateMachine"), jsii.Number(0))
 
-	processCsvLambda := stack.Node().TryFindChild(jsii.String("ProcessCsvLambda"))
-	require.NotNil(t, processCsvLambda, "ProcessCsvLambda not found in stack")
+	// The process lambda invokes the other two, and only them
+	actions := allowedActions(t, template, "ProcessCsvLambda")
+	invoked := actions["lambda:InvokeFunction"]
+	for _, id := range []string{"StoreSummaryLambda", "SendSummaryLambda"} {
+		require.Contains(t, invoked, getAtt(logicalID(t, template, "AWS::Lambda::Function", id), "Arn"))
+	}
+	require.NotContains(t, invoked, "*")
 }
@@ -0,0 +1,114 @@
+package summary
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DefaultAccount is used for input files dropped directly under the input prefix.
+const DefaultAccount = "default"
+
+// Prefixes of the bucket, uploads land under InputPrefix and are moved to ProcessedPrefix or QuarantinePrefix
+// depending on the outcome. The generated emails are stored under OutputPrefix.
+const (
+	InputPrefix      = "input/"
+	ProcessedPrefix  = "processed/"
+	QuarantinePrefix = "quarantine/"
+	OutputPrefix     = "output/"
+)
+
+// unsafeKeyChars matches everything that should not end up in a generated object key.
+var unsafeKeyChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// Message is the payload passed from the CSV processing lambda to the store and send lambdas. The store
+// lambda returns it back with RecordID set. ArchivedKey is where the input file was moved to once the run ended,
+// it is empty while the file is still under the input prefix. TraceHeader is the X-Ray trace header of the parse step,
+// empty when it was not traced.
+type Message struct {
+	RunID        string
+	Account      string
+	SourceBucket string
+	SourceKey    string
+	ArchivedKey  string
+	ReceivedAt   time.Time
+	RecordID     int64
+	Summary      SummaryData
+	TraceHeader  string
+}
+
+// ParseRequest is the input of the parse step of the state machine, built from the S3 'Object Created' event.
+type ParseRequest struct {
+	Bucket     string
+	Key        string
+	ETag       string
+	Sequencer  string
+	ReceivedAt time.Time
+}
+
+// Outcomes of a run, the prefix its input file is moved to and the 'outcome' tag of the moved file.
+const (
+	OutcomeProcessed   = "processed"
+	OutcomeQuarantined = "quarantined"
+)
+
+// ArchiveRequest is the input of the archive steps of the state machine, run once the summary was notified or
+// once storing or notifying it failed. The input file of Message is moved according to Outcome, Reason being the
+// failure of a quarantined run.
+type ArchiveRequest struct {
+	Outcome string
+	Message Message
+	Reason  string
+}
+
+// NotifyResult is returned by the send lambda once the email has been generated and sent. Recipients counts the
+// emails sent by this attempt, a retried run skips the recipients an earlier attempt sent to.
+type NotifyResult struct {
+	OutputKey  string
+	Recipients int
+}
+
+// NewMessage builds the message for an uploaded object, the account is taken from the first path
+// segment after the input prefix, e.g. 'input/<account>/<file>.csv'.
+func NewMessage(bucket, key, etag, sequencer string, receivedAt time.Time, summaryData SummaryData) Message {
+	return Message{
+		RunID:        RunID(bucket, key, etag, sequencer),
+		Account:      AccountFromKey(key),
+		SourceBucket: bucket,
+		SourceKey:    key,
+		ReceivedAt:   receivedAt.UTC(),
+		Summary:      summaryData,
+	}
+}
+
+// RunID derives a stable id for one upload of an object, re-running the same event yields the
+// same id while a new upload of the same key gets a new one.
+func RunID(bucket, key, etag, sequencer string) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{bucket, key, etag, sequencer}, "/")))
+
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// AccountFromKey returns the account folder of an input key or DefaultAccount.
+func AccountFromKey(key string) string {
+	return DefaultPrefixes.AccountFromKey(key)
+}
+
+// ArchiveKey returns the key an input file is moved to under prefix, keeping its path relative to the input
+// prefix so it can be copied back to be processed again.
+func ArchiveKey(key, prefix string) string {
+	return DefaultPrefixes.ArchiveKey(key, prefix)
+}
+
+// OutputKey returns the key the generated email is stored under:
+// 'output/<account>/<yyyy-mm>/<input-path>-<run-id>.html'.
+func (m Message) OutputKey() string {
+	return DefaultPrefixes.OutputKey(m)
+}
+
+// sanitizeKeyPart replaces characters that are awkward in object keys with dashes.
+func sanitizeKeyPart(part string) string {
+	return strings.Trim(unsafeKeyChars.ReplaceAllString(part, "-"), "-")
+}
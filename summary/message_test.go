@@ -0,0 +1,48 @@
+package summary
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccountFromKey(t *testing.T) {
+	require.Equal(t, "acme", AccountFromKey("input/acme/january.csv"))
+	require.Equal(t, "acme-corp", AccountFromKey("input/acme corp/january.csv"))
+	require.Equal(t, DefaultAccount, AccountFromKey("input/january.csv"))
+	require.Equal(t, DefaultAccount, AccountFromKey("input/$$$/january.csv"))
+}
+
+func TestOutputKey(t *testing.T) {
+	receivedAt := time.Date(2023, 4, 30, 23, 59, 0, 0, time.UTC)
+
+	message := NewMessage("bucket", "input/acme/statement 04.csv", "etag", "seq", receivedAt, SummaryData{})
+	require.Equal(t, "output/acme/2023-04/statement-04-"+message.RunID+".html", message.OutputKey())
+
+	message = NewMessage("bucket", "input/sample.csv", "etag", "seq", receivedAt, SummaryData{})
+	require.Equal(t, "output/default/2023-04/sample-"+message.RunID+".html", message.OutputKey())
+
+	// A re-upload of the same file in the same month gets its own email
+	reupload := NewMessage("bucket", "input/sample.csv", "etag-2", "seq-2", receivedAt, SummaryData{})
+	require.NotEqual(t, message.OutputKey(), reupload.OutputKey())
+
+	// and so do files of the same name in other folders of an account
+	north := NewMessage("bucket", "input/acme/north/july.csv", "etag", "seq", receivedAt, SummaryData{})
+	south := NewMessage("bucket", "input/acme/south/july.csv", "etag", "seq", receivedAt, SummaryData{})
+	require.Equal(t, "output/acme/2023-04/north/july-"+north.RunID+".html", north.OutputKey())
+	require.Equal(t, "output/acme/2023-04/south/july-"+south.RunID+".html", south.OutputKey())
+}
+
+func TestRunID(t *testing.T) {
+	first := RunID("bucket", "input/sample.csv", "etag", "0055AED6DCD90281E5")
+	require.Len(t, first, 16)
+	require.Equal(t, first, RunID("bucket", "input/sample.csv", "etag", "0055AED6DCD90281E5"))
+	require.NotEqual(t, first, RunID("bucket", "input/sample.csv", "etag", "0055AED6DCD90281E6"))
+}
+
+func TestArchiveKey(t *testing.T) {
+	require.Equal(t, "processed/acme/january.csv", ArchiveKey("input/acme/january.csv", ProcessedPrefix))
+	require.Equal(t, "quarantine/sample.csv", ArchiveKey("input/sample.csv", QuarantinePrefix))
+	require.Equal(t, "quarantine/other/sample.csv", ArchiveKey("other/sample.csv", QuarantinePrefix))
+}
@@ -0,0 +1,109 @@
+package summary
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Prefixes are the folders of the bucket a pipeline works with. Pipelines sharing a bucket, e.g. one per tenant,
+// each get their own prefixes.
+type Prefixes struct {
+	Input      string
+	Processed  string
+	Quarantine string
+	Output     string
+}
+
+// DefaultPrefixes are used by a pipeline owning its bucket.
+var DefaultPrefixes = Prefixes{
+	Input:      InputPrefix,
+	Processed:  ProcessedPrefix,
+	Quarantine: QuarantinePrefix,
+	Output:     OutputPrefix,
+}
+
+// WithDefaults returns the prefixes with the empty ones set to the default, every prefix ends with '/'.
+func (p Prefixes) WithDefaults() Prefixes {
+	folder := func(prefix, fallback string) string {
+		prefix = strings.Trim(prefix, "/")
+		if prefix == "" {
+			return fallback
+		}
+		return prefix + "/"
+	}
+
+	return Prefixes{
+		Input:      folder(p.Input, InputPrefix),
+		Processed:  folder(p.Processed, ProcessedPrefix),
+		Quarantine: folder(p.Quarantine, QuarantinePrefix),
+		Output:     folder(p.Output, OutputPrefix),
+	}
+}
+
+// AccountFromKey returns the account folder of an input key, the first folder under the input prefix, e.g.
+// '<input>/<account>/<file>.csv', or DefaultAccount for files dropped directly under it.
+func (p Prefixes) AccountFromKey(key string) string {
+	p = p.WithDefaults()
+
+	relative := strings.Trim(key, "/")
+	if strings.HasPrefix(relative, p.Input) {
+		relative = strings.TrimPrefix(relative, p.Input)
+	} else {
+		// Keys outside the input prefix still get the folder below their first one
+		_, relative, _ = strings.Cut(relative, "/")
+	}
+
+	parts := strings.Split(relative, "/")
+	if len(parts) < 2 {
+		return DefaultAccount
+	}
+
+	account := sanitizeKeyPart(parts[0])
+	if account == "" {
+		return DefaultAccount
+	}
+
+	return account
+}
+
+// ArchiveKey returns the key an input file is moved to under prefix, keeping its path relative to the input
+// prefix so it can be copied back to be processed again.
+func (p Prefixes) ArchiveKey(key, prefix string) string {
+	return prefix + strings.TrimPrefix(strings.TrimPrefix(key, "/"), p.WithDefaults().Input)
+}
+
+// OutputKey returns the key the generated email of the message is stored under:
+// '<output>/<account>/<yyyy-mm>/<input-path>-<run-id>.html', where the input path is the one of the input file
+// below its account folder, without extension. The run id keeps re-uploads of a file and files of the same name
+// in other folders from overwriting each other's email.
+func (p Prefixes) OutputKey(m Message) string {
+	p = p.WithDefaults()
+	account := m.Account
+	if account == "" {
+		account = DefaultAccount
+	}
+
+	parts := strings.Split(strings.TrimPrefix(strings.Trim(m.SourceKey, "/"), p.Input), "/")
+	if len(parts) > 1 && sanitizeKeyPart(parts[0]) == account {
+		parts = parts[1:]
+	}
+	last := parts[len(parts)-1]
+	parts[len(parts)-1] = strings.TrimSuffix(last, path.Ext(last))
+
+	var name []string
+	for _, part := range parts {
+		if part = sanitizeKeyPart(part); part != "" {
+			name = append(name, part)
+		}
+	}
+	if m.RunID != "" {
+		if len(name) == 0 {
+			name = []string{m.RunID}
+		} else {
+			name[len(name)-1] += "-" + m.RunID
+		}
+	}
+
+	return fmt.Sprintf("%s%s/%s/%s.html", p.Output, account, m.ReceivedAt.UTC().Format("2006-01"), strings.Join(name, "/"))
+}
@@ -0,0 +1,35 @@
+package summary
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefixesWithDefaults(t *testing.T) {
+	require.Equal(t, DefaultPrefixes, Prefixes{}.WithDefaults())
+
+	prefixes := Prefixes{Input: "tenants/acme/input", Output: "/tenants/acme/output/"}.WithDefaults()
+	require.Equal(t, "tenants/acme/input/", prefixes.Input)
+	require.Equal(t, ProcessedPrefix, prefixes.Processed)
+	require.Equal(t, "tenants/acme/output/", prefixes.Output)
+}
+
+func TestPrefixesKeys(t *testing.T) {
+	prefixes := Prefixes{
+		Input:      "tenants/acme/input/",
+		Processed:  "tenants/acme/processed/",
+		Quarantine: "tenants/acme/quarantine/",
+		Output:     "tenants/acme/output/",
+	}
+
+	require.Equal(t, "north", prefixes.AccountFromKey("tenants/acme/input/north/january.csv"))
+	require.Equal(t, DefaultAccount, prefixes.AccountFromKey("tenants/acme/input/january.csv"))
+
+	require.Equal(t, "tenants/acme/processed/north/january.csv",
+		prefixes.ArchiveKey("tenants/acme/input/north/january.csv", prefixes.Processed))
+
+	message := Message{RunID: "run-1", Account: "north", SourceKey: "tenants/acme/input/north/january.csv", ReceivedAt: time.Date(2023, 1, 31, 0, 0, 0, 0, time.UTC)}
+	require.Equal(t, "tenants/acme/output/north/2023-01/january-run-1.html", prefixes.OutputKey(message))
+}
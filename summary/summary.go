@@ -0,0 +1,142 @@
+package summary
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SummaryData holds the transactions summary shared by every step of the pipeline.
+type SummaryData struct {
+	TotalBalance        float64
+	TransactionsByMonth map[string]int
+	AvgCreditsByMonth   map[string]float64
+	AvgDebitsByMonth    map[string]float64
+	DebitTotal          float64
+	CreditTotal         float64
+}
+
+// Rejection is a CSV line that could not be summarized.
+type Rejection struct {
+	Line   int
+	Reason string
+}
+
+// ParseReport counts the rows of a CSV file and lists the rejected ones.
+type ParseReport struct {
+	RowsParsed int
+	Rejections []Rejection
+}
+
+// RejectedRowsError is returned by ParseCSV when at least one row was rejected.
+type RejectedRowsError struct {
+	Rejections []Rejection
+}
+
+func (e *RejectedRowsError) Error() string {
+	first := e.Rejections[0]
+	if len(e.Rejections) == 1 {
+		return fmt.Sprintf("rejected line %d: %s", first.Line, first.Reason)
+	}
+
+	return fmt.Sprintf("rejected %d lines, first at line %d: %s", len(e.Rejections), first.Line, first.Reason)
+}
+
+// ParseCSV processes the CSV data and returns a SummaryData struct containing the total debit and credit amounts.
+// Every invalid row is reported, if any row is rejected the file is not summarized and a *RejectedRowsError is
+// returned along with the report.
+func ParseCSV(csvData string) (SummaryData, ParseReport, error) {
+	var debitTotal float64
+	var creditTotal float64
+	var report ParseReport
+	monthTransactions := make(map[string]int)
+	monthCredits := make(map[string]float64)
+	monthDebits := make(map[string]float64)
+
+	reader := csv.NewReader(strings.NewReader(csvData))
+	// Column count is checked per record so short rows are reported instead of aborting the file
+	reader.FieldsPerRecord = -1
+
+	// Read and ignore the header line
+	if _, err := reader.Read(); err != nil {
+		return SummaryData{}, report, fmt.Errorf("failed to read header line: %w", err)
+	}
+
+	reject := func(reason string, args ...interface{}) {
+		line, _ := reader.FieldPos(0)
+		report.Rejections = append(report.Rejections, Rejection{Line: line, Reason: fmt.Sprintf(reason, args...)})
+	}
+
+	// Process each record in the CSV file
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if parseErr, ok := err.(*csv.ParseError); ok {
+			report.Rejections = append(report.Rejections, Rejection{Line: parseErr.Line, Reason: parseErr.Err.Error()})
+			continue
+		}
+		if err != nil {
+			return SummaryData{}, report, fmt.Errorf("failed to read record: %w", err)
+		}
+
+		// Check that the record has the required columns
+		if len(record) < 4 {
+			reject("record has missing columns: %v", record)
+			continue
+		}
+
+		// Get the transaction type (debit or credit)
+		typ := strings.ToLower(record[1])
+		if typ != "debit" && typ != "credit" {
+			reject("invalid transaction type: %s", typ)
+			continue
+		}
+
+		// Get the transaction amount
+		amount, err := strconv.ParseFloat(record[2], 64)
+		if err != nil {
+			reject("failed to parse amount: %v", err)
+			continue
+		}
+
+		// Extract year-month from the date
+		if len(record[3]) < 7 {
+			reject("invalid date: %s", record[3])
+			continue
+		}
+		if _, err = time.Parse("2006-01", record[3][:7]); err != nil {
+			reject("invalid date: %s", record[3])
+			continue
+		}
+
+		report.RowsParsed++
+		month := record[3][:7]
+		monthTransactions[month]++
+		if typ == "credit" {
+			creditTotal += amount
+			monthCredits[month] += amount
+		} else if typ == "debit" {
+			debitTotal += amount
+			monthDebits[month] += amount
+		}
+
+	}
+
+	if len(report.Rejections) > 0 {
+		return SummaryData{}, report, &RejectedRowsError{Rejections: report.Rejections}
+	}
+
+	return SummaryData{
+		DebitTotal:          debitTotal,
+		CreditTotal:         creditTotal,
+		TotalBalance:        creditTotal + debitTotal,
+		TransactionsByMonth: monthTransactions,
+		AvgCreditsByMonth:   monthCredits,
+		AvgDebitsByMonth:    monthDebits,
+	}, report, nil
+}
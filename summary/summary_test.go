@@ -0,0 +1,60 @@
+package summary
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCSVSample(t *testing.T) {
+	csvData, err := os.ReadFile("../resources/sample.csv")
+	require.NoError(t, err)
+
+	summaryData, report, err := ParseCSV(string(csvData))
+	require.NoError(t, err)
+	require.Empty(t, report.Rejections)
+	require.Equal(t, sumInts(summaryData.TransactionsByMonth), report.RowsParsed)
+	require.InDelta(t, summaryData.CreditTotal+summaryData.DebitTotal, summaryData.TotalBalance, 0.001)
+}
+
+func TestParseCSVReportsEveryRejectedRow(t *testing.T) {
+	csvData := "id,type,amount,date\n" +
+		"1,debit,100.00,2023-01-01\n" +
+		"2,refund,10.00,2023-01-02\n" +
+		"3,credit,abc,2023-01-03\n" +
+		"4,credit,10.00\n" +
+		"5,credit,10.00,2023\n" +
+		"6,credit,20.00,2023-02-01\n"
+
+	summaryData, report, err := ParseCSV(csvData)
+	require.Error(t, err)
+	require.Zero(t, summaryData.TotalBalance, "a file with rejected rows must not be summarized")
+	require.Equal(t, 2, report.RowsParsed)
+
+	var rejected *RejectedRowsError
+	require.True(t, errors.As(err, &rejected))
+	require.Len(t, rejected.Rejections, 4)
+
+	lines := make([]int, 0, len(report.Rejections))
+	for _, rejection := range report.Rejections {
+		lines = append(lines, rejection.Line)
+	}
+	require.Equal(t, []int{3, 4, 5, 6}, lines)
+	require.Contains(t, report.Rejections[0].Reason, "invalid transaction type")
+}
+
+func TestParseCSVEmptyFile(t *testing.T) {
+	_, _, err := ParseCSV("")
+	require.Error(t, err)
+}
+
+func sumInts(values map[string]int) int {
+	total := 0
+	for _, v := range values {
+		total += v
+	}
+
+	return total
+}
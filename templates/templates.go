@@ -0,0 +1,279 @@
+package templates
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+
+	"stori-challenge/summary"
+)
+
+// DefaultBrand is the brand used when none is configured.
+const DefaultBrand = "stori"
+
+//go:embed files
+var files embed.FS
+
+// Brand holds the per-brand values injected into a template.
+type Brand struct {
+	Name string
+	// LogoURL is empty for a brand without a logo of its own, GetBrand falls back to the one of DefaultBrand.
+	LogoURL string
+}
+
+var brands = map[string]Brand{
+	"stori": {
+		Name:    "stori",
+		LogoURL: "https://www.storicard.com/_next/static/media/complete-logo.0f6b7ce5.svg",
+	},
+	// Stori Plus has no logo asset yet, its templates tell it apart by their heading and colors
+	"stori-plus": {
+		Name: "stori-plus",
+	},
+}
+
+// Template is a single embedded template version of a brand.
+type Template struct {
+	Brand   string
+	Version string
+	Body    string
+}
+
+// Key returns the object key the template is stored under in the bucket.
+func (t Template) Key() string {
+	return Key(t.Brand, t.Version)
+}
+
+// Key returns the versioned object key for a brand template, e.g. 'templates/stori/v1.html'.
+func Key(brand, version string) string {
+	return fmt.Sprintf("templates/%s/%s.html", brand, version)
+}
+
+// GetBrand returns the brand registered under name, with the logo of DefaultBrand when it has none.
+func GetBrand(name string) (Brand, error) {
+	brand, ok := brands[name]
+	if !ok {
+		return Brand{}, fmt.Errorf("unknown brand: %s", name)
+	}
+	if brand.LogoURL == "" {
+		brand.LogoURL = brands[DefaultBrand].LogoURL
+	}
+
+	return brand, nil
+}
+
+// Versions returns the embedded versions of a brand sorted from oldest to newest.
+func Versions(brand string) ([]string, error) {
+	entries, err := files.ReadDir(path.Join("files", brand))
+	if err != nil {
+		return nil, fmt.Errorf("no templates for brand %s: %w", brand, err)
+	}
+
+	var versions []string
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".html" {
+			continue
+		}
+		versions = append(versions, strings.TrimSuffix(entry.Name(), ".html"))
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versionNumber(versions[i]) < versionNumber(versions[j])
+	})
+
+	return versions, nil
+}
+
+// Latest returns the newest embedded version of a brand.
+func Latest(brand string) (string, error) {
+	versions, err := Versions(brand)
+	if err != nil {
+		return "", err
+	}
+	if len(versions) == 0 {
+		return "", fmt.Errorf("no templates for brand %s", brand)
+	}
+
+	return versions[len(versions)-1], nil
+}
+
+// Get returns an embedded template, an empty version resolves to the latest one.
+func Get(brand, version string) (Template, error) {
+	if version == "" {
+		latest, err := Latest(brand)
+		if err != nil {
+			return Template{}, err
+		}
+		version = latest
+	}
+
+	body, err := files.ReadFile(path.Join("files", brand, version+".html"))
+	if err != nil {
+		return Template{}, fmt.Errorf("template %s/%s not found: %w", brand, version, err)
+	}
+
+	return Template{Brand: brand, Version: version, Body: string(body)}, nil
+}
+
+// All returns every embedded template of every brand.
+func All() ([]Template, error) {
+	var names []string
+	for name := range brands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var all []Template
+	for _, name := range names {
+		versions, err := Versions(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, version := range versions {
+			tmpl, err := Get(name, version)
+			if err != nil {
+				return nil, err
+			}
+			all = append(all, tmpl)
+		}
+	}
+
+	return all, nil
+}
+
+// Recipient holds the per-recipient values injected into a template.
+type Recipient struct {
+	Locale         string
+	UnsubscribeURL string
+}
+
+// textTemplate is used for recipients that prefer plain text emails.
+const textTemplate = `Account Summary
+
+Total Balance: {{.TotalBalance}}
+
+Transaction Summary
+{{range $month, $transactions := .TransactionsByMonth}}
+{{$month}}: {{$transactions}} transactions, average credit {{index $.AvgCreditsByMonth $month}}, average debit {{index $.AvgDebitsByMonth $month}}
+{{end}}
+Total Credits: {{.CreditTotal}}
+Total Debits: {{.DebitTotal}}
+{{if .UnsubscribeURL}}
+To stop receiving these emails visit {{.UnsubscribeURL}}
+{{end}}`
+
+// templateData is the data every template is executed with.
+type templateData struct {
+	LogoURL             string
+	Language            string
+	UnsubscribeURL      string
+	DebitTotal          string
+	CreditTotal         string
+	TotalBalance        string
+	TransactionsByMonth map[string]int
+	AvgCreditsByMonth   map[string]float64
+	AvgDebitsByMonth    map[string]float64
+}
+
+func newTemplateData(brand Brand, recipient Recipient, summaryData *summary.SummaryData) templateData {
+	language := recipient.Locale
+	if language == "" {
+		language = "en"
+	}
+
+	return templateData{
+		LogoURL:             brand.LogoURL,
+		Language:            language,
+		UnsubscribeURL:      recipient.UnsubscribeURL,
+		DebitTotal:          strconv.FormatFloat(summaryData.DebitTotal, 'f', 2, 64),
+		CreditTotal:         strconv.FormatFloat(summaryData.CreditTotal, 'f', 2, 64),
+		TotalBalance:        strconv.FormatFloat(summaryData.TotalBalance, 'f', 2, 64),
+		TransactionsByMonth: summaryData.TransactionsByMonth,
+		AvgCreditsByMonth:   summaryData.AvgCreditsByMonth,
+		AvgDebitsByMonth:    summaryData.AvgDebitsByMonth,
+	}
+}
+
+// Render generates an email body from a template and summary data.
+func Render(templateStr string, brand Brand, recipient Recipient, summaryData *summary.SummaryData) (bytes.Buffer, error) {
+	emailTemplate, err := template.New("email").Parse(templateStr)
+	if err != nil {
+		return bytes.Buffer{}, fmt.Errorf("failed to parse email template: %w", err)
+	}
+
+	// Execute the template with the data
+	var emailBody bytes.Buffer
+	if err = emailTemplate.Execute(&emailBody, newTemplateData(brand, recipient, summaryData)); err != nil {
+		return bytes.Buffer{}, fmt.Errorf("failed to execute email template: %v", err)
+	}
+
+	return emailBody, nil
+}
+
+// RenderText generates a plain text email body from summary data.
+func RenderText(brand Brand, recipient Recipient, summaryData *summary.SummaryData) (bytes.Buffer, error) {
+	emailTemplate, err := texttemplate.New("text").Parse(textTemplate)
+	if err != nil {
+		return bytes.Buffer{}, fmt.Errorf("failed to parse text template: %w", err)
+	}
+
+	var emailBody bytes.Buffer
+	if err = emailTemplate.Execute(&emailBody, newTemplateData(brand, recipient, summaryData)); err != nil {
+		return bytes.Buffer{}, fmt.Errorf("failed to execute text template: %v", err)
+	}
+
+	return emailBody, nil
+}
+
+// Fixture returns the canonical summary templates are dry-run against before being accepted.
+func Fixture() *summary.SummaryData {
+	return &summary.SummaryData{
+		TotalBalance:        39.74,
+		TransactionsByMonth: map[string]int{"2023-07": 2, "2023-08": 2},
+		AvgCreditsByMonth:   map[string]float64{"2023-07": 60.5, "2023-08": 10},
+		AvgDebitsByMonth:    map[string]float64{"2023-07": -10.3, "2023-08": -20.46},
+		DebitTotal:          -30.76,
+		CreditTotal:         70.5,
+	}
+}
+
+// Validate parses the template and executes it against the Fixture, so a template that would fail
+// at send time is rejected before it gets stored.
+func Validate(templateStr string) error {
+	recipient := Recipient{Locale: "en-US", UnsubscribeURL: "https://example.com/unsubscribe?token=fixture"}
+	if _, err := Render(templateStr, brands[DefaultBrand], recipient, Fixture()); err != nil {
+		return fmt.Errorf("invalid email template: %w", err)
+	}
+
+	return nil
+}
+
+// Default returns the built-in template for a brand, falling back to the default brand when the
+// brand has no embedded templates.
+func Default(brand string) Template {
+	tmpl, err := Get(brand, "")
+	if err != nil {
+		tmpl, err = Get(DefaultBrand, "")
+		if err != nil {
+			panic(fmt.Sprintf("default brand %s has no embedded templates: %v", DefaultBrand, err))
+		}
+	}
+
+	return tmpl
+}
+
+// versionNumber extracts the numeric part of a 'vN' version so v10 sorts after v9.
+func versionNumber(version string) int {
+	n, err := strconv.Atoi(strings.TrimPrefix(version, "v"))
+	if err != nil {
+		return -1
+	}
+
+	return n
+}
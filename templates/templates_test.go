@@ -0,0 +1,103 @@
+package templates
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"stori-challenge/summary"
+)
+
+func TestEmbeddedTemplatesRender(t *testing.T) {
+	all, err := All()
+	require.NoError(t, err)
+	require.NotEmpty(t, all, "no embedded templates found")
+
+	summaryData := &summary.SummaryData{
+		TotalBalance:        10,
+		TransactionsByMonth: map[string]int{"2023-01": 2},
+		AvgCreditsByMonth:   map[string]float64{"2023-01": 20},
+		AvgDebitsByMonth:    map[string]float64{"2023-01": -10},
+		DebitTotal:          -10,
+		CreditTotal:         20,
+	}
+
+	for _, tmpl := range all {
+		brand, err := GetBrand(tmpl.Brand)
+		require.NoError(t, err, "template %s has no registered brand", tmpl.Key())
+
+		body, err := Render(tmpl.Body, brand, Recipient{}, summaryData)
+		require.NoError(t, err, "template %s failed to render", tmpl.Key())
+		require.Contains(t, body.String(), "2023-01")
+	}
+}
+
+func TestGetResolvesLatestVersion(t *testing.T) {
+	latest, err := Latest(DefaultBrand)
+	require.NoError(t, err)
+
+	tmpl, err := Get(DefaultBrand, "")
+	require.NoError(t, err)
+	require.Equal(t, latest, tmpl.Version)
+	require.Equal(t, Key(DefaultBrand, latest), tmpl.Key())
+
+	_, err = Get(DefaultBrand, "v0")
+	require.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	all, err := All()
+	require.NoError(t, err)
+	for _, tmpl := range all {
+		require.NoError(t, Validate(tmpl.Body), "embedded template %s is invalid", tmpl.Key())
+	}
+
+	require.Error(t, Validate(`<p>{{.TotalBalance</p>`), "unterminated action must be rejected")
+	require.Error(t, Validate(`<p>{{.UnknownField}}</p>`), "unknown field must be rejected")
+	require.Error(t, Validate(`<p>{{template "missing"}}</p>`), "undefined template must be rejected")
+}
+
+func TestDefaultFallsBackToDefaultBrand(t *testing.T) {
+	require.Equal(t, DefaultBrand, Default("no-such-brand").Brand)
+	require.Equal(t, "stori-plus", Default("stori-plus").Brand)
+}
+
+func TestRenderIncludesUnsubscribeLink(t *testing.T) {
+	brand, err := GetBrand(DefaultBrand)
+	require.NoError(t, err)
+	recipient := Recipient{Locale: "es-MX", UnsubscribeURL: "https://example.com/?token=abc"}
+
+	latest, err := Get(DefaultBrand, "")
+	require.NoError(t, err)
+	body, err := Render(latest.Body, brand, recipient, Fixture())
+	require.NoError(t, err)
+	require.Contains(t, body.String(), `href="https://example.com/?token=abc"`)
+	require.Contains(t, body.String(), `lang="es-MX"`)
+
+	text, err := RenderText(brand, recipient, Fixture())
+	require.NoError(t, err)
+	require.Contains(t, text.String(), "https://example.com/?token=abc")
+	require.Contains(t, text.String(), "Total Balance: 39.74")
+}
+
+func TestBrandsRenderDistinctBranding(t *testing.T) {
+	rendered := make(map[string]string)
+	for _, name := range []string{"stori", "stori-plus"} {
+		brand, err := GetBrand(name)
+		require.NoError(t, err)
+		require.NotEmpty(t, brand.LogoURL, "brand %s renders without a logo", name)
+
+		tmpl, err := Get(name, "")
+		require.NoError(t, err)
+		body, err := Render(tmpl.Body, brand, Recipient{}, Fixture())
+		require.NoError(t, err)
+		rendered[name] = body.String()
+	}
+
+	require.NotEqual(t, rendered["stori"], rendered["stori-plus"])
+	require.Contains(t, rendered["stori-plus"], "<h1>Stori Plus Account Summary</h1>")
+	require.NotContains(t, rendered["stori"], "Stori Plus")
+
+	// Without a logo of its own Stori Plus shows the default one, the registry does not copy it
+	require.Empty(t, brands["stori-plus"].LogoURL)
+	require.Contains(t, rendered["stori-plus"], `src="`+brands[DefaultBrand].LogoURL+`"`)
+}
@@ -0,0 +1,89 @@
+// Package tracing traces the lambdas with AWS X-Ray: the calls to S3, Lambda, Secrets Manager, SES, SQS and SNS,
+// the Postgres queries and the parse, store and notify steps become subsegments of the invocation. The synchronous
+// invokes and the state machine carry the trace from one lambda to the next, and the trace header also travels in
+// the summary message so the steps reached through the queues record the trace of the upload they belong to.
+//
+// Tracing is off until Setup finds the X-Ray daemon of an actively traced lambda, so tests and local runs do not
+// need one. Every lambda main has pipeline.Bootstrap call logging.Setup, metrics.Setup and then Setup before building
+// its clients: the log lines are then JSON with the secrets redacted, the metrics EMF records, and the AWS and
+// database calls are traced whenever the lambda has active tracing.
+package tracing
+
+import (
+	"context"
+	"database/sql/driver"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-xray-sdk-go/header"
+	"github.com/aws/aws-xray-sdk-go/instrumentation/awsv2"
+	"github.com/aws/aws-xray-sdk-go/xray"
+)
+
+// DaemonAddressEnv is set by Lambda when active tracing is enabled.
+const DaemonAddressEnv = "AWS_XRAY_DAEMON_ADDRESS"
+
+// Annotations of the step subsegments, searchable in X-Ray, e.g. annotation.run_id = "<run id>".
+const (
+	RunIDAnnotation         = "run_id"
+	UpstreamTraceAnnotation = "upstream_trace_id"
+)
+
+var enabled bool
+
+// Setup enables the tracing when the lambda is actively traced, call it first thing in main.
+func Setup(getenv func(string) string) {
+	enabled = getenv(DaemonAddressEnv) != ""
+}
+
+// InstrumentAWS traces the calls of the clients created from the configuration.
+func InstrumentAWS(cfg *aws.Config) {
+	if enabled {
+		awsv2.AWSV2Instrumentor(&cfg.APIOptions)
+	}
+}
+
+// Connector traces the connections and queries of a connection pool.
+func Connector(connector driver.Connector) driver.Connector {
+	if !enabled {
+		return connector
+	}
+
+	// The name is recorded as the connection string, the credentials are never part of it
+	return xray.SQLConnector("postgres", connector)
+}
+
+// StartStep begins the subsegment of a pipeline step, annotated with the run id. The upstream header is the one
+// the message carries: when the step runs in another trace, e.g. consuming a queue, the trace of the upload is
+// recorded as an annotation. Call the returned function with the outcome of the step.
+func StartStep(ctx context.Context, name, runID, upstream string) (context.Context, func(error)) {
+	if !enabled {
+		return ctx, func(error) {}
+	}
+
+	ctx, segment := xray.BeginSubsegment(ctx, name)
+	if segment == nil {
+		return ctx, func(error) {}
+	}
+
+	_ = segment.AddAnnotation(RunIDAnnotation, runID)
+	if upstreamTrace := header.FromString(upstream).TraceID; upstreamTrace != "" && upstreamTrace != segment.TraceID {
+		_ = segment.AddAnnotation(UpstreamTraceAnnotation, upstreamTrace)
+	}
+
+	return ctx, segment.Close
+}
+
+// Header returns the trace header of the current subsegment, to pass along in the payload of the next step. It is
+// empty when tracing is off.
+func Header(ctx context.Context) string {
+	if !enabled {
+		return ""
+	}
+
+	segment := xray.GetSegment(ctx)
+	if segment == nil {
+		return ""
+	}
+
+	return segment.DownstreamHeader().String()
+}
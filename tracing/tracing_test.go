@@ -0,0 +1,48 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-xray-sdk-go/header"
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDisabled(t *testing.T) {
+	Setup(func(string) string { return "" })
+
+	ctx, end := StartStep(context.Background(), "store", "run-1", "")
+	end(nil)
+	require.Nil(t, xray.GetSegment(ctx))
+	require.Empty(t, Header(ctx))
+}
+
+func TestStartStep(t *testing.T) {
+	Setup(func(string) string { return "127.0.0.1:2000" })
+	defer Setup(func(string) string { return "" })
+
+	ctx, segment := xray.BeginSegment(context.Background(), "store-summary-lambda")
+	defer segment.Close(nil)
+
+	// The trace of the upload reached through a queue is another trace
+	upstream := "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1"
+	stepCtx, end := StartStep(ctx, "store", "run-1", upstream)
+	step := xray.GetSegment(stepCtx)
+	require.NotNil(t, step)
+	require.Equal(t, "store", step.Name)
+	require.Equal(t, "run-1", step.Annotations[RunIDAnnotation])
+	require.Equal(t, "1-5759e988-bd862e3fe1be46a994272793", step.Annotations[UpstreamTraceAnnotation])
+
+	traceHeader := header.FromString(Header(stepCtx))
+	require.Equal(t, segment.TraceID, traceHeader.TraceID)
+	require.Equal(t, step.ID, traceHeader.ParentID)
+	end(errors.New("failed"))
+	require.True(t, step.Fault)
+
+	// The steps of the same trace are not annotated with it
+	stepCtx, end = StartStep(ctx, "notify", "run-1", Header(ctx))
+	defer end(nil)
+	require.NotContains(t, xray.GetSegment(stepCtx).Annotations, UpstreamTraceAnnotation)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"stori-challenge/logging"
+	"stori-challenge/pipeline"
+)
+
+const page = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <title>Account Summary</title>
+</head>
+<body>
+    <p>%s</p>
+</body>
+</html>
+`
+
+const confirmation = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <title>Account Summary</title>
+</head>
+<body>
+    <p>Do you want to stop receiving account summary emails?</p>
+    <form method="post" action="?token=%s">
+        <button type="submit">Unsubscribe</button>
+    </form>
+</body>
+</html>
+`
+
+// unsubscriber opts recipients out of the summary emails.
+type unsubscriber interface {
+	// Unsubscribe flips the unsubscribed flag of the recipient owning the token, reporting whether a recipient
+	// matched.
+	Unsubscribe(ctx context.Context, token string) (bool, error)
+}
+
+// respond renders a minimal HTML page for the browser following the unsubscribe link.
+func respond(status int, message string) events.LambdaFunctionURLResponse {
+	return events.LambdaFunctionURLResponse{
+		StatusCode: status,
+		Headers:    map[string]string{"Content-Type": "text/html; charset=utf-8"},
+		Body:       fmt.Sprintf(page, message),
+	}
+}
+
+// confirm renders the page asking the recipient to confirm, posting the form back to the link.
+func confirm(token string) events.LambdaFunctionURLResponse {
+	return events.LambdaFunctionURLResponse{
+		StatusCode: http.StatusOK,
+		Headers:    map[string]string{"Content-Type": "text/html; charset=utf-8"},
+		Body:       fmt.Sprintf(confirmation, html.EscapeString(url.QueryEscape(token))),
+	}
+}
+
+// Handler serves the unsubscribe link included in the summary emails.
+type Handler struct {
+	Recipients unsubscriber
+}
+
+// Handle serves /?token=<unsubscribe-token>. GET only renders a confirmation page, since mail scanners and link
+// prefetchers follow the links of the emails; the recipient is unsubscribed by the POST of that page or by the
+// RFC 8058 one-click POST of their mail client.
+func (h *Handler) Handle(ctx context.Context, request events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
+	token := request.QueryStringParameters["token"]
+	if token == "" {
+		return respond(http.StatusBadRequest, "The unsubscribe link is missing its token."), nil
+	}
+
+	switch request.RequestContext.HTTP.Method {
+	case http.MethodGet, http.MethodHead:
+		return confirm(token), nil
+	case http.MethodPost:
+	default:
+		response := respond(http.StatusMethodNotAllowed, "The unsubscribe link only supports GET and POST.")
+		response.Headers["Allow"] = "GET, HEAD, POST"
+		return response, nil
+	}
+
+	found, err := h.Recipients.Unsubscribe(ctx, token)
+	if err != nil {
+		logging.ErrorContext(ctx, "failed to unsubscribe", logging.Fields{"error": err})
+		return respond(http.StatusInternalServerError, "We could not process your request, please try again later."), nil
+	}
+
+	if !found {
+		return respond(http.StatusNotFound, "The unsubscribe link is invalid or has expired."), nil
+	}
+
+	return respond(http.StatusOK, "You have been unsubscribed from account summary emails."), nil
+}
+
+func main() {
+	_, db := pipeline.Bootstrap(context.Background())
+
+	handler := &Handler{Recipients: &pipeline.Postgres{DB: db}}
+
+	lambda.Start(handler.Handle)
+}
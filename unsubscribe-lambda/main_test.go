@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRecipients knows a single token.
+type fakeRecipients struct {
+	token        string
+	err          error
+	unsubscribed []string
+}
+
+func (f *fakeRecipients) Unsubscribe(_ context.Context, token string) (bool, error) {
+	if f.err != nil {
+		return false, f.err
+	}
+	if token != f.token {
+		return false, nil
+	}
+	f.unsubscribed = append(f.unsubscribed, token)
+
+	return true, nil
+}
+
+func request(method, token string) events.LambdaFunctionURLRequest {
+	request := events.LambdaFunctionURLRequest{QueryStringParameters: map[string]string{"token": token}}
+	request.RequestContext.HTTP.Method = method
+
+	return request
+}
+
+func TestHandle(t *testing.T) {
+	recipients := &fakeRecipients{token: "token-1"}
+	handler := &Handler{Recipients: recipients}
+
+	// Following the link only asks for a confirmation, link scanners must not unsubscribe anyone
+	response, err := handler.Handle(context.Background(), request(http.MethodGet, "token-1"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.Contains(t, response.Body, `<form method="post" action="?token=token-1">`)
+	require.Empty(t, recipients.unsubscribed)
+
+	// The confirmation form and the one-click unsubscribe of the mail clients post to the link
+	response, err = handler.Handle(context.Background(), request(http.MethodPost, "token-1"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.Contains(t, response.Body, "You have been unsubscribed")
+	require.Equal(t, []string{"token-1"}, recipients.unsubscribed)
+}
+
+func TestConfirmationEscapesToken(t *testing.T) {
+	handler := &Handler{Recipients: &fakeRecipients{}}
+
+	response, err := handler.Handle(context.Background(), request(http.MethodGet, `"><script>`))
+	require.NoError(t, err)
+	require.NotContains(t, response.Body, "<script>")
+	require.Contains(t, response.Body, `action="?token=%22%3E%3Cscript%3E"`)
+}
+
+func TestHandleErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		recipients *fakeRecipients
+		method     string
+		token      string
+		status     int
+	}{
+		{name: "missing token", recipients: &fakeRecipients{token: "token-1"}, status: http.StatusBadRequest},
+		{name: "unsupported method", recipients: &fakeRecipients{token: "token-1"}, method: http.MethodDelete, token: "token-1", status: http.StatusMethodNotAllowed},
+		{name: "unknown token", recipients: &fakeRecipients{token: "token-1"}, token: "token-2", status: http.StatusNotFound},
+		{name: "database down", recipients: &fakeRecipients{err: errors.New("connection refused")}, token: "token-1", status: http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := &Handler{Recipients: test.recipients}
+			method := test.method
+			if method == "" {
+				method = http.MethodPost
+			}
+
+			response, err := handler.Handle(context.Background(), request(method, test.token))
+			require.NoError(t, err, "errors are rendered as a page, not returned")
+			require.Equal(t, test.status, response.StatusCode)
+			require.NotContains(t, response.Body, "connection refused")
+		})
+	}
+}